@@ -0,0 +1,111 @@
+package function
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+/*
+AdminConfig holds the token of the admin endpoint, read from an environment variable (env:NAME) or from Secret Manager
+(secret:projects/.../versions/...). The endpoint is disabled without it.
+*/
+type AdminConfig struct {
+	Token string `json:"token"`
+	token []byte
+}
+
+// Header of the token of the admin endpoint, as the Authorization header holds the identity token of the caller
+const adminTokenHeader = "X-Admin-Token"
+
+func (config AdminConfig) Validate() error {
+	return validateTokenRef("admin", config.Token)
+}
+
+/*
+Check that the reference of the token of an endpoint is a secret reference, as the tokens are not written in the
+configuration
+*/
+func validateTokenRef(endpoint, ref string) error {
+	if ref != "" && !strings.HasPrefix(ref, "env:") && !strings.HasPrefix(ref, "secret:") {
+		return fmt.Errorf("invalid %s token: expected env:NAME or secret:projects/.../versions/...", endpoint)
+	}
+	return nil
+}
+
+/*
+Check the token of a request in its header, answering 404 when the endpoint has no token, as it is then disabled, and 401
+when the token of the request doesn't match
+*/
+func authorizeRequest(w http.ResponseWriter, r *http.Request, header string, token []byte) bool {
+	if len(token) == 0 {
+		http.Error(w, "endpoint not configured", http.StatusNotFound)
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get(header)), token) != 1 {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+/*
+AdminStatus is the state of the instance reported by the admin endpoint
+*/
+type AdminStatus struct {
+	Healthy bool               `json:"healthy"`
+	Tables  []TableHealth      `json:"tables"`
+	Spool   *SpoolingSinkStats `json:"spool,omitempty"`
+	Load    *LoadSinkStats     `json:"load,omitempty"`
+	Credits []CreditBalance    `json:"credits,omitempty"`
+}
+
+// runAdmin reports the health of the tables of the instance. The callers must send the token of the configuration: the
+// endpoint is disabled without it. The instance is never started by the endpoint, as its token is resolved when it
+// starts: a deployed function starts at init, and the worker before it serves. An instance that has not started is
+// reported unhealthy, without details. GET is read-only, and POST provisions the tables first: the unhealthy tables due
+// for a retry, and the tables of a lazily provisioned instance.
+// The status code is 503 when at least one table is unhealthy.
+func runAdmin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !started.Load() {
+		http.Error(w, "not started", http.StatusServiceUnavailable)
+		return
+	}
+	if !authorizeRequest(w, r, adminTokenHeader, bqContext.Admin.token) {
+		return
+	}
+	if r.Method == http.MethodPost {
+		for _, table := range bqContext.ManagedTables() {
+			// Errors are reported in the health of the tables
+			_, _ = bqContext.GetUploader(r.Context(), table)
+		}
+	}
+	status := AdminStatus{Healthy: true, Tables: bqContext.Health.Snapshot()}
+	for _, table := range status.Tables {
+		status.Healthy = status.Healthy && table.Healthy
+	}
+	if sink := spoolingSink.Load(); sink != nil {
+		stats := sink.Stats()
+		status.Spool = &stats
+	}
+	if sink := loadSink.Load(); sink != nil {
+		stats := sink.Stats()
+		status.Load = &stats
+	}
+	if bqContext.credits != nil {
+		status.Credits = bqContext.credits.Balances()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !status.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		logger.Error("Error encoding admin status", "error", err)
+	}
+}
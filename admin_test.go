@@ -0,0 +1,60 @@
+package function
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminEndpointRequiresTheToken(t *testing.T) {
+	const adminTablesConfig = `"tables": [{"source": "shop", "datasetId": "brevo", "tableId": "emails", "eventCategory": "transactional-email"}]`
+	t.Setenv("ADMIN_TOKEN", "s3cret")
+	tests := []struct {
+		name   string
+		config string
+		method string
+		token  string
+		status int
+	}{
+		{"no token configured", `{` + adminTablesConfig + `}`, http.MethodGet, "s3cret", http.StatusNotFound},
+		{"missing token", `{` + adminTablesConfig + `, "admin": {"token": "env:ADMIN_TOKEN"}}`, http.MethodGet, "", http.StatusUnauthorized},
+		{"invalid token", `{` + adminTablesConfig + `, "admin": {"token": "env:ADMIN_TOKEN"}}`, http.MethodPost, "s3cre", http.StatusUnauthorized},
+		{"valid token", `{` + adminTablesConfig + `, "admin": {"token": "env:ADMIN_TOKEN"}}`, http.MethodGet, "s3cret", http.StatusOK},
+		{"method not allowed", `{` + adminTablesConfig + `, "admin": {"token": "env:ADMIN_TOKEN"}}`, http.MethodDelete, "s3cret", http.StatusMethodNotAllowed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			startTestConsumer(t, test.config)
+			request := httptest.NewRequest(test.method, "/Admin", nil)
+			if test.token != "" {
+				request.Header.Set(adminTokenHeader, test.token)
+			}
+			response := httptest.NewRecorder()
+			runAdmin(response, request)
+			if response.Code != test.status {
+				t.Fatalf("status: got %d, want %d: %s", response.Code, test.status, response.Body)
+			}
+			if test.status != http.StatusOK {
+				// The state of the tables is only reported to the callers with the token
+				var status AdminStatus
+				if json.Unmarshal(response.Body.Bytes(), &status) == nil {
+					t.Errorf("status reported without the token: %s", response.Body)
+				}
+			}
+		})
+	}
+}
+
+func TestAdminEndpointDoesNotStartTheInstance(t *testing.T) {
+	t.Setenv("ADMIN_TOKEN", "s3cret")
+	startTestConsumer(t, `{"admin": {"token": "env:ADMIN_TOKEN"}}`)
+	started.Store(false)
+	request := httptest.NewRequest(http.MethodPost, "/Admin", nil)
+	request.Header.Set(adminTokenHeader, "s3cret")
+	response := httptest.NewRecorder()
+	runAdmin(response, request)
+	if response.Code != http.StatusServiceUnavailable {
+		t.Errorf("status: got %d, want %d", response.Code, http.StatusServiceUnavailable)
+	}
+}
@@ -0,0 +1,253 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	AggregateProjection = "aggregate"
+	AggregateCategory   = "aggregate"
+)
+
+const (
+	defaultAggregatesInterval = time.Minute
+	defaultAggregatesLookback = time.Hour
+	// Columns partitioning the staging and the aggregates tables, by which the merges select their rows. The staging
+	// table is also clustered by its partitioning column.
+	aggregatesStagingTimeColumn = "ReceivedAt"
+	aggregatesTimeColumn        = "Minute"
+	// How far back the last merge is searched in the aggregates table: before, all the staging rows are counted again
+	aggregatesLastMergeHorizon = 7 * 24 * time.Hour
+	// How long before their event time the events can be received, as the clocks of Brevo and of the instances differ
+	aggregatesClockSkew = 5 * time.Minute
+)
+
+/*
+AggregatesConfig holds the staging table receiving one row per event, the table of the per-minute aggregates merged from
+it, the interval of the merges of the worker, and the lookback of the merges: the minutes counted again by each merge
+*/
+type AggregatesConfig struct {
+	Staging  *Table   `json:"staging"`
+	Table    *Table   `json:"table"`
+	Interval Duration `json:"interval"`
+	Lookback Duration `json:"lookback"`
+}
+
+/*
+AggregateEventBigquery is a struct that represents an event in the staging table of the aggregates, in the bigquery
+format. The Pub/Sub message of the event is in the _metadata column of the row.
+*/
+type AggregateEventBigquery struct {
+	Source     bigquery.NullString    `json:"source"`
+	Category   bigquery.NullString    `json:"category"`
+	CampaignId bigquery.NullInt64     `json:"campaign_id"`
+	TemplateId bigquery.NullInt64     `json:"template_id"`
+	EventType  bigquery.NullString    `json:"event_type"`
+	EventTime  bigquery.NullTimestamp `json:"event_time"`
+	ReceivedAt time.Time              `json:"received_at"`
+}
+
+var AggregateEventBigqueryDescription = map[string]string{
+	"Source":     "Source attribute of the Pub/Sub message",
+	"Category":   "Event category",
+	"CampaignId": "Campaign id of the marketing events",
+	"TemplateId": "Template id of the transactional emails",
+	"EventType":  "Type of the event",
+	"EventTime":  "Time at which the event occurred",
+	"ReceivedAt": "Time at which the event was received",
+}
+
+/*
+AggregateBigquery is a struct that represents the number of events of a minute, source, category, campaign or template
+and event type, in the bigquery format
+*/
+type AggregateBigquery struct {
+	Minute     time.Time           `json:"minute"`
+	Key        string              `json:"key"`
+	Source     bigquery.NullString `json:"source"`
+	Category   bigquery.NullString `json:"category"`
+	CampaignId bigquery.NullInt64  `json:"campaign_id"`
+	TemplateId bigquery.NullInt64  `json:"template_id"`
+	EventType  bigquery.NullString `json:"event_type"`
+	Count      int64               `json:"count"`
+	UpdatedAt  time.Time           `json:"updated_at"`
+}
+
+var AggregateBigqueryDescription = map[string]string{
+	"Minute":     "Minute of the events",
+	"Key":        "Dimensions of the count, JSON encoded",
+	"Source":     "Source attribute of the Pub/Sub messages",
+	"Category":   "Event category",
+	"CampaignId": "Campaign id of the marketing events",
+	"TemplateId": "Template id of the transactional emails",
+	"EventType":  "Type of the events",
+	"Count":      "Number of distinct messages of the events",
+	"UpdatedAt":  "Time of the last merge of the count",
+}
+
+func projectAggregate(category, source string, event Event, payload []byte) any {
+	unified := projectUnified(category, source, event, payload).(UnifiedEventBigquery)
+	return AggregateEventBigquery{
+		Source:     unified.Source,
+		Category:   unified.Category,
+		CampaignId: unified.CampaignId,
+		TemplateId: unified.TemplateId,
+		EventType:  unified.EventType,
+		EventTime:  unified.EventTime,
+		ReceivedAt: time.Now().UTC(),
+	}
+}
+
+/*
+Validate the aggregates configuration: the staging and the aggregates tables are set together, and the staging rows are
+written as they are received, as the merges select them by the time they were written
+*/
+func (config AggregatesConfig) Validate() error {
+	if (config.Staging == nil) != (config.Table == nil) {
+		return fmt.Errorf("aggregates require both a staging and an aggregates table")
+	}
+	if config.Staging != nil && config.Staging.WriteMode == WriteModeLoad {
+		return fmt.Errorf("write mode %s of aggregates staging table %s is not supported", WriteModeLoad, config.Staging.Key())
+	}
+	return nil
+}
+
+/*
+Count again the minutes since the last merge minus the lookback, and return the number of counts merged.
+
+The events are written to the staging table before their message is acknowledged, like to their other tables, and a
+count is the number of distinct Pub/Sub messages of its minute and dimensions. The counts are thus exact whatever the
+crashes and the restarts of the workers, the redeliveries of the messages, and the number of workers: merging again
+gives the same counts. A count only grows, so that it is kept when the staging rows of its minute are purged by the
+retention of the staging table. The events are counted in the minute of their event time, or of the time their message
+was published when they have none. The events received after the lookback of their minute are not counted.
+
+The staging table is partitioned and clustered by the time the events were received, and the merge only reads the rows
+received since the start of the minutes it counts, so that its cost is the number of events of the lookback.
+*/
+func (bqContext *BqContext) MergeAggregates(ctx context.Context) (int64, error) {
+	config := bqContext.Worker.Aggregates
+	if config.Table == nil {
+		return 0, fmt.Errorf("no aggregates table configured")
+	}
+	lookback := config.Lookback.Duration
+	if lookback <= 0 {
+		lookback = defaultAggregatesLookback
+	}
+	client, err := bqContext.GetClient(*config.Table)
+	if err != nil {
+		return 0, err
+	}
+	lastMerge, err := bqContext.lastAggregatesMerge(ctx, client)
+	if err != nil {
+		return 0, err
+	}
+	// The first minute is a parameter, and not a subquery, so that BigQuery only reads the partitions from it
+	query := client.Query(aggregatesMergeStatement(bqContext.tableReference(*config.Staging), bqContext.tableReference(*config.Table)))
+	query.Parameters = []bigquery.QueryParameter{{Name: "since", Value: lastMerge.Add(-lookback)}}
+	query.Location = config.Table.Location
+	job, err := query.Run(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to run merge of aggregates table %s: %v", config.Table.Key(), err)
+	}
+	status, err := job.Wait(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to wait for merge of aggregates table %s: %v", config.Table.Key(), err)
+	}
+	if err := status.Err(); err != nil {
+		return 0, fmt.Errorf("merge of aggregates table %s failed: %v", config.Table.Key(), err)
+	}
+	var merged int64
+	if statistics, ok := status.Statistics.Details.(*bigquery.QueryStatistics); ok {
+		merged = statistics.NumDMLAffectedRows
+	}
+	logger.InfoContext(ctx, "Aggregates merged", "table", config.Table.Key(), "aggregates", merged)
+	return merged, nil
+}
+
+/*
+Time of the last merge of the aggregates, from the last update of the counts of the last days, or the zero time before
+the first merge. The counts are only updated when they grow: without events since, the next merges read the staging rows
+received since the last update, which are only those of the last events. The counts are only updated within the lookback
+of their minute, so that only the last partitions of the aggregates table are read.
+*/
+func (bqContext *BqContext) lastAggregatesMerge(ctx context.Context, client *bigquery.Client) (time.Time, error) {
+	table := *bqContext.Worker.Aggregates.Table
+	query := client.Query(fmt.Sprintf("SELECT MAX(UpdatedAt) FROM %s WHERE %s >= @horizon", bqContext.tableReference(table), aggregatesTimeColumn))
+	query.Parameters = []bigquery.QueryParameter{{Name: "horizon", Value: time.Now().UTC().Add(-aggregatesLastMergeHorizon)}}
+	query.Location = table.Location
+	it, err := query.Read(ctx)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to query aggregates table %s: %v", table.Key(), err)
+	}
+	var values []bigquery.Value
+	if err := it.Next(&values); err != nil && !errors.Is(err, iterator.Done) {
+		return time.Time{}, fmt.Errorf("failed to read aggregates table %s: %v", table.Key(), err)
+	}
+	if len(values) == 1 {
+		if updated, ok := values[0].(time.Time); ok {
+			return updated.UTC(), nil
+		}
+	}
+	// No count yet: all the staging rows are counted
+	return time.Unix(0, 0).UTC(), nil
+}
+
+/*
+MERGE statement of the staging table into the aggregates table. The minutes since the @since parameter are counted
+again from all their staging rows. The rows of a minute are received after it, give or take the clock skew of the event
+times: the staging rows are filtered on their receive time, the partitioning column of the staging table, so that only
+the partitions of the minutes are read.
+*/
+func aggregatesMergeStatement(staging, aggregates string) string {
+	return fmt.Sprintf(`MERGE %s AS T
+USING (
+  SELECT
+    Minute,
+    TO_JSON_STRING(STRUCT(Source, Category, CampaignId, TemplateId, EventType)) AS Key,
+    Source, Category, CampaignId, TemplateId, EventType,
+    COUNT(DISTINCT MessageId) AS Count
+  FROM (
+    SELECT
+      TIMESTAMP_TRUNC(COALESCE(EventTime, _metadata.PublishTime, ReceivedAt), MINUTE) AS Minute,
+      Source, Category, CampaignId, TemplateId, EventType,
+      _metadata.MessageId AS MessageId
+    FROM %s
+    WHERE %s >= TIMESTAMP_SUB(@since, INTERVAL %d MINUTE)
+  )
+  WHERE Minute >= TIMESTAMP_TRUNC(@since, MINUTE)
+  GROUP BY Minute, Source, Category, CampaignId, TemplateId, EventType
+) AS S
+ON T.Minute = S.Minute AND T.Key = S.Key AND T.%s >= TIMESTAMP_TRUNC(@since, MINUTE)
+WHEN MATCHED AND S.Count > T.Count THEN UPDATE SET Count = S.Count, UpdatedAt = CURRENT_TIMESTAMP()
+WHEN NOT MATCHED THEN INSERT (Minute, Key, Source, Category, CampaignId, TemplateId, EventType, Count, UpdatedAt)
+  VALUES (S.Minute, S.Key, S.Source, S.Category, S.CampaignId, S.TemplateId, S.EventType, S.Count, CURRENT_TIMESTAMP())`,
+		aggregates, staging, aggregatesStagingTimeColumn, int(aggregatesClockSkew.Minutes()), aggregatesTimeColumn)
+}
+
+/*
+Merge the aggregates periodically, until the context is done
+*/
+func (bqContext *BqContext) RunAggregates(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultAggregatesInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := bqContext.MergeAggregates(ctx); err != nil {
+			logger.ErrorContext(ctx, "Aggregates merge failed", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package function
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const aggregatesTestConfig = `{
+	"tables": [{"source": "shop", "datasetId": "brevo", "tableId": "emails", "eventCategory": "transactional-email"}],
+	"worker": {"aggregates": {
+		"staging": {"datasetId": "brevo", "tableId": "aggregate_events"},
+		"table": {"datasetId": "brevo", "tableId": "event_counts"}
+	}}
+}`
+
+func TestAggregateEventsAreStagedBeforeTheAck(t *testing.T) {
+	sink := startTestConsumer(t, aggregatesTestConfig)
+	attributes := map[string]string{"source": "shop", "category": "transactional-email"}
+	// A redelivered message is staged again, and counted once by the merges
+	for range 2 {
+		if err := publish(context.Background(), t, "m1", attributes, testTransactionalEmail); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rows := sink.Rows("brevo.aggregate_events")
+	if len(rows) != 2 {
+		t.Fatalf("staging rows: got %d, want 2", len(rows))
+	}
+	row := rows[0].Row.(AggregateEventBigquery)
+	if row.Category.StringVal != "transactional-email" || row.EventType.StringVal != "delivered" || row.TemplateId.Int64 != 12 || !row.EventTime.Valid {
+		t.Errorf("staging row: got %+v", row)
+	}
+	if rows[0].Metadata == nil || rows[0].Metadata.MessageId != "m1" {
+		t.Errorf("staging row without the id of its message: %+v", rows[0].Metadata)
+	}
+}
+
+func TestAggregatesMergeReadsTheStagingRowsOfTheLookback(t *testing.T) {
+	const staging, aggregates = "`p.brevo.aggregate_events`", "`p.brevo.event_counts`"
+	statement := aggregatesMergeStatement(staging, aggregates)
+	// The tables are read once, the staging table filtered by its partitioning column with a constant, so that BigQuery
+	// prunes its partitions: a subquery in the filter would read all of them
+	if n := strings.Count(statement, staging); n != 1 {
+		t.Errorf("staging table read %d times:\n%s", n, statement)
+	}
+	if n := strings.Count(statement, aggregates); n != 1 {
+		t.Errorf("aggregates table read %d times:\n%s", n, statement)
+	}
+	_, after, _ := strings.Cut(statement, staging)
+	filter, _, _ := strings.Cut(strings.TrimSpace(after), "\n")
+	if filter != "WHERE ReceivedAt >= TIMESTAMP_SUB(@since, INTERVAL 5 MINUTE)" {
+		t.Errorf("filter of the staging table: got %q, want the partitioning column compared to a parameter", filter)
+	}
+	for _, want := range []string{
+		"COUNT(DISTINCT MessageId)",
+		// Only the minutes of the lookback are counted again, from all their staging rows
+		"WHERE Minute >= TIMESTAMP_TRUNC(@since, MINUTE)",
+		"T.Minute >= TIMESTAMP_TRUNC(@since, MINUTE)",
+		// A merge never lowers a count, whose staging rows can be purged
+		"WHEN MATCHED AND S.Count > T.Count",
+	} {
+		if !strings.Contains(statement, want) {
+			t.Errorf("merge statement without %s:\n%s", want, statement)
+		}
+	}
+}
+
+func TestAggregatesStagingIsClusteredByReceiveTime(t *testing.T) {
+	staging := Table{Projection: AggregateProjection}
+	if clustering := staging.clustering(); clustering == nil || len(clustering.Fields) != 1 || clustering.Fields[0] != aggregatesStagingTimeColumn {
+		t.Errorf("clustering of the staging table: got %+v, want %s", clustering, aggregatesStagingTimeColumn)
+	}
+	if clustering := (Table{EventCategory: "transactional-email"}).clustering(); clustering != nil {
+		t.Errorf("clustering of an event table: got %+v, want none", clustering)
+	}
+}
+
+func TestAggregatesConfigValidation(t *testing.T) {
+	staging := &Table{DatasetId: "brevo", TableId: "aggregate_events"}
+	table := &Table{DatasetId: "brevo", TableId: "event_counts"}
+	tests := []struct {
+		name   string
+		config AggregatesConfig
+		valid  bool
+	}{
+		{"disabled", AggregatesConfig{}, true},
+		{"staging and table", AggregatesConfig{Staging: staging, Table: table}, true},
+		{"table without staging", AggregatesConfig{Table: table}, false},
+		{"staging without table", AggregatesConfig{Staging: staging}, false},
+		{"staging written by load jobs", AggregatesConfig{Staging: &Table{DatasetId: "brevo", TableId: "aggregate_events", WriteMode: WriteModeLoad}, Table: table}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.config.Validate(); (err == nil) != test.valid {
+				t.Errorf("Validate: got %v, want valid %v", err, test.valid)
+			}
+		})
+	}
+}
+
+func TestDrainWaitsForTheMessagesInFlight(t *testing.T) {
+	var gate drainGate
+	if !gate.Enter() {
+		t.Fatal("message rejected before the drain")
+	}
+	var drained sync.WaitGroup
+	drained.Add(1)
+	var drainErr error
+	go func() {
+		defer drained.Done()
+		drainErr = gate.Drain(context.Background())
+	}()
+	// The drain stops accepting messages before the messages in flight are done
+	deadline := time.Now().Add(time.Second)
+	for gate.Enter() {
+		gate.Leave()
+		if time.Now().After(deadline) {
+			t.Fatal("messages still accepted while draining")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	gate.Leave()
+	drained.Wait()
+	if drainErr != nil {
+		t.Errorf("Drain: %v", drainErr)
+	}
+
+	var stuck drainGate
+	stuck.Enter()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := stuck.Drain(ctx); err == nil {
+		t.Error("drain of a stuck message: no error")
+	}
+}
+
+func TestDrainedConsumerRejectsMessages(t *testing.T) {
+	sink := startTestConsumer(t, aggregatesTestConfig)
+	previous := consumers
+	consumers = &drainGate{}
+	t.Cleanup(func() { consumers = previous })
+	if err := consumers.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	attributes := map[string]string{"source": "shop", "category": "transactional-email"}
+	if err := publish(context.Background(), t, "m1", attributes, testTransactionalEmail); err == nil {
+		t.Error("message accepted by a drained consumer")
+	}
+	if calls := sink.Calls(); calls != 0 {
+		t.Errorf("rows written by a drained consumer: %d", calls)
+	}
+}
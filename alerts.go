@@ -0,0 +1,369 @@
+package function
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	RuleCount   = "count"
+	RuleRate    = "rate"
+	RuleAbsence = "absence"
+)
+
+const (
+	defaultAlertsInterval = time.Minute
+	defaultRuleCooldown   = time.Hour
+)
+
+/*
+AlertsConfig holds the alert rules evaluated on the events received by the consumer, and the interval of the checks of
+the rules that can be met without events, such as the absence rules
+*/
+type AlertsConfig struct {
+	Rules    []AlertRule `json:"rules"`
+	Interval Duration    `json:"interval"`
+}
+
+/*
+AlertRule is a condition on the events of the filter received during the window:
+  - count: more events matching the match filter than the threshold
+  - rate: a share of events matching the match filter above the threshold (0 to 1), once there are at least minEvents
+  - absence: no event matching the match filter during the window, which requires the worker
+
+With perSource, the condition is evaluated for each source separately. An alert is sent again after the cooldown while
+its condition holds.
+*/
+type AlertRule struct {
+	Name      string      `json:"name"`
+	Type      string      `json:"type"`
+	Filter    EventFilter `json:"filter"`
+	Match     EventFilter `json:"match"`
+	Window    Duration    `json:"window"`
+	Threshold float64     `json:"threshold"`
+	MinEvents int64       `json:"minEvents"`
+	Cooldown  Duration    `json:"cooldown"`
+	PerSource bool        `json:"perSource"`
+}
+
+/*
+EventFilter matches events on their source, category, event type and payload fields. All the conditions must match, and
+a filter without conditions matches every event. The event types are compared regardless of case, "_" and "-".
+*/
+type EventFilter struct {
+	Source     *Pattern           `json:"source"`
+	Categories []string           `json:"categories"`
+	EventTypes []string           `json:"eventTypes"`
+	Fields     map[string]Pattern `json:"fields"`
+}
+
+func (config AlertsConfig) Validate() error {
+	names := make(map[string]bool, len(config.Rules))
+	for _, rule := range config.Rules {
+		if rule.Name == "" {
+			return fmt.Errorf("alert rule without name")
+		}
+		if names[rule.Name] {
+			return fmt.Errorf("duplicate alert rule %s", rule.Name)
+		}
+		names[rule.Name] = true
+		switch rule.Type {
+		case RuleCount, RuleAbsence:
+		case RuleRate:
+			if rule.Threshold < 0 || rule.Threshold > 1 {
+				return fmt.Errorf("alert rule %s: rate threshold must be between 0 and 1", rule.Name)
+			}
+		default:
+			return fmt.Errorf("alert rule %s: invalid type: %s", rule.Name, rule.Type)
+		}
+		if rule.Window.Duration <= 0 {
+			return fmt.Errorf("alert rule %s: missing window", rule.Name)
+		}
+	}
+	return nil
+}
+
+/*
+Check that the rules can be evaluated by a deployed function. Its rules are only checked when an instance receives
+events, and each instance only sees its own events: an absence rule would be met by the idle instances, or never
+checked once all of them are idle. The absence rules require the worker.
+*/
+func (config AlertsConfig) ValidateFunction() error {
+	for _, rule := range config.Rules {
+		if rule.Type == RuleAbsence {
+			return fmt.Errorf("alert rule %s: rule type %s requires the worker", rule.Name, RuleAbsence)
+		}
+	}
+	return nil
+}
+
+/*
+Check whether the filter matches an event of the message, with its normalized event type
+*/
+func (filter EventFilter) matches(category, eventType string, message *RoutedMessage) bool {
+	if filter.Source != nil && !filter.Source.Match(message.Message.Attributes["source"]) {
+		return false
+	}
+	if len(filter.Categories) > 0 && !slices.Contains(filter.Categories, category) {
+		return false
+	}
+	if len(filter.EventTypes) > 0 && !slices.ContainsFunc(filter.EventTypes, func(t string) bool { return normalizeFieldName(t) == eventType }) {
+		return false
+	}
+	return RoutingRule{Fields: filter.Fields}.Matches(message)
+}
+
+// Events of a rule received during a second
+type ruleBucket struct {
+	at      time.Time
+	total   int64
+	matched int64
+}
+
+type ruleGroup struct {
+	buckets   []ruleBucket
+	lastMatch time.Time
+	// Time of the last alert while its condition holds
+	alerted map[string]time.Time
+}
+
+/*
+RuleEngine evaluates the alert rules on the events of the consumer. The windows are measured in the time the events are
+observed, so that a replay gives the same alerts as the stream it was recorded from.
+*/
+type RuleEngine struct {
+	config    AlertsConfig
+	mutex     sync.Mutex
+	lastCheck time.Time
+	// Groups of each rule, by source, or under an empty source for the rules that are not per source
+	groups []map[string]*ruleGroup
+}
+
+/*
+Create the engine of the rules, started at the time: the absence rules that are not per source are met when no event
+matches for a window after the start. The absence rules per source are evaluated from the first event of each source.
+*/
+func NewRuleEngine(config AlertsConfig, now time.Time) *RuleEngine {
+	if config.Interval.Duration <= 0 {
+		config.Interval.Duration = defaultAlertsInterval
+	}
+	engine := &RuleEngine{config: config, lastCheck: now, groups: make([]map[string]*ruleGroup, len(config.Rules))}
+	for i, rule := range config.Rules {
+		engine.groups[i] = make(map[string]*ruleGroup)
+		if !rule.PerSource {
+			engine.groups[i][""] = &ruleGroup{lastMatch: now, alerted: make(map[string]time.Time)}
+		}
+	}
+	return engine
+}
+
+/*
+Record an event in the rules whose filter matches it, and return the alerts whose condition is met. The rules are all
+checked once the interval has elapsed since the last check.
+*/
+func (engine *RuleEngine) Observe(category, source string, event Event, payload []byte, now time.Time) []Alert {
+	unified := projectUnified(category, source, event, nil).(UnifiedEventBigquery)
+	eventType := normalizeFieldName(unified.EventType.StringVal)
+	message := &RoutedMessage{Message: PubSubMessage{Attributes: map[string]string{"source": source}, Data: payload}}
+	engine.mutex.Lock()
+	defer engine.mutex.Unlock()
+	var alerts []Alert
+	for i, rule := range engine.config.Rules {
+		if !rule.Filter.matches(category, eventType, message) {
+			continue
+		}
+		key := ""
+		if rule.PerSource {
+			key = source
+		}
+		group, ok := engine.groups[i][key]
+		if !ok {
+			group = &ruleGroup{lastMatch: now, alerted: make(map[string]time.Time)}
+			engine.groups[i][key] = group
+		}
+		matched := rule.Match.matches(category, eventType, message)
+		group.record(now, matched)
+		if alert, ok := engine.evaluate(rule, key, group, now); ok {
+			alerts = append(alerts, alert)
+		}
+	}
+	if now.Sub(engine.lastCheck) >= engine.config.Interval.Duration {
+		alerts = append(alerts, engine.check(now)...)
+	}
+	return alerts
+}
+
+/*
+Check all the rules, and return the alerts whose condition is met
+*/
+func (engine *RuleEngine) Check(now time.Time) []Alert {
+	engine.mutex.Lock()
+	defer engine.mutex.Unlock()
+	return engine.check(now)
+}
+
+func (engine *RuleEngine) check(now time.Time) []Alert {
+	engine.lastCheck = now
+	var alerts []Alert
+	for i, rule := range engine.config.Rules {
+		for key, group := range engine.groups[i] {
+			if alert, ok := engine.evaluate(rule, key, group, now); ok {
+				alerts = append(alerts, alert)
+			}
+			// The sources without events in the window are forgotten, except by the absence rules which watch them
+			if rule.PerSource && rule.Type != RuleAbsence && len(group.buckets) == 0 && len(group.alerted) == 0 {
+				delete(engine.groups[i], key)
+			}
+		}
+	}
+	slices.SortFunc(alerts, func(a, b Alert) int {
+		return cmp.Or(cmp.Compare(a.Name, b.Name), cmp.Compare(a.Source, b.Source))
+	})
+	return alerts
+}
+
+func (group *ruleGroup) record(now time.Time, matched bool) {
+	at := now.Truncate(time.Second)
+	if n := len(group.buckets); n == 0 || !group.buckets[n-1].at.Equal(at) {
+		group.buckets = append(group.buckets, ruleBucket{at: at})
+	}
+	bucket := &group.buckets[len(group.buckets)-1]
+	bucket.total++
+	if matched {
+		bucket.matched++
+		group.lastMatch = now
+	}
+}
+
+/*
+Evaluate the condition of the rule on the events of the window of the group, and get the alert to send when it is met.
+The events older than the window are dropped.
+*/
+func (engine *RuleEngine) evaluate(rule AlertRule, key string, group *ruleGroup, now time.Time) (Alert, bool) {
+	window := rule.Window.Duration
+	group.buckets = slices.DeleteFunc(group.buckets, func(bucket ruleBucket) bool { return now.Sub(bucket.at) >= window })
+	var total, matched int64
+	for _, bucket := range group.buckets {
+		total += bucket.total
+		matched += bucket.matched
+	}
+	alert := Alert{Name: rule.Name, Source: key, Time: now}
+	if !rule.PerSource && rule.Filter.Source != nil {
+		alert.Source = rule.Filter.Source.raw
+	}
+	var condition bool
+	switch rule.Type {
+	case RuleCount:
+		condition = float64(matched) > rule.Threshold
+		alert.Message = fmt.Sprintf("%d matching events in %s, above %g", matched, window, rule.Threshold)
+		alert.Values = map[string]float64{"count": float64(matched), "threshold": rule.Threshold}
+	case RuleRate:
+		rate := 0.0
+		if total > 0 {
+			rate = float64(matched) / float64(total)
+		}
+		condition = total > 0 && total >= rule.MinEvents && rate > rule.Threshold
+		alert.Message = fmt.Sprintf("%.2f%% of %d events in %s, above %.2f%%", rate*100, total, window, rule.Threshold*100)
+		alert.Values = map[string]float64{"rate": rate, "count": float64(matched), "total": float64(total), "threshold": rule.Threshold}
+	case RuleAbsence:
+		silence := now.Sub(group.lastMatch)
+		condition = silence >= window
+		alert.Message = fmt.Sprintf("no events for %s", silence.Truncate(time.Second))
+		alert.Values = map[string]float64{"silenceSeconds": silence.Seconds()}
+	}
+	cooldown := rule.Cooldown.Duration
+	if cooldown <= 0 {
+		cooldown = defaultRuleCooldown
+	}
+	return alert, alertDue(group.alerted, rule.Name, condition, now, cooldown)
+}
+
+/*
+AlertFixture is an event of a replayed stream, observed at its time. A fixture without category only advances the
+time, to check the rules that can be met without events.
+*/
+type AlertFixture struct {
+	Time     time.Time       `json:"time"`
+	Source   string          `json:"source"`
+	Category string          `json:"category"`
+	Data     json.RawMessage `json:"data"`
+}
+
+/*
+Replay a stream of fixtures, one JSON object per line, through the alert rules, and return the alerts in the order they
+are sent. The engine starts at the time of the first fixture.
+*/
+func ReplayAlerts(config AlertsConfig, r io.Reader) ([]Alert, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	var engine *RuleEngine
+	var alerts []Alert
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var fixture AlertFixture
+		if err := json.Unmarshal(scanner.Bytes(), &fixture); err != nil {
+			return nil, fmt.Errorf("invalid fixture on line %d: %v", line, err)
+		}
+		if fixture.Time.IsZero() {
+			return nil, fmt.Errorf("missing time of the fixture on line %d", line)
+		}
+		if engine == nil {
+			engine = NewRuleEngine(config, fixture.Time)
+		}
+		if fixture.Category == "" {
+			alerts = append(alerts, engine.Check(fixture.Time)...)
+			continue
+		}
+		event, err := DecodeEvent(fixture.Category, fixture.Data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s event on line %d: %v", fixture.Category, line, err)
+		}
+		alerts = append(alerts, engine.Observe(fixture.Category, fixture.Source, event, fixture.Data, fixture.Time)...)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read fixtures: %v", err)
+	}
+	return alerts, nil
+}
+
+/*
+Evaluate the alert rules on an event, and send the alerts whose condition is met
+*/
+func (bqContext *BqContext) evaluateAlerts(ctx context.Context, category, source string, event Event, payload []byte) {
+	if bqContext.rules == nil {
+		return
+	}
+	for _, alert := range bqContext.rules.Observe(category, source, event, payload, time.Now()) {
+		bqContext.notify(ctx, alert)
+	}
+}
+
+/*
+Check the alert rules periodically, so that the absence rules are met without events, until the context is done
+*/
+func (bqContext *BqContext) RunAlerts(ctx context.Context) {
+	ticker := time.NewTicker(bqContext.rules.config.Interval.Duration)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, alert := range bqContext.rules.Check(time.Now()) {
+			bqContext.notify(ctx, alert)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package function
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+const bounceRule = `"filter": {"categories": ["transactional-email"]}, "match": {"eventTypes": ["hard_bounce"]}`
+
+func TestReplayAlerts(t *testing.T) {
+	tests := []struct {
+		name     string
+		fixtures string
+		rules    string
+		// Alerts in the order they are sent, with their time, name and source
+		want []string
+	}{
+		{
+			name:     "count",
+			fixtures: "bounces.jsonl",
+			rules:    `[{"name": "bounces", "type": "count", ` + bounceRule + `, "window": "5m", "threshold": 2}]`,
+			// The third bounce of the window is above the threshold, again once the first bounces leave the window
+			want: []string{"10:00:40 bounces", "10:20:20 bounces"},
+		},
+		{
+			name:     "count per source",
+			fixtures: "bounces.jsonl",
+			rules:    `[{"name": "bounces", "type": "count", ` + bounceRule + `, "window": "5m", "threshold": 0, "perSource": true}]`,
+			want:     []string{"10:00:10 bounces shop", "10:20:00 bounces shop"},
+		},
+		{
+			name:     "rate",
+			fixtures: "bounces.jsonl",
+			rules:    `[{"name": "bounce-rate", "type": "rate", ` + bounceRule + `, "window": "5m", "threshold": 0.5}]`,
+			// The first bounce of the second burst is the only event of its window
+			want: []string{"10:00:40 bounce-rate", "10:20:00 bounce-rate"},
+		},
+		{
+			name:     "rate with minEvents",
+			fixtures: "bounces.jsonl",
+			rules:    `[{"name": "bounce-rate", "type": "rate", ` + bounceRule + `, "window": "5m", "threshold": 0.5, "minEvents": 4}]`,
+			want:     []string{"10:00:40 bounce-rate", "10:20:30 bounce-rate"},
+		},
+		{
+			name:     "absence",
+			fixtures: "silence.jsonl",
+			rules:    `[{"name": "silence", "type": "absence", "filter": {"categories": ["transactional-email"]}, "window": "10m"}]`,
+			// The events of any source reset the silence
+			want: []string{"10:30:00 silence"},
+		},
+		{
+			name:     "absence per source",
+			fixtures: "silence.jsonl",
+			rules:    `[{"name": "silence", "type": "absence", "filter": {"categories": ["transactional-email"]}, "window": "5m", "perSource": true}]`,
+			// The sources are watched from their first event, and checked without events
+			want: []string{"10:08:00 silence blog", "10:20:00 silence shop"},
+		},
+		{
+			name:     "absence of a source",
+			fixtures: "silence.jsonl",
+			rules:    `[{"name": "blog-silence", "type": "absence", "filter": {"source": "blog"}, "window": "5m"}]`,
+			// Checked with the events of the other sources
+			want: []string{"10:08:00 blog-silence blog"},
+		},
+		{
+			name:     "cooldown",
+			fixtures: "bounces.jsonl",
+			rules:    `[{"name": "bounces", "type": "count", ` + bounceRule + `, "window": "30m", "threshold": 2, "cooldown": "10m"}]`,
+			// Sent again after the cooldown while the condition holds
+			want: []string{"10:00:40 bounces", "10:15:00 bounces"},
+		},
+		{
+			name:     "several rules",
+			fixtures: "bounces.jsonl",
+			rules: `[
+				{"name": "bounces", "type": "count", ` + bounceRule + `, "window": "5m", "threshold": 2},
+				{"name": "bounce-rate", "type": "rate", ` + bounceRule + `, "window": "5m", "threshold": 0.5, "minEvents": 4}
+			]`,
+			want: []string{"10:00:40 bounces", "10:00:40 bounce-rate", "10:20:20 bounces", "10:20:30 bounce-rate"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var config AlertsConfig
+			if err := json.Unmarshal([]byte(`{"rules": `+test.rules+`}`), &config); err != nil {
+				t.Fatal(err)
+			}
+			fixtures, err := os.Open(filepath.Join("testdata", "alerts", test.fixtures))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer fixtures.Close()
+			alerts, err := ReplayAlerts(config, fixtures)
+			if err != nil {
+				t.Fatalf("ReplayAlerts: %v", err)
+			}
+			got := make([]string, 0, len(alerts))
+			for _, alert := range alerts {
+				sent := fmt.Sprintf("%s %s", alert.Time.Format("15:04:05"), alert.Name)
+				if alert.Source != "" {
+					sent += " " + alert.Source
+				}
+				got = append(got, sent)
+			}
+			if !slices.Equal(got, test.want) {
+				t.Errorf("alerts:\ngot  %q\nwant %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestReplayAlertsRejectsInvalidStreams(t *testing.T) {
+	config := AlertsConfig{Rules: []AlertRule{{Name: "silence", Type: RuleAbsence, Window: Duration{time.Minute}}}}
+	tests := []struct {
+		name     string
+		fixtures string
+	}{
+		{"invalid json", `{"time": "2026-10-19T10:00:00Z"`},
+		{"missing time", `{"source": "shop"}`},
+		{"invalid event", `{"time": "2026-10-19T10:00:00Z", "category": "transactional-email", "data": []}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := ReplayAlerts(config, strings.NewReader(test.fixtures)); err == nil {
+				t.Error("no error")
+			}
+		})
+	}
+}
+
+func TestAbsenceRulesRequireTheWorker(t *testing.T) {
+	tests := []struct {
+		name     string
+		function string
+		rule     string
+		wantErr  bool
+	}{
+		{"absence rule of a deployed function", "RunPubSubConsumer", `{"name": "silence", "type": "absence", "window": "1h"}`, true},
+		{"count rule of a deployed function", "RunPubSubConsumer", `{"name": "bounces", "type": "count", ` + bounceRule + `, "window": "1h"}`, false},
+		{"absence rule of the worker", "", `{"name": "silence", "type": "absence", "window": "1h"}`, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("FUNCTION_TARGET", test.function)
+			path := filepath.Join(t.TempDir(), "config.json")
+			if err := os.WriteFile(path, []byte(`{"alerts": {"rules": [`+test.rule+`]}}`), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			var context BqContext
+			err := context.LoadTablesFromConfig(path)
+			if test.wantErr && (err == nil || !strings.Contains(err.Error(), "requires the worker")) {
+				t.Errorf("LoadTablesFromConfig: got %v, want the rule rejected", err)
+			}
+			if !test.wantErr && err != nil {
+				t.Errorf("LoadTablesFromConfig: %v", err)
+			}
+		})
+	}
+	// The rules of a function can still be replayed
+	t.Setenv("FUNCTION_TARGET", "RunPubSubConsumer")
+	config := AlertsConfig{Rules: []AlertRule{{Name: "silence", Type: RuleAbsence, Window: Duration{time.Hour}}}}
+	if _, err := ReplayAlerts(config, strings.NewReader(`{"time": "2026-10-19T10:00:00Z"}`)); err != nil {
+		t.Errorf("ReplayAlerts: %v", err)
+	}
+}
@@ -0,0 +1,220 @@
+package function
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/linkedin/goavro/v2"
+)
+
+const avroBlockRows = 1000
+
+/*
+Convert an NDJSON batch file to an Avro container file with the schema of the table. Timestamps are written with the
+timestamp-micros logical type.
+*/
+func convertBatchToAvro(table Table, ndjsonPath, avroPath string) error {
+	schema, err := table.Schema()
+	if err != nil {
+		return err
+	}
+	avroSchema, err := json.Marshal(avroRecord("root", schema))
+	if err != nil {
+		return err
+	}
+	input, err := os.Open(ndjsonPath)
+	if err != nil {
+		return fmt.Errorf("failed to open load batch: %v", err)
+	}
+	defer input.Close()
+	tmp := avroPath + ".tmp"
+	output, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to create avro batch: %v", err)
+	}
+	defer output.Close()
+	writer, err := goavro.NewOCFWriter(goavro.OCFConfig{W: output, Schema: string(avroSchema), CompressionName: goavro.CompressionDeflateLabel})
+	if err != nil {
+		return fmt.Errorf("failed to create avro writer: %v", err)
+	}
+	reader := bufio.NewReader(input)
+	block := make([]any, 0, avroBlockRows)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			var raw RawRow
+			if err := json.Unmarshal(line, &raw); err != nil {
+				return fmt.Errorf("failed to read load batch: %v", err)
+			}
+			values, err := decodeRawRow(raw)
+			if err != nil {
+				return fmt.Errorf("failed to read load batch: %v", err)
+			}
+			record, err := avroRecordValue("root", schema, values)
+			if err != nil {
+				return err
+			}
+			block = append(block, record)
+		}
+		if len(block) == avroBlockRows || (errors.Is(err, io.EOF) && len(block) > 0) {
+			if err := writer.Append(block); err != nil {
+				return fmt.Errorf("failed to write avro batch: %v", err)
+			}
+			block = block[:0]
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read load batch: %v", err)
+		}
+	}
+	if err := output.Sync(); err != nil {
+		return fmt.Errorf("failed to sync avro batch: %v", err)
+	}
+	if err := output.Close(); err != nil {
+		return fmt.Errorf("failed to close avro batch: %v", err)
+	}
+	return os.Rename(tmp, avroPath)
+}
+
+/*
+Avro schema of a record with the BigQuery schema. Nullable fields are unions with null, and the names of the nested
+records are prefixed by the names of their parents to be unique.
+*/
+func avroRecord(name string, schema bigquery.Schema) map[string]any {
+	fields := make([]any, 0, len(schema))
+	for _, field := range schema {
+		fieldType := avroType(name, field)
+		if field.Repeated {
+			fieldType = map[string]any{"type": "array", "items": fieldType}
+		} else if !field.Required {
+			fieldType = []any{"null", fieldType}
+		}
+		fields = append(fields, map[string]any{"name": field.Name, "type": fieldType})
+	}
+	return map[string]any{"type": "record", "name": name, "fields": fields}
+}
+
+func avroType(parent string, field *bigquery.FieldSchema) any {
+	switch field.Type {
+	case bigquery.IntegerFieldType:
+		return "long"
+	case bigquery.FloatFieldType:
+		return "double"
+	case bigquery.BooleanFieldType:
+		return "boolean"
+	case bigquery.BytesFieldType:
+		return "bytes"
+	case bigquery.TimestampFieldType:
+		return map[string]any{"type": "long", "logicalType": "timestamp-micros"}
+	case bigquery.RecordFieldType:
+		return avroRecord(parent+"_"+field.Name, field.Schema)
+	default:
+		return "string"
+	}
+}
+
+/*
+Name of the type of the field in its union with null
+*/
+func avroUnionName(parent string, field *bigquery.FieldSchema) string {
+	switch field.Type {
+	case bigquery.TimestampFieldType:
+		return "long.timestamp-micros"
+	case bigquery.RecordFieldType:
+		return parent + "_" + field.Name
+	default:
+		return avroType(parent, field).(string)
+	}
+}
+
+/*
+Convert the JSON values of a row to the native values of goavro
+*/
+func avroRecordValue(name string, schema bigquery.Schema, values map[string]any) (map[string]any, error) {
+	record := make(map[string]any, len(schema))
+	for _, field := range schema {
+		value := values[field.Name]
+		if field.Repeated {
+			list, _ := value.([]any)
+			items := make([]any, 0, len(list))
+			for _, item := range list {
+				converted, err := avroValue(name, field, item)
+				if err != nil {
+					return nil, err
+				}
+				items = append(items, converted)
+			}
+			record[field.Name] = items
+			continue
+		}
+		if value == nil {
+			if field.Required {
+				return nil, fmt.Errorf("missing required field %s", field.Name)
+			}
+			record[field.Name] = nil
+			continue
+		}
+		converted, err := avroValue(name, field, value)
+		if err != nil {
+			return nil, err
+		}
+		if !field.Required {
+			converted = goavro.Union(avroUnionName(name, field), converted)
+		}
+		record[field.Name] = converted
+	}
+	return record, nil
+}
+
+func avroValue(parent string, field *bigquery.FieldSchema, value any) (any, error) {
+	switch field.Type {
+	case bigquery.IntegerFieldType:
+		switch v := value.(type) {
+		case json.Number:
+			return v.Int64()
+		case string:
+			return strconv.ParseInt(v, 10, 64)
+		}
+	case bigquery.FloatFieldType:
+		switch v := value.(type) {
+		case json.Number:
+			return v.Float64()
+		case string:
+			return strconv.ParseFloat(v, 64)
+		}
+	case bigquery.BooleanFieldType:
+		if v, ok := value.(bool); ok {
+			return v, nil
+		}
+	case bigquery.BytesFieldType:
+		if v, ok := value.(string); ok {
+			return base64.StdEncoding.DecodeString(v)
+		}
+	case bigquery.TimestampFieldType:
+		if v, ok := value.(string); ok {
+			return time.Parse(time.RFC3339Nano, v)
+		}
+	case bigquery.RecordFieldType:
+		if v, ok := value.(map[string]any); ok {
+			return avroRecordValue(parent+"_"+field.Name, field.Schema, v)
+		}
+	default:
+		if v, ok := value.(string); ok {
+			return v, nil
+		}
+		// JSON and other values are written as their JSON text
+		encoded, err := json.Marshal(value)
+		return string(encoded), err
+	}
+	return nil, fmt.Errorf("invalid value %v of %s field %s", value, field.Type, field.Name)
+}
@@ -3,31 +3,127 @@ package function
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"slices"
+	"strings"
+	"sync"
+	"time"
 
 	"cloud.google.com/go/bigquery"
-	"google.golang.org/api/iterator"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
 )
 
 /*
 BqContext struct to hold the BigQuery client and configuration (projectId, datasetId)
 */
 type BqContext struct {
-	Ctx       context.Context
-	Client    *bigquery.Client
-	ProjectId string  `json:"projectId"`
-	Tables    []Table `json:"tables"`
-	Uploaders map[string]*bigquery.Uploader
+	Ctx             context.Context
+	Client          *bigquery.Client
+	ProjectId       string        `json:"projectId"`
+	Tables          []Table       `json:"tables"`
+	Routing         RoutingConfig `json:"routing"`
+	RouteBySource   bool          `json:"routeBySource"`
+	QuarantineTable *Table        `json:"quarantine"`
+	// Table receiving the events of all the categories in a common format, in addition to their routed tables
+	UnifiedTable *Table `json:"unified"`
+	// Message lifecycle state table, merged from its staging table
+	Lifecycle LifecycleConfig `json:"lifecycle"`
+	// Suppressed recipients, merged from their staging table
+	Suppression SuppressionConfig `json:"suppression"`
+	Datasets    []Dataset         `json:"datasets"`
+	// Provisioning settings: with lazyProvisioning, tables are provisioned on their first message instead of at startup
+	LazyProvisioning        bool `json:"lazyProvisioning"`
+	ProvisioningConcurrency int  `json:"provisioningConcurrency"`
+	// Timeout of each insert, within the deadline of the invocation
+	InsertTimeout Duration `json:"insertTimeout"`
+	// In-function retry of the transient errors
+	Retry RetryPolicy `json:"retry"`
+	// What to do with the messages of unhealthy tables: nack them (default) or quarantine them
+	UnhealthyPolicy string `json:"unhealthyPolicy"`
+	Health          *HealthRegistry
+	// Level, sampling and redaction of the logs
+	Logging LoggingConfig `json:"logging"`
+	// Keyset of the encrypted fields
+	Encryption EncryptionConfig `json:"encryption"`
+	// Audit of the erasures of contacts
+	Erasure ErasureConfig `json:"erasure"`
+	// Token of the admin endpoint
+	Admin AdminConfig `json:"admin"`
+	// Alerts on the SMS credit balance, and the endpoint receiving the alerts
+	Credits  CreditsConfig  `json:"credits"`
+	Notifier NotifierConfig `json:"notifier"`
+	// Alert rules on the events
+	Alerts AlertsConfig `json:"alerts"`
+	// Write the _metadata column in all the tables
+	RowMetadata bool `json:"rowMetadata"`
+	// Settings of the long-running worker
+	Worker            WorkerConfig `json:"worker"`
+	Sink              Sink         `json:"-"`
+	Uploaders         map[string]*bigquery.Uploader
+	uploadersMutex    sync.Mutex
+	clients           map[clientKey]*bigquery.Client
+	clientsMutex      sync.Mutex
+	transformers      map[string]*Transformer
+	keyset            *Keyset
+	credits           *CreditTracker
+	notifier          Notifier
+	notifications     chan notification
+	rules             *RuleEngine
+	ensuredDatasets   sync.Map
+	provisioningLocks sync.Map
 }
 
+const defaultProvisioningConcurrency = 8
+
+/*
+Table is a destination table. The projectId defaults to the project of the function, and the service account to the
+credentials of the function.
+*/
 type Table struct {
-	Source        string `json:"source"`
-	DatasetId     string `json:"datasetId"`
-	TableId       string `json:"tableId"`
-	EventCategory string `json:"eventCategory"`
+	Source                    string `json:"source"`
+	ProjectId                 string `json:"projectId"`
+	DatasetId                 string `json:"datasetId"`
+	TableId                   string `json:"tableId"`
+	Location                  string `json:"location"`
+	ImpersonateServiceAccount string `json:"impersonateServiceAccount"`
+	EventCategory             string `json:"eventCategory"`
+	Projection                string `json:"projection"`
+	// Store the payload of the messages in the payload column of the unified projection or of the quarantine table, off
+	// by default as it holds the personal data in clear, whatever the transforms of the other columns
+	Payload bool `json:"payload"`
+	// How the rows are written: streaming (default), storage-write or load
+	WriteMode string          `json:"writeMode"`
+	Load      TableLoadConfig `json:"load"`
+	// Write the trace and the Pub/Sub message of each row in its _metadata column
+	RowMetadata bool `json:"rowMetadata"`
+	// Transforms of the fields holding personal data, by path (email, Content.WorkPhone), and the restricted table
+	// receiving their original and transformed values
+	Transforms map[string]FieldTransform `json:"transforms"`
+	Vault      *Table                    `json:"vault"`
+	// How long the rows are kept: the partition expiration of a partitioned table, or the age of the purged rows
+	Retention Duration `json:"retention"`
+}
+
+/*
+Key of the table in the uploaders map and in the routing rules: datasetId.tableId, prefixed by the projectId when it is set
+*/
+func (table Table) Key() string {
+	if table.ProjectId != "" {
+		return fmt.Sprintf("%s.%s.%s", table.ProjectId, table.DatasetId, table.TableId)
+	}
+	return fmt.Sprintf("%s.%s", table.DatasetId, table.TableId)
+}
+
+/*
+BigQuery clients are pooled per project and identity
+*/
+type clientKey struct {
+	projectId      string
+	serviceAccount string
 }
 
 /*
@@ -41,15 +137,113 @@ func (bqContext *BqContext) InitBigqueryClient(projectId, configFilePath string)
 	}
 	bqContext.Ctx = context.Background()
 	bqContext.ProjectId = projectId
-	bqContext.Client, err = bigquery.NewClient(bqContext.Ctx, bqContext.ProjectId)
+	bqContext.clients = make(map[clientKey]*bigquery.Client)
+	bqContext.Client, err = bqContext.GetClient(Table{})
 	if err != nil {
 		return err
 	}
-	bqContext.Uploaders = make(map[string]*bigquery.Uploader)
+	bqContext.Sink = NewWriteModeSink(bqContext, nil)
+	if err := bqContext.initConsumer(bqContext.Ctx); err != nil {
+		return err
+	}
 	logger.Info("Tables loaded from config.json", "tables", bqContext.Tables)
 	return nil
 }
 
+/*
+Initialise the state of the consumer that doesn't depend on BigQuery: the health of the tables, the transformers, the
+alerts and the notifier. The tests start the consumer with it and a fake sink.
+*/
+func (bqContext *BqContext) initConsumer(ctx context.Context) error {
+	bqContext.Uploaders = make(map[string]*bigquery.Uploader)
+	bqContext.Health = NewHealthRegistry()
+	if err := bqContext.InitTransformers(ctx); err != nil {
+		return err
+	}
+	bqContext.credits = NewCreditTracker(bqContext.Credits)
+	if len(bqContext.Alerts.Rules) > 0 {
+		bqContext.rules = NewRuleEngine(bqContext.Alerts, time.Now())
+	}
+	var err error
+	if bqContext.notifier, err = bqContext.NewNotifier(ctx, bqContext.Notifier); err != nil {
+		return err
+	}
+	if ref := bqContext.Admin.Token; ref != "" {
+		if bqContext.Admin.token, err = bqContext.resolveSecret(ctx, ref); err != nil {
+			return fmt.Errorf("failed to resolve admin token: %v", err)
+		}
+	}
+	if ref := bqContext.Suppression.Token; ref != "" {
+		if bqContext.Suppression.token, err = bqContext.resolveSecret(ctx, ref); err != nil {
+			return fmt.Errorf("failed to resolve suppression token: %v", err)
+		}
+	}
+	return nil
+}
+
+/*
+Get the pooled BigQuery client of the project of the table, authenticated as its service account
+*/
+func (bqContext *BqContext) GetClient(table Table) (*bigquery.Client, error) {
+	key := bqContext.clientKey(table)
+	bqContext.clientsMutex.Lock()
+	defer bqContext.clientsMutex.Unlock()
+	if client, ok := bqContext.clients[key]; ok {
+		return client, nil
+	}
+	opts, err := bqContext.clientOptions(key)
+	if err != nil {
+		return nil, err
+	}
+	client, err := bigquery.NewClient(bqContext.Ctx, key.projectId, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create bigquery client for project %s: %v", key.projectId, err)
+	}
+	logger.Info("Bigquery client created", "projectId", key.projectId, "serviceAccount", key.serviceAccount)
+	bqContext.clients[key] = client
+	return client, nil
+}
+
+func (bqContext *BqContext) clientKey(table Table) clientKey {
+	key := clientKey{projectId: table.ProjectId, serviceAccount: table.ImpersonateServiceAccount}
+	if key.projectId == "" {
+		key.projectId = bqContext.ProjectId
+	}
+	return key
+}
+
+/*
+Options of the clients of the key, impersonating its service account when it is set. The scopes default to BigQuery.
+*/
+func (bqContext *BqContext) clientOptions(key clientKey, scopes ...string) ([]option.ClientOption, error) {
+	var opts []option.ClientOption
+	if len(scopes) == 0 {
+		scopes = []string{bigquery.Scope}
+	}
+	if key.serviceAccount != "" {
+		tokenSource, err := impersonate.CredentialsTokenSource(bqContext.Ctx, impersonate.CredentialsConfig{
+			TargetPrincipal: key.serviceAccount,
+			Scopes:          scopes,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to impersonate service account %s: %v", key.serviceAccount, err)
+		}
+		opts = append(opts, option.WithTokenSource(tokenSource))
+	}
+	return opts, nil
+}
+
+/*
+Get the handle of the BigQuery dataset of the table, with the client of the table
+*/
+func (bqContext *BqContext) GetDataset(table Table) (*bigquery.Dataset, error) {
+	client, err := bqContext.GetClient(table)
+	if err != nil {
+		return nil, err
+	}
+	return client.Dataset(table.DatasetId), nil
+}
+
 /*
 Load the tables from the config.json file
 */
@@ -68,67 +262,319 @@ func (bqContext *BqContext) LoadTablesFromConfig(filePath string) error {
 	if err != nil {
 		return fmt.Errorf("failed to parse configuration file: %v", err)
 	}
-	return nil
+	if bqContext.QuarantineTable != nil {
+		bqContext.QuarantineTable.EventCategory = QuarantineCategory
+		bqContext.QuarantineTable.RowMetadata = bqContext.QuarantineTable.RowMetadata || bqContext.RowMetadata
+	}
+	if bqContext.UnifiedTable != nil {
+		bqContext.UnifiedTable.Projection = UnifiedProjection
+		bqContext.UnifiedTable.RowMetadata = bqContext.UnifiedTable.RowMetadata || bqContext.RowMetadata
+		if vault := bqContext.UnifiedTable.Vault; vault != nil {
+			vault.EventCategory = VaultCategory
+			vault.RowMetadata = vault.RowMetadata || bqContext.RowMetadata
+		}
+	}
+	if err := bqContext.Alerts.Validate(); err != nil {
+		return err
+	}
+	if deployedFunction() {
+		if err := bqContext.Alerts.ValidateFunction(); err != nil {
+			return err
+		}
+	}
+	if err := bqContext.Lifecycle.Validate(); err != nil {
+		return err
+	}
+	if staging := bqContext.Lifecycle.Staging; staging != nil {
+		staging.Projection = LifecycleProjection
+		// The merges select the staging rows by the time they were written, in their _metadata column
+		staging.RowMetadata = true
+		if vault := staging.Vault; vault != nil {
+			vault.EventCategory = VaultCategory
+			vault.RowMetadata = vault.RowMetadata || bqContext.RowMetadata
+		}
+		bqContext.Lifecycle.State.EventCategory = LifecycleStateCategory
+		bqContext.Lifecycle.State.inheritTransforms(*staging)
+	}
+	if err := bqContext.Admin.Validate(); err != nil {
+		return err
+	}
+	if err := bqContext.Suppression.Validate(); err != nil {
+		return err
+	}
+	if staging := bqContext.Suppression.Staging; staging != nil {
+		staging.Projection = SuppressionProjection
+		// The merges select the staging rows by the time they were written, in their _metadata column
+		staging.RowMetadata = true
+		if vault := staging.Vault; vault != nil {
+			vault.EventCategory = VaultCategory
+			vault.RowMetadata = vault.RowMetadata || bqContext.RowMetadata
+		}
+		bqContext.Suppression.Table.EventCategory = SuppressionCategory
+		bqContext.Suppression.Table.inheritTransforms(*staging)
+	}
+	if err := bqContext.Worker.Aggregates.Validate(); err != nil {
+		return err
+	}
+	if staging := bqContext.Worker.Aggregates.Staging; staging != nil {
+		staging.Projection = AggregateProjection
+		// The merges count the distinct messages of the staging rows, and select them by the time they were written
+		staging.RowMetadata = true
+		bqContext.Worker.Aggregates.Table.EventCategory = AggregateCategory
+	}
+	if bqContext.Erasure.AuditTable != nil {
+		bqContext.Erasure.AuditTable.EventCategory = ErasureAuditCategory
+	}
+	for i := range bqContext.Tables {
+		bqContext.Tables[i].RowMetadata = bqContext.Tables[i].RowMetadata || bqContext.RowMetadata
+		if vault := bqContext.Tables[i].Vault; vault != nil {
+			vault.EventCategory = VaultCategory
+			vault.RowMetadata = vault.RowMetadata || bqContext.RowMetadata
+		}
+	}
+	if err := ConfigureLogging(bqContext.Logging); err != nil {
+		return err
+	}
+	bqContext.Retry = bqContext.Retry.WithDefaults()
+	switch bqContext.UnhealthyPolicy {
+	case "":
+		bqContext.UnhealthyPolicy = UnhealthyNack
+	case UnhealthyNack, UnhealthyQuarantine:
+	default:
+		return fmt.Errorf("invalid unhealthy policy: %s", bqContext.UnhealthyPolicy)
+	}
+	for _, table := range bqContext.ManagedTables() {
+		if _, ok := Projections[table.Projection]; table.Projection != "" && !ok {
+			return fmt.Errorf("projection %s of table %s not found", table.Projection, table.Key())
+		}
+		if err := table.ValidateWriteMode(); err != nil {
+			return err
+		}
+		if err := table.ValidateTransforms(); err != nil {
+			return err
+		}
+	}
+	return bqContext.InitRouting()
 }
 
 /*
-Create the bigquery table and uploader if it doesn't exist, by listing the existing tables in the dataset
+List all the tables managed by the function: the routed tables, the quarantine table, the unified table, the lifecycle
+and suppression tables, the aggregates tables and the vault tables
 */
-func (bqContext *BqContext) CreateTablesAndUploaders() error {
-	for _, table := range bqContext.Tables {
-		bqTable := bqContext.Client.Dataset(table.DatasetId).Table(table.TableId)
-		tables, err := bqContext.ListTables(table.DatasetId)
-		if err != nil {
-			return err
+func (bqContext *BqContext) ManagedTables() []Table {
+	tables := slices.Clone(bqContext.Tables)
+	if bqContext.QuarantineTable != nil {
+		tables = append(tables, *bqContext.QuarantineTable)
+	}
+	if bqContext.UnifiedTable != nil {
+		tables = append(tables, *bqContext.UnifiedTable)
+	}
+	if bqContext.Lifecycle.Staging != nil {
+		tables = append(tables, *bqContext.Lifecycle.Staging, *bqContext.Lifecycle.State)
+	}
+	if bqContext.Suppression.Staging != nil {
+		tables = append(tables, *bqContext.Suppression.Staging, *bqContext.Suppression.Table)
+	}
+	if bqContext.Worker.Aggregates.Staging != nil {
+		tables = append(tables, *bqContext.Worker.Aggregates.Staging, *bqContext.Worker.Aggregates.Table)
+	}
+	// Several tables can share a vault
+	for _, table := range slices.Clone(tables) {
+		if table.Vault != nil && !slices.ContainsFunc(tables, func(managed Table) bool { return managed.Key() == table.Vault.Key() }) {
+			tables = append(tables, *table.Vault)
 		}
-		if !slices.Contains(tables, table.TableId) {
-			logger.Info("Creating bigquery table", "table", bqTable)
-			var schema bigquery.Schema
-			switch table.EventCategory {
-			case "transactional-email":
-				schema, err = GenerateTableSchema(TransactionalEmailEventBigquery{}, TransactionalEmailEventBigqueryDescription)
-			case "marketing-email":
-				schema, err = GenerateTableSchema(MarketingEmailEventBigquery{}, MarketingEmailEventBigqueryDescription)
-			case "marketing-sms":
-				schema, err = GenerateTableSchema(MarketingSMSEventBigquery{}, MarketingSMSEventBigqueryDescription)
-			case "transactional-sms":
-				schema, err = GenerateTableSchema(TransactionalSMSEventBigquery{}, TransactionalSMSEventBigqueryDescription)
-			default:
-				return fmt.Errorf("schema not found for event category %s", table.EventCategory)
-			}
-			if err != nil {
-				return err
-			}
-			err = bqTable.Create(bqContext.Ctx, &bigquery.TableMetadata{Schema: schema})
-			if err != nil {
-				return err
-			}
-		} else {
-			logger.Info("Bigquery table already exists", "table", bqTable)
-		}
-		bqContext.Uploaders[fmt.Sprintf("%s.%s", table.DatasetId, table.TableId)] = bqTable.Uploader()
-		logger.Info("Uploader created", "source", table.Source, "datasetId", table.DatasetId, "tableId", table.TableId)
 	}
-	return nil
+	return tables
+}
+
+/*
+Create the bigquery datasets, tables and uploaders that don't exist yet, concurrently.
+With lazy provisioning, nothing is created here: each table is provisioned when its first message is received.
+*/
+func (bqContext *BqContext) CreateTablesAndUploaders(ctx context.Context) error {
+	if bqContext.LazyProvisioning {
+		logger.InfoContext(ctx, "Lazy provisioning enabled, tables will be provisioned on their first message")
+		return nil
+	}
+	concurrency := bqContext.ProvisioningConcurrency
+	if concurrency <= 0 {
+		concurrency = defaultProvisioningConcurrency
+	}
+	tables := bqContext.ManagedTables()
+	errs := make([]error, len(tables))
+	semaphore := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, table := range tables {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+			_, errs[i] = bqContext.GetUploader(ctx, table)
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
 }
 
 /*
-List all the tables in the dataset from the BqContext object
+Get the uploader of the table, provisioning its dataset and table first if it wasn't done yet.
+Successful provisioning is cached for the lifetime of the instance, and concurrent calls for the same table or dataset wait for a single provisioning.
+A table that failed to provision is unhealthy, and ErrTableUnhealthy is returned until its next attempt.
 */
-func (bqContext *BqContext) ListTables(datasetId string) ([]string, error) {
-	table := make([]string, 1)
-	ts := bqContext.Client.Dataset(datasetId).Tables(bqContext.Ctx)
-	for {
-		t, err := ts.Next()
-		if err == iterator.Done {
-			break
+func (bqContext *BqContext) GetUploader(ctx context.Context, table Table) (*bigquery.Uploader, error) {
+	unlock := bqContext.lock("table:" + table.Key())
+	defer unlock()
+	bqContext.uploadersMutex.Lock()
+	uploader, ok := bqContext.Uploaders[table.Key()]
+	bqContext.uploadersMutex.Unlock()
+	if ok {
+		return uploader, nil
+	}
+	if err := bqContext.Health.CanAttempt(table.Key()); err != nil {
+		return nil, err
+	}
+	uploader, err := bqContext.provisionTable(ctx, table)
+	if err != nil {
+		// A cancelled or expired request says nothing about the health of the table
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("%w: %w", ctx.Err(), err)
 		}
-		if err != nil {
-			return table, err
+		bqContext.Health.Failed(ctx, table.Key(), err)
+		return nil, fmt.Errorf("%w: %w", ErrTableUnhealthy, err)
+	}
+	bqContext.Health.Succeeded(ctx, table.Key())
+	bqContext.uploadersMutex.Lock()
+	bqContext.Uploaders[table.Key()] = uploader
+	bqContext.uploadersMutex.Unlock()
+	logger.InfoContext(ctx, "Uploader created", "source", table.Source, "table", table.Key())
+	return uploader, nil
+}
+
+/*
+Forget the uploader of a table that no longer exists, such as a table deleted by the default table expiration of its
+dataset, and mark the table unhealthy, so that it is created again by its next provisioning attempt. The returned error
+is an unhealthy table error, so that the message is handled by the unhealthy policy instead of being dropped.
+*/
+func (bqContext *BqContext) tableNotFound(ctx context.Context, table Table, err error) error {
+	bqContext.uploadersMutex.Lock()
+	delete(bqContext.Uploaders, table.Key())
+	bqContext.uploadersMutex.Unlock()
+	bqContext.Health.Failed(ctx, table.Key(), fmt.Errorf("table not found: %v", err))
+	return fmt.Errorf("%w: table %s not found: %w", ErrTableUnhealthy, table.Key(), err)
+}
+
+/*
+Create the dataset and the table if they don't exist, and return the uploader of the table. The tables with a retention
+and the tables of the aggregates are created partitioned.
+*/
+func (bqContext *BqContext) provisionTable(ctx context.Context, table Table) (*bigquery.Uploader, error) {
+	dataset, err := bqContext.GetDataset(table)
+	if err != nil {
+		return nil, err
+	}
+	if err := bqContext.ensureDatasetOnce(ctx, dataset, table); err != nil {
+		return nil, err
+	}
+	schema, err := table.Schema()
+	if err != nil {
+		return nil, err
+	}
+	bqTable := dataset.Table(table.TableId)
+	metadata, err := bqTable.Metadata(ctx)
+	if isNotFound(err) {
+		logger.InfoContext(ctx, "Creating bigquery table", "table", bqTable)
+		err = bqTable.Create(ctx, &bigquery.TableMetadata{Schema: schema, TimePartitioning: table.timePartitioning(schema), Clustering: table.clustering()})
+		if err != nil && !isAlreadyExists(err) {
+			return nil, fmt.Errorf("failed to create table %s: %v", table.Key(), err)
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get table %s: %v", table.Key(), err)
+	} else {
+		logger.InfoContext(ctx, "Bigquery table already exists", "table", bqTable)
+		if missing := missingFields(metadata, schema); len(missing) > 0 {
+			logger.WarnContext(ctx, "Bigquery table is missing fields of the schema, their values will be rejected", "table", table.Key(), "fields", missing)
+		}
+	}
+	return bqTable.Uploader(), nil
+}
+
+/*
+Get the fields of the schema that are missing from an existing table, such as _metadata.InsertedAt for the fields of
+records. The schemas of the existing tables are never changed by the consumer.
+*/
+func missingFields(metadata *bigquery.TableMetadata, schema bigquery.Schema) []string {
+	return missingSchemaFields(metadata.Schema, schema, "")
+}
+
+func missingSchemaFields(existing, schema bigquery.Schema, prefix string) []string {
+	var missing []string
+	for _, field := range schema {
+		index := slices.IndexFunc(existing, func(existing *bigquery.FieldSchema) bool { return strings.EqualFold(existing.Name, field.Name) })
+		switch {
+		case index < 0:
+			missing = append(missing, prefix+field.Name)
+		case field.Type == bigquery.RecordFieldType:
+			missing = append(missing, missingSchemaFields(existing[index].Schema, field.Schema, prefix+field.Name+".")...)
 		}
-		table = append(table, t.TableID)
 	}
-	return table, nil
+	return missing
+}
+
+/*
+Ensure the dataset once per instance, whatever the number of tables it holds
+*/
+func (bqContext *BqContext) ensureDatasetOnce(ctx context.Context, dataset *bigquery.Dataset, table Table) error {
+	key := dataset.ProjectID + "." + dataset.DatasetID
+	unlock := bqContext.lock("dataset:" + key)
+	defer unlock()
+	if _, ok := bqContext.ensuredDatasets.Load(key); ok {
+		return nil
+	}
+	if err := bqContext.EnsureDataset(ctx, table); err != nil {
+		return err
+	}
+	bqContext.ensuredDatasets.Store(key, true)
+	return nil
+}
+
+/*
+Lock a provisioning key, and return the function to unlock it
+*/
+func (bqContext *BqContext) lock(key string) func() {
+	mutex, _ := bqContext.provisioningLocks.LoadOrStore(key, &sync.Mutex{})
+	mutex.(*sync.Mutex).Lock()
+	return mutex.(*sync.Mutex).Unlock
+}
+
+/*
+Generate the BigQuery schema of the tables of an event category
+*/
+func GenerateCategorySchema(category string) (bigquery.Schema, error) {
+	switch category {
+	case "transactional-email":
+		return GenerateTableSchema(TransactionalEmailEventBigquery{}, TransactionalEmailEventBigqueryDescription)
+	case "marketing-email":
+		return GenerateTableSchema(MarketingEmailEventBigquery{}, MarketingEmailEventBigqueryDescription)
+	case "marketing-sms":
+		return GenerateTableSchema(MarketingSMSEventBigquery{}, MarketingSMSEventBigqueryDescription)
+	case "transactional-sms":
+		return GenerateTableSchema(TransactionalSMSEventBigquery{}, TransactionalSMSEventBigqueryDescription)
+	case QuarantineCategory:
+		return GenerateTableSchema(QuarantineRecordBigquery{}, QuarantineRecordBigqueryDescription)
+	case VaultCategory:
+		return GenerateTableSchema(VaultRecordBigquery{}, VaultRecordBigqueryDescription)
+	case ErasureAuditCategory:
+		return GenerateTableSchema(ErasureAuditBigquery{}, ErasureAuditBigqueryDescription)
+	case LifecycleStateCategory:
+		return GenerateTableSchema(LifecycleStateBigquery{}, LifecycleStateBigqueryDescription)
+	case SuppressionCategory:
+		return GenerateTableSchema(SuppressionBigquery{}, SuppressionBigqueryDescription)
+	case AggregateCategory:
+		return GenerateTableSchema(AggregateBigquery{}, AggregateBigqueryDescription)
+	default:
+		return nil, fmt.Errorf("schema not found for event category %s", category)
+	}
 }
 
 /*
@@ -153,13 +599,25 @@ func GenerateTableSchema(model any, descriptions map[string]string) (bigquery.Sc
 }
 
 /*
-Get the target table for the source
+Get a managed table (routed or quarantine) from its key
+*/
+func (bqContext *BqContext) GetManagedTable(key string) (Table, error) {
+	for _, table := range bqContext.ManagedTables() {
+		if table.Key() == key {
+			return table, nil
+		}
+	}
+	return Table{}, fmt.Errorf("table not found: %s", key)
+}
+
+/*
+Get a configured table from its key (datasetId.tableId)
 */
-func (bqContext *BqContext) GetTargetTable(source string) (string, string, error) {
+func (bqContext *BqContext) GetTable(key string) (Table, error) {
 	for _, table := range bqContext.Tables {
-		if table.Source == source {
-			return table.DatasetId, table.TableId, nil
+		if table.Key() == key {
+			return table, nil
 		}
 	}
-	return "", "", fmt.Errorf("table not found for source: %s", source)
+	return Table{}, fmt.Errorf("table not found: %s", key)
 }
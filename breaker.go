@@ -0,0 +1,103 @@
+package function
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+/*
+BreakerConfig holds the settings of the circuit breaker of the sink: it opens after failureThreshold consecutive
+failures, and lets a probe through after openTimeout.
+*/
+type BreakerConfig struct {
+	FailureThreshold int      `json:"failureThreshold"`
+	OpenTimeout      Duration `json:"openTimeout"`
+}
+
+/*
+CircuitBreaker stops calling an unavailable sink. Once open, a single probe is let through after the open timeout:
+the breaker closes if it succeeds, and opens again if it fails.
+*/
+type CircuitBreaker struct {
+	mu               sync.Mutex
+	state            string
+	failures         int
+	openedAt         time.Time
+	failureThreshold int
+	openTimeout      time.Duration
+}
+
+func NewCircuitBreaker(config BreakerConfig) *CircuitBreaker {
+	breaker := &CircuitBreaker{state: BreakerClosed, failureThreshold: config.FailureThreshold, openTimeout: config.OpenTimeout.Duration}
+	if breaker.failureThreshold <= 0 {
+		breaker.failureThreshold = 5
+	}
+	if breaker.openTimeout <= 0 {
+		breaker.openTimeout = 30 * time.Second
+	}
+	return breaker
+}
+
+/*
+Check whether the sink can be called. When the open timeout has elapsed, the breaker becomes half-open and lets one probe through.
+*/
+func (breaker *CircuitBreaker) Allow(ctx context.Context) bool {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+	switch breaker.state {
+	case BreakerClosed:
+		return true
+	case BreakerOpen:
+		if time.Since(breaker.openedAt) >= breaker.openTimeout {
+			breaker.setState(ctx, BreakerHalfOpen)
+			return true
+		}
+		return false
+	default:
+		// A probe is already in progress
+		return false
+	}
+}
+
+/*
+Record a successful call of the sink
+*/
+func (breaker *CircuitBreaker) Success(ctx context.Context) {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+	breaker.failures = 0
+	if breaker.state != BreakerClosed {
+		breaker.setState(ctx, BreakerClosed)
+	}
+}
+
+/*
+Record a failed call of the sink
+*/
+func (breaker *CircuitBreaker) Failure(ctx context.Context) {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+	breaker.failures++
+	if breaker.state == BreakerHalfOpen || (breaker.state == BreakerClosed && breaker.failures >= breaker.failureThreshold) {
+		breaker.openedAt = time.Now()
+		breaker.setState(ctx, BreakerOpen)
+	}
+}
+
+func (breaker *CircuitBreaker) State() string {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+	return breaker.state
+}
+
+func (breaker *CircuitBreaker) setState(ctx context.Context, state string) {
+	logger.WarnContext(ctx, "Circuit breaker state changed", "previousState", breaker.state, "state", state, "failures", breaker.failures)
+	breaker.state = state
+}
@@ -0,0 +1,354 @@
+// Command brevoctl runs the administration tasks of the consumer on the tables of its configuration. It is configured
+// like the function, with GCP_PROJECT_ID and CONFIG_FILE_PATH.
+//
+//	brevoctl erase [-dry-run] [-requester name] <email or phone number>
+//	brevoctl export [-format json|csv] [-output file] <email or phone number>
+//	brevoctl retention apply|report [-json]
+//	brevoctl lifecycle merge
+//	brevoctl aggregates merge
+//	brevoctl suppression lookup <email or phone number>
+//	brevoctl suppression export [-output file]
+//	brevoctl suppression merge
+//	brevoctl notify [-message text]
+//	brevoctl alerts replay [-json] <fixtures file>
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	function "upd.com/brevo-pubsub-consumer"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	var err error
+	switch os.Args[1] {
+	case "erase":
+		err = erase(context.Background(), os.Args[2:])
+	case "export":
+		err = export(context.Background(), os.Args[2:])
+	case "retention":
+		err = retention(context.Background(), os.Args[2:])
+	case "lifecycle":
+		err = lifecycle(context.Background(), os.Args[2:])
+	case "aggregates":
+		err = aggregates(context.Background(), os.Args[2:])
+	case "suppression":
+		err = suppression(context.Background(), os.Args[2:])
+	case "notify":
+		err = notify(context.Background(), os.Args[2:])
+	case "alerts":
+		err = alerts(os.Args[2:])
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "brevoctl: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: brevoctl erase [-dry-run] [-requester name] <email or phone number>")
+	fmt.Fprintln(os.Stderr, "       brevoctl export [-format json|csv] [-output file] <email or phone number>")
+	fmt.Fprintln(os.Stderr, "       brevoctl retention apply|report [-json]")
+	fmt.Fprintln(os.Stderr, "       brevoctl lifecycle merge")
+	fmt.Fprintln(os.Stderr, "       brevoctl aggregates merge")
+	fmt.Fprintln(os.Stderr, "       brevoctl suppression lookup <email or phone number>")
+	fmt.Fprintln(os.Stderr, "       brevoctl suppression export [-output file]")
+	fmt.Fprintln(os.Stderr, "       brevoctl suppression merge")
+	fmt.Fprintln(os.Stderr, "       brevoctl notify [-message text]")
+	fmt.Fprintln(os.Stderr, "       brevoctl alerts replay [-json] <fixtures file>")
+	os.Exit(2)
+}
+
+/*
+Load the configuration of the consumer, without provisioning its tables
+*/
+func loadContext() (*function.BqContext, error) {
+	bqContext := &function.BqContext{}
+	if err := bqContext.InitBigqueryClient(os.Getenv("GCP_PROJECT_ID"), os.Getenv("CONFIG_FILE_PATH")); err != nil {
+		return nil, err
+	}
+	return bqContext, nil
+}
+
+/*
+Erase the rows of a contact in all the tables, and print the report
+*/
+func erase(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("erase", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "count the rows of the contact without deleting them")
+	requester := flags.String("requester", os.Getenv("USER"), "who requested the erasure, written in the audit records")
+	_ = flags.Parse(args)
+	if flags.NArg() != 1 {
+		usage()
+	}
+	bqContext, err := loadContext()
+	if err != nil {
+		return err
+	}
+	report, err := bqContext.Erase(ctx, function.ErasureRequest{Identifier: flags.Arg(0), Requester: *requester, DryRun: *dryRun})
+	if report != nil {
+		if err := printJSON(report); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+/*
+Export the rows of a contact in all the tables as a timeline, for a subject access request
+*/
+func export(ctx context.Context, args []string) (err error) {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	format := flags.String("format", function.ExportJSON, "format of the export: json or csv")
+	output := flags.String("output", "", "file of the export, the standard output by default")
+	_ = flags.Parse(args)
+	if flags.NArg() != 1 || (*format != function.ExportJSON && *format != function.ExportCSV) {
+		usage()
+	}
+	bqContext, err := loadContext()
+	if err != nil {
+		return err
+	}
+	subject, err := bqContext.Export(ctx, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	w := os.Stdout
+	if *output != "" {
+		// The export holds personal data: only its owner can read it
+		if w, err = os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600); err != nil {
+			return err
+		}
+		defer func() {
+			if closeErr := w.Close(); err == nil {
+				err = closeErr
+			}
+		}()
+	}
+	if *format == function.ExportCSV {
+		return subject.WriteCSV(w)
+	}
+	return subject.WriteJSON(w)
+}
+
+/*
+Enforce the retention of the tables, or report their oldest data against their retention
+*/
+func retention(ctx context.Context, args []string) error {
+	if len(args) == 0 || (args[0] != "apply" && args[0] != "report") {
+		usage()
+	}
+	flags := flag.NewFlagSet("retention", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "print the results in JSON")
+	_ = flags.Parse(args[1:])
+	bqContext, err := loadContext()
+	if err != nil {
+		return err
+	}
+	if args[0] == "apply" {
+		results, err := bqContext.ApplyRetention(ctx)
+		if *asJSON {
+			return errors.Join(printJSON(results), err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "TABLE\tRETENTION\tACTION\tCUTOFF\tROWS\tERROR")
+		for _, result := range results {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\n", result.Table, days(result.Retention), result.Action, result.Cutoff.Format(time.DateOnly), result.Rows, result.Error)
+		}
+		return errors.Join(w.Flush(), err)
+	}
+	statuses, err := bqContext.RetentionReport(ctx)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(statuses)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TABLE\tRETENTION\tPARTITION EXPIRATION\tOLDEST\tROWS\tEXPIRED ROWS\tUNDATED ROWS\tSTATUS\tERROR")
+	for _, status := range statuses {
+		oldest := "-"
+		if status.Oldest != nil {
+			oldest = status.Oldest.Format(time.DateOnly)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\t%d\t%s\t%s\n", status.Table, days(status.Retention), days(status.PartitionExpiration), oldest, status.Rows, status.ExpiredRows, status.UndatedRows, status.Status, status.Error)
+	}
+	return w.Flush()
+}
+
+/*
+Format a retention in days, like in the configuration
+*/
+func days(d function.Duration) string {
+	if d.Duration <= 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%gd", d.Hours()/24)
+}
+
+func printJSON(value any) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
+
+func lifecycle(ctx context.Context, args []string) error {
+	if len(args) != 1 || args[0] != "merge" {
+		usage()
+	}
+	bqContext, err := loadContext()
+	if err != nil {
+		return err
+	}
+	merged, err := bqContext.MergeLifecycle(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d messages merged\n", merged)
+	return nil
+}
+
+func aggregates(ctx context.Context, args []string) error {
+	if len(args) != 1 || args[0] != "merge" {
+		usage()
+	}
+	bqContext, err := loadContext()
+	if err != nil {
+		return err
+	}
+	merged, err := bqContext.MergeAggregates(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d aggregates merged\n", merged)
+	return nil
+}
+
+/*
+Look up the suppressions of a recipient, export all the suppressions in CSV, or merge the suppression events
+*/
+func suppression(ctx context.Context, args []string) (err error) {
+	if len(args) == 0 {
+		usage()
+	}
+	flags := flag.NewFlagSet("suppression", flag.ExitOnError)
+	output := flags.String("output", "", "file of the export, the standard output by default")
+	_ = flags.Parse(args[1:])
+	switch {
+	case args[0] == "lookup" && flags.NArg() == 1:
+	case (args[0] == "export" || args[0] == "merge") && flags.NArg() == 0:
+	default:
+		usage()
+	}
+	bqContext, err := loadContext()
+	if err != nil {
+		return err
+	}
+	switch args[0] {
+	case "lookup":
+		suppressions, err := bqContext.LookupSuppressions(ctx, flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "RECIPIENT\tCHANNEL\tREASON\tFIRST SEEN\tLAST SEEN\tSOURCE")
+		for _, s := range suppressions {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", s.Recipient, s.Channel, s.Reason, s.FirstSeen.Format(time.RFC3339), s.LastSeen.Format(time.RFC3339), s.Source)
+		}
+		return w.Flush()
+	case "merge":
+		merged, err := bqContext.MergeSuppressions(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d suppressions merged\n", merged)
+		return nil
+	}
+	w := os.Stdout
+	if *output != "" {
+		// The suppressions hold personal data: only their owner can read them
+		if w, err = os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600); err != nil {
+			return err
+		}
+		defer func() {
+			if closeErr := w.Close(); err == nil {
+				err = closeErr
+			}
+		}()
+	}
+	return bqContext.ExportSuppressions(ctx, w)
+}
+
+/*
+Send a test alert with the notifier of the configuration
+*/
+func notify(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("notify", flag.ExitOnError)
+	message := flags.String("message", "Test alert", "message of the alert")
+	_ = flags.Parse(args)
+	if flags.NArg() != 0 {
+		usage()
+	}
+	bqContext, err := loadContext()
+	if err != nil {
+		return err
+	}
+	notifier, err := bqContext.NewNotifier(ctx, bqContext.Notifier)
+	if err != nil {
+		return err
+	}
+	if notifier == nil {
+		return fmt.Errorf("no notifier configured")
+	}
+	return notifier.Notify(ctx, function.Alert{Name: "test", Message: *message, Time: time.Now().UTC()})
+}
+
+/*
+Replay a stream of fixtures through the alert rules of the configuration, and print the alerts. Only the configuration
+file is read: the replay doesn't need BigQuery nor the notifier.
+*/
+func alerts(args []string) error {
+	if len(args) == 0 || args[0] != "replay" {
+		usage()
+	}
+	flags := flag.NewFlagSet("alerts", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "print the alerts in JSON")
+	_ = flags.Parse(args[1:])
+	if flags.NArg() != 1 {
+		usage()
+	}
+	bqContext := &function.BqContext{}
+	if err := bqContext.LoadTablesFromConfig(os.Getenv("CONFIG_FILE_PATH")); err != nil {
+		return err
+	}
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	alerts, err := function.ReplayAlerts(bqContext.Alerts, file)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(alerts)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tRULE\tSOURCE\tMESSAGE")
+	for _, alert := range alerts {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", alert.Time.Format(time.RFC3339), alert.Name, alert.Source, alert.Message)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,26 @@
+// Command worker runs the consumer as a long-running HTTP server, for Cloud Run or a VM, instead of a Cloud Function.
+// It is configured like the function, with GCP_PROJECT_ID and CONFIG_FILE_PATH, and listens on PORT (default 8080).
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	function "upd.com/brevo-pubsub-consumer"
+)
+
+func main() {
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+	// The worker stops on SIGTERM, draining the messages being consumed
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	if err := function.RunWorker(ctx, port); err != nil {
+		log.Fatalf("worker: %v", err)
+	}
+}
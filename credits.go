@@ -0,0 +1,207 @@
+package function
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	AlertLowBalance = "sms-credits-low-balance"
+	AlertDepletion  = "sms-credits-depletion"
+)
+
+const (
+	defaultCreditsWindow   = time.Hour
+	defaultCreditsCooldown = time.Hour
+	// Shortest period of the spend rate after a start, so that the first events don't forecast an immediate depletion
+	minCreditsRatePeriod = 5 * time.Minute
+)
+
+/*
+CreditsConfig holds the alerts on the SMS credit balance of each source: below the low balance, or when the spend rate of
+the window forecasts its depletion within the depletion duration. An alert is sent again after the cooldown while its
+condition holds.
+*/
+type CreditsConfig struct {
+	LowBalance float64  `json:"lowBalance"`
+	Depletion  Duration `json:"depletion"`
+	Window     Duration `json:"window"`
+	Cooldown   Duration `json:"cooldown"`
+}
+
+/*
+CreditBalance is the latest SMS credit balance of a source, with its spend rate in credits per hour
+*/
+type CreditBalance struct {
+	Source      string     `json:"source"`
+	Remaining   float64    `json:"remaining"`
+	UpdatedAt   time.Time  `json:"updatedAt"`
+	Rate        float64    `json:"rate"`
+	DepletionAt *time.Time `json:"depletionAt,omitempty"`
+}
+
+type creditSpend struct {
+	at      time.Time
+	credits float64
+}
+
+type creditSource struct {
+	remaining float64
+	updatedAt time.Time
+	started   time.Time
+	spends    []creditSpend
+	// Time of the last alert, by alert name, while its condition holds
+	alerted map[string]time.Time
+}
+
+/*
+CreditTracker tracks the latest SMS credit balance and the spend rate of each source, from the remaining credits and the
+credits used by the SMS events
+*/
+type CreditTracker struct {
+	config  CreditsConfig
+	mutex   sync.Mutex
+	sources map[string]*creditSource
+}
+
+func NewCreditTracker(config CreditsConfig) *CreditTracker {
+	if config.Window.Duration <= 0 {
+		config.Window.Duration = defaultCreditsWindow
+	}
+	if config.Cooldown.Duration <= 0 {
+		config.Cooldown.Duration = defaultCreditsCooldown
+	}
+	return &CreditTracker{config: config, sources: make(map[string]*creditSource)}
+}
+
+/*
+Get the credits used and the remaining credits of an SMS event, with its time. ok is false for the other events.
+*/
+func smsCredits(event Event) (used, remaining *float64, eventTime *int64, ok bool) {
+	switch e := event.(type) {
+	case MarketingSMSEvent:
+		return e.CreditsUsed, e.RemainingCredits, e.TSEvent, true
+	case TransactionalSMSEvent:
+		return e.CreditsUsed, e.RemainingCredit, e.TSEvent, true
+	default:
+		return nil, nil, nil, false
+	}
+}
+
+/*
+Record the credits of an SMS event, and return the alerts whose condition is met. The balance is the remaining credits
+of the latest event, by event time, so that the events received out of order don't roll it back.
+*/
+func (tracker *CreditTracker) Observe(ctx context.Context, category, source string, event Event, now time.Time) []Alert {
+	used, remaining, eventTime, ok := smsCredits(event)
+	if !ok {
+		return nil
+	}
+	at := now
+	if eventTime != nil {
+		at = time.Unix(*eventTime, 0).UTC()
+	}
+	if used != nil {
+		telemetry().CreditsUsed(ctx, source, category, *used)
+	}
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	current, ok := tracker.sources[source]
+	if !ok {
+		current = &creditSource{started: now, alerted: make(map[string]time.Time)}
+		tracker.sources[source] = current
+	}
+	if used != nil && *used > 0 {
+		current.spends = append(current.spends, creditSpend{at: at, credits: *used})
+	}
+	if remaining == nil || at.Before(current.updatedAt) {
+		return nil
+	}
+	current.remaining = *remaining
+	current.updatedAt = at
+	return tracker.alerts(source, current, now)
+}
+
+/*
+Spend rate of the source over the window, in credits per hour. The spends older than the window are dropped.
+*/
+func (tracker *CreditTracker) rate(current *creditSource, now time.Time) float64 {
+	window := tracker.config.Window.Duration
+	current.spends = slices.DeleteFunc(current.spends, func(spend creditSpend) bool { return now.Sub(spend.at) > window })
+	var credits float64
+	for _, spend := range current.spends {
+		credits += spend.credits
+	}
+	period := min(window, max(now.Sub(current.started), minCreditsRatePeriod))
+	return credits / period.Hours()
+}
+
+func (tracker *CreditTracker) alerts(source string, current *creditSource, now time.Time) []Alert {
+	rate := tracker.rate(current, now)
+	var alerts []Alert
+	lowBalance := tracker.config.LowBalance > 0 && current.remaining < tracker.config.LowBalance
+	if alertDue(current.alerted, AlertLowBalance, lowBalance, now, tracker.config.Cooldown.Duration) {
+		alerts = append(alerts, Alert{
+			Name:    AlertLowBalance,
+			Source:  source,
+			Message: fmt.Sprintf("%g SMS credits remaining, below %g", current.remaining, tracker.config.LowBalance),
+			Values:  map[string]float64{"remaining": current.remaining, "ratePerHour": rate},
+			Time:    now,
+		})
+	}
+	depletion := tracker.config.Depletion.Duration
+	hoursLeft := 0.0
+	if rate > 0 {
+		hoursLeft = current.remaining / rate
+	}
+	depleting := depletion > 0 && rate > 0 && hoursLeft < depletion.Hours()
+	if alertDue(current.alerted, AlertDepletion, depleting, now, tracker.config.Cooldown.Duration) {
+		alerts = append(alerts, Alert{
+			Name:    AlertDepletion,
+			Source:  source,
+			Message: fmt.Sprintf("SMS credits depleted in %.1f hours at %g credits per hour", hoursLeft, rate),
+			Values:  map[string]float64{"remaining": current.remaining, "ratePerHour": rate, "hoursLeft": hoursLeft},
+			Time:    now,
+		})
+	}
+	return alerts
+}
+
+/*
+Get the balances of the sources, sorted by source
+*/
+func (tracker *CreditTracker) Balances() []CreditBalance {
+	now := time.Now()
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	balances := make([]CreditBalance, 0, len(tracker.sources))
+	for source, current := range tracker.sources {
+		if current.updatedAt.IsZero() {
+			continue
+		}
+		balance := CreditBalance{Source: source, Remaining: current.remaining, UpdatedAt: current.updatedAt, Rate: tracker.rate(current, now)}
+		if balance.Rate > 0 {
+			depletionAt := now.Add(time.Duration(balance.Remaining / balance.Rate * float64(time.Hour)))
+			balance.DepletionAt = &depletionAt
+		}
+		balances = append(balances, balance)
+	}
+	slices.SortFunc(balances, func(a, b CreditBalance) int { return cmp.Compare(a.Source, b.Source) })
+	return balances
+}
+
+/*
+Track the SMS credits of an event, and send the alerts whose condition is met
+*/
+func (bqContext *BqContext) trackCredits(ctx context.Context, category, source string, event Event) {
+	if bqContext.credits == nil {
+		return
+	}
+	for _, alert := range bqContext.credits.Observe(ctx, category, source, event, time.Now()) {
+		bqContext.notify(ctx, alert)
+	}
+}
@@ -0,0 +1,125 @@
+package function
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+)
+
+type creditsTestEvent struct {
+	// Time at which the event is received, from the start of the test
+	received time.Duration
+	// Time of the event, from the start of the test
+	occurred  time.Duration
+	used      float64
+	remaining float64
+	alerts    []string
+}
+
+func TestCreditTrackerAlerts(t *testing.T) {
+	start := time.Date(2025, 10, 9, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		config  CreditsConfig
+		events  []creditsTestEvent
+		balance float64
+	}{
+		{
+			name:   "low balance",
+			config: CreditsConfig{LowBalance: 100},
+			events: []creditsTestEvent{
+				{received: 0, occurred: 0, used: 1, remaining: 150},
+				{received: time.Minute, occurred: time.Minute, used: 1, remaining: 90, alerts: []string{AlertLowBalance}},
+			},
+			balance: 90,
+		},
+		{
+			name:   "cooldown and reset",
+			config: CreditsConfig{LowBalance: 100, Cooldown: Duration{30 * time.Minute}},
+			events: []creditsTestEvent{
+				{received: 0, occurred: 0, remaining: 90, alerts: []string{AlertLowBalance}},
+				// Not sent again during the cooldown
+				{received: 10 * time.Minute, occurred: 10 * time.Minute, remaining: 80},
+				// Sent again after the cooldown while the balance is low
+				{received: 40 * time.Minute, occurred: 40 * time.Minute, remaining: 70, alerts: []string{AlertLowBalance}},
+				// Reset once the credits are topped up, and sent as soon as the balance is low again
+				{received: 41 * time.Minute, occurred: 41 * time.Minute, remaining: 500},
+				{received: 42 * time.Minute, occurred: 42 * time.Minute, remaining: 60, alerts: []string{AlertLowBalance}},
+			},
+			balance: 60,
+		},
+		{
+			name:   "depletion forecast",
+			config: CreditsConfig{Depletion: Duration{10 * time.Hour}},
+			events: []creditsTestEvent{
+				{received: 0, occurred: 0, remaining: 10000},
+				// 300 credits in 30 minutes: 600 credits per hour, 1000 credits last less than 2 hours
+				{received: 30 * time.Minute, occurred: 30 * time.Minute, used: 300, remaining: 1000, alerts: []string{AlertDepletion}},
+			},
+			balance: 1000,
+		},
+		{
+			name:   "no depletion forecast at a slow rate",
+			config: CreditsConfig{Depletion: Duration{10 * time.Hour}},
+			events: []creditsTestEvent{
+				{received: 0, occurred: 0, remaining: 10000},
+				{received: 30 * time.Minute, occurred: 30 * time.Minute, used: 30, remaining: 9970},
+			},
+			balance: 9970,
+		},
+		{
+			name:   "no immediate depletion forecast after a start",
+			config: CreditsConfig{Depletion: Duration{time.Hour}},
+			events: []creditsTestEvent{
+				// The rate is spread over 5 minutes at least: 60 credits per hour, 100 credits last more than an hour
+				{received: 0, occurred: 0, used: 5, remaining: 100},
+			},
+			balance: 100,
+		},
+		{
+			name:   "out of order events",
+			config: CreditsConfig{LowBalance: 100},
+			events: []creditsTestEvent{
+				{received: 0, occurred: 10 * time.Minute, remaining: 50, alerts: []string{AlertLowBalance}},
+				// An older event doesn't roll the balance back, nor reset the alert
+				{received: time.Minute, occurred: 5 * time.Minute, remaining: 500},
+				{received: 2 * time.Minute, occurred: 11 * time.Minute, remaining: 40},
+			},
+			balance: 40,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tracker := NewCreditTracker(test.config)
+			for i, e := range test.events {
+				occurred := start.Add(e.occurred).Unix()
+				event := TransactionalSMSEvent{CreditsUsed: &e.used, RemainingCredit: &e.remaining, TSEvent: &occurred}
+				var names []string
+				for _, alert := range tracker.Observe(context.Background(), "transactional-sms", "shop", event, start.Add(e.received)) {
+					if alert.Source != "shop" {
+						t.Errorf("event %d: alert %s of source %q", i, alert.Name, alert.Source)
+					}
+					names = append(names, alert.Name)
+				}
+				if !slices.Equal(names, e.alerts) {
+					t.Errorf("event %d: got alerts %v, want %v", i, names, e.alerts)
+				}
+			}
+			balances := tracker.Balances()
+			if len(balances) != 1 || balances[0].Remaining != test.balance {
+				t.Errorf("balances: got %+v, want %g remaining", balances, test.balance)
+			}
+		})
+	}
+}
+
+func TestCreditTrackerIgnoresOtherEvents(t *testing.T) {
+	tracker := NewCreditTracker(CreditsConfig{LowBalance: 100})
+	if alerts := tracker.Observe(context.Background(), "transactional-email", "shop", TransactionalEmailEvent{}, time.Now()); alerts != nil {
+		t.Errorf("alerts of an email: %v", alerts)
+	}
+	if balances := tracker.Balances(); len(balances) != 0 {
+		t.Errorf("balances of an email: %+v", balances)
+	}
+}
@@ -0,0 +1,118 @@
+package function
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+)
+
+/*
+Dataset holds the settings of a dataset, used to create it when it doesn't exist and to report the drift of an existing dataset.
+The projectId defaults to the project of the function.
+*/
+type Dataset struct {
+	ProjectId                  string            `json:"projectId"`
+	DatasetId                  string            `json:"datasetId"`
+	Location                   string            `json:"location"`
+	Description                string            `json:"description"`
+	Labels                     map[string]string `json:"labels"`
+	DefaultTableExpiration     Duration          `json:"defaultTableExpiration"`
+	DefaultPartitionExpiration Duration          `json:"defaultPartitionExpiration"`
+}
+
+/*
+Get the configured settings of the dataset of the table
+*/
+func (bqContext *BqContext) GetDatasetConfig(table Table) (Dataset, bool) {
+	for _, dataset := range bqContext.Datasets {
+		if dataset.DatasetId == table.DatasetId && bqContext.sameProject(dataset.ProjectId, table.ProjectId) {
+			return dataset, true
+		}
+	}
+	return Dataset{}, false
+}
+
+func (bqContext *BqContext) sameProject(a, b string) bool {
+	if a == "" {
+		a = bqContext.ProjectId
+	}
+	if b == "" {
+		b = bqContext.ProjectId
+	}
+	return a == b
+}
+
+/*
+Create the dataset of the table if it doesn't exist and is configured, or report the drift of its settings if it exists
+*/
+func (bqContext *BqContext) EnsureDataset(ctx context.Context, table Table) error {
+	dataset, err := bqContext.GetDataset(table)
+	if err != nil {
+		return err
+	}
+	config, configured := bqContext.GetDatasetConfig(table)
+	metadata, err := dataset.Metadata(ctx)
+	if isNotFound(err) {
+		if !configured {
+			return fmt.Errorf("dataset %s.%s not found, add it to the datasets of the configuration to create it", dataset.ProjectID, table.DatasetId)
+		}
+		location := config.Location
+		if location == "" {
+			location = table.Location
+		}
+		logger.InfoContext(ctx, "Creating bigquery dataset", "projectId", dataset.ProjectID, "datasetId", table.DatasetId, "location", location)
+		err = dataset.Create(ctx, &bigquery.DatasetMetadata{
+			Location:                   location,
+			Description:                config.Description,
+			Labels:                     config.Labels,
+			DefaultTableExpiration:     config.DefaultTableExpiration.Duration,
+			DefaultPartitionExpiration: config.DefaultPartitionExpiration.Duration,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create dataset %s.%s: %v", dataset.ProjectID, table.DatasetId, err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get dataset %s.%s: %v", dataset.ProjectID, table.DatasetId, err)
+	}
+	if table.Location != "" && !strings.EqualFold(metadata.Location, table.Location) {
+		return fmt.Errorf("dataset %s of table %s is in location %s instead of %s", table.DatasetId, table.Key(), metadata.Location, table.Location)
+	}
+	if configured {
+		if drift := config.Drift(metadata); len(drift) > 0 {
+			logger.WarnContext(ctx, "Bigquery dataset settings differ from the configuration", "projectId", dataset.ProjectID, "datasetId", table.DatasetId, "drift", drift)
+		}
+	}
+	return nil
+}
+
+/*
+Compare the configured settings with the metadata of the existing dataset, and return the differences by setting.
+Settings that are not configured are not compared.
+*/
+func (dataset Dataset) Drift(metadata *bigquery.DatasetMetadata) map[string]string {
+	drift := make(map[string]string)
+	if dataset.Location != "" && !strings.EqualFold(dataset.Location, metadata.Location) {
+		drift["location"] = fmt.Sprintf("configured %s, actual %s", dataset.Location, metadata.Location)
+	}
+	if dataset.Description != "" && dataset.Description != metadata.Description {
+		drift["description"] = fmt.Sprintf("configured %q, actual %q", dataset.Description, metadata.Description)
+	}
+	for _, key := range slices.Sorted(maps.Keys(dataset.Labels)) {
+		if actual, ok := metadata.Labels[key]; !ok || actual != dataset.Labels[key] {
+			drift["labels."+key] = fmt.Sprintf("configured %q, actual %q", dataset.Labels[key], actual)
+		}
+	}
+	if dataset.DefaultTableExpiration.Duration != 0 && dataset.DefaultTableExpiration.Duration != metadata.DefaultTableExpiration {
+		drift["defaultTableExpiration"] = fmt.Sprintf("configured %s, actual %s", dataset.DefaultTableExpiration.Duration, metadata.DefaultTableExpiration)
+	}
+	if dataset.DefaultPartitionExpiration.Duration != 0 && dataset.DefaultPartitionExpiration.Duration != metadata.DefaultPartitionExpiration {
+		drift["defaultPartitionExpiration"] = fmt.Sprintf("configured %s, actual %s", dataset.DefaultPartitionExpiration.Duration, metadata.DefaultPartitionExpiration)
+	}
+	return drift
+}
@@ -3,22 +3,128 @@ package function
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
 
 	"cloud.google.com/go/bigquery"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 /*
-DecodeAndSend decodes the message using the event struct, converts it to a pubsub event struct, and sends it to BigQuery.
+Decode decodes the message using the event struct.
 */
-func DecodeAndSend[T Event](msg []byte, uploader *bigquery.Uploader, ctx context.Context) (T, error) {
+func Decode[T Event](msg []byte) (T, error) {
 	var data T
 	err := json.Unmarshal(msg, &data)
+	return data, err
+}
+
+/*
+DecodeEvent decodes the message using the event struct of the category.
+*/
+func DecodeEvent(category string, msg []byte) (Event, error) {
+	switch category {
+	case "transactional-email":
+		return Decode[TransactionalEmailEvent](msg)
+	case "marketing-email":
+		return Decode[MarketingEmailEvent](msg)
+	case "marketing-sms":
+		return Decode[MarketingSMSEvent](msg)
+	case "transactional-sms":
+		return Decode[TransactionalSMSEvent](msg)
+	default:
+		return nil, fmt.Errorf("invalid category: ##%s##", category)
+	}
+}
+
+/*
+Send inserts the row in BigQuery. The insert id lets BigQuery deduplicate the row when the message is redelivered.
+The insert is bound to the context of the invocation and to the timeout, when set. When the insert is interrupted by the
+context, the error wraps context.Canceled or context.DeadlineExceeded.
+*/
+func Send(ctx context.Context, uploader *bigquery.Uploader, row any, insertId string, timeout time.Duration) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	ctx, span := startSpan(ctx, "bigquery.Put", attribute.String("insert.id", insertId))
+	err := uploader.Put(ctx, InsertRow{Row: row, InsertId: insertId})
+	endSpan(span, err)
+	if err != nil && ctx.Err() != nil && !errors.Is(err, ctx.Err()) {
+		return fmt.Errorf("%w: %w", ctx.Err(), err)
+	}
+	return err
+}
+
+/*
+InsertRow is a bigquery.ValueSaver for a row struct with an insert id
+*/
+type InsertRow struct {
+	Row      any
+	InsertId string
+	// Written in the _metadata column when set
+	Metadata *RowMetadata
+	// Time at which the sink writes the row, written in the _metadata column of the row when it has one. It is set on
+	// the last attempt, so that the rows replayed from the spool get the time of their replay.
+	InsertedAt time.Time
+}
+
+func (r InsertRow) Save() (map[string]bigquery.Value, string, error) {
+	row, err := r.save()
 	if err != nil {
-		return data, err
+		return nil, "", err
+	}
+	if r.Metadata != nil {
+		row[rowMetadataColumn] = r.Metadata.value()
+	}
+	if !r.InsertedAt.IsZero() {
+		if err := setInsertedAt(row, r.InsertedAt); err != nil {
+			return nil, "", err
+		}
+	}
+	return row, r.InsertId, nil
+}
+
+/*
+Set the insert time in the _metadata column of the row, as built by the row or read back from the spool
+*/
+func setInsertedAt(row map[string]bigquery.Value, insertedAt time.Time) error {
+	switch metadata := row[rowMetadataColumn].(type) {
+	case map[string]bigquery.Value:
+		metadata["InsertedAt"] = bigquery.NullTimestamp{Timestamp: insertedAt, Valid: true}
+	case json.RawMessage:
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(metadata, &fields); err != nil {
+			return fmt.Errorf("invalid %s column: %v", rowMetadataColumn, err)
+		}
+		if fields == nil {
+			return nil
+		}
+		encoded, err := json.Marshal(insertedAt)
+		if err != nil {
+			return err
+		}
+		fields["InsertedAt"] = encoded
+		if encoded, err = json.Marshal(fields); err != nil {
+			return err
+		}
+		row[rowMetadataColumn] = json.RawMessage(encoded)
 	}
-	// Insert data into BigQuery
-	if err := uploader.Put(ctx, data.ToBigquery()); err != nil {
-		return data, err
+	return nil
+}
+
+func (r InsertRow) save() (map[string]bigquery.Value, error) {
+	if saver, ok := r.Row.(bigquery.ValueSaver); ok {
+		row, _, err := saver.Save()
+		return row, err
+	}
+	schema, err := bigquery.InferSchema(r.Row)
+	if err != nil {
+		return nil, err
 	}
-	return data, nil
+	saver := bigquery.StructSaver{Schema: schema, Struct: r.Row}
+	row, _, err := saver.Save()
+	return row, err
 }
@@ -0,0 +1,74 @@
+package function
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+DeliveryTracker remembers the tables a message was already delivered to, so that when a message is redelivered
+after a partial failure, only the failed tables are retried.
+
+The deliveries are only remembered by the instance: a message redelivered to another instance, or after a restart, is
+written again to all its tables, and its rows are then deduplicated by their insert ids in streaming mode only.
+*/
+type DeliveryTracker struct {
+	mu         sync.Mutex
+	ttl        time.Duration
+	deliveries map[string]*messageDeliveries
+}
+
+type messageDeliveries struct {
+	tables    map[string]bool
+	updatedAt time.Time
+}
+
+func NewDeliveryTracker(ttl time.Duration) *DeliveryTracker {
+	return &DeliveryTracker{ttl: ttl, deliveries: make(map[string]*messageDeliveries)}
+}
+
+/*
+Check whether the message was already delivered to the table
+*/
+func (tracker *DeliveryTracker) Delivered(messageId, tableKey string) bool {
+	if messageId == "" {
+		return false
+	}
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	deliveries, ok := tracker.deliveries[messageId]
+	return ok && deliveries.tables[tableKey]
+}
+
+/*
+Record the delivery of the message to the table, and forget the expired messages
+*/
+func (tracker *DeliveryTracker) Record(messageId, tableKey string) {
+	if messageId == "" {
+		return
+	}
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	now := time.Now()
+	for id, deliveries := range tracker.deliveries {
+		if now.Sub(deliveries.updatedAt) > tracker.ttl {
+			delete(tracker.deliveries, id)
+		}
+	}
+	deliveries, ok := tracker.deliveries[messageId]
+	if !ok {
+		deliveries = &messageDeliveries{tables: make(map[string]bool)}
+		tracker.deliveries[messageId] = deliveries
+	}
+	deliveries.tables[tableKey] = true
+	deliveries.updatedAt = now
+}
+
+/*
+Forget the message once it was delivered to all its tables
+*/
+func (tracker *DeliveryTracker) Forget(messageId string) {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	delete(tracker.deliveries, messageId)
+}
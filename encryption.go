@@ -0,0 +1,321 @@
+package function
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const TransformEncrypt = "encrypt"
+
+// Prefix of the encrypted values, followed by the tenant, the id of its key and the envelope
+const encryptedPrefix = "enc:v1:"
+
+// Size of the data keys and of the tenant keys (AES-256)
+const encryptionKeySize = 32
+
+/*
+ErrKeyNotFound is returned when the tenant of a value has no key in the keyset, such as a tenant whose key was shredded
+*/
+var ErrKeyNotFound = errors.New("encryption key not found")
+
+/*
+EncryptionConfig holds the keyset of the encrypt transforms, and the attribute of the messages naming their tenant
+*/
+type EncryptionConfig struct {
+	Keyset          string `json:"keyset"`
+	TenantAttribute string `json:"tenantAttribute"`
+}
+
+/*
+Keyset holds the keys of the tenants, in a local JSON file. Each tenant has its own keys, so that deleting the keys of a
+tenant (crypto-shredding) makes all its encrypted values unreadable. New values are encrypted with the primary key of the
+tenant, and the older keys are kept to decrypt the values encrypted before a rotation.
+*/
+type Keyset struct {
+	Tenants map[string]*TenantKeys `json:"tenants"`
+	mutex   sync.RWMutex
+}
+
+type TenantKeys struct {
+	Primary string `json:"primary"`
+	// Keys by id, base64 encoded
+	Keys map[string]string `json:"keys"`
+}
+
+/*
+Load the keyset from its file
+*/
+func LoadKeyset(path string) (*Keyset, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keyset: %v", err)
+	}
+	keyset := &Keyset{}
+	if err := json.Unmarshal(data, keyset); err != nil {
+		return nil, fmt.Errorf("failed to parse keyset: %v", err)
+	}
+	if keyset.Tenants == nil {
+		keyset.Tenants = make(map[string]*TenantKeys)
+	}
+	for tenant, keys := range keyset.Tenants {
+		if err := validateKeyName(tenant); err != nil {
+			return nil, fmt.Errorf("invalid tenant %s in keyset: %v", tenant, err)
+		}
+		if _, ok := keys.Keys[keys.Primary]; !ok {
+			return nil, fmt.Errorf("primary key %s of tenant %s not found in keyset", keys.Primary, tenant)
+		}
+		for id := range keys.Keys {
+			if err := validateKeyName(id); err != nil {
+				return nil, fmt.Errorf("invalid key %s of tenant %s in keyset: %v", id, tenant, err)
+			}
+			if _, err := keys.key(id); err != nil {
+				return nil, fmt.Errorf("invalid key %s of tenant %s in keyset: %v", id, tenant, err)
+			}
+		}
+	}
+	return keyset, nil
+}
+
+func validateKeyName(name string) error {
+	if name == "" || strings.Contains(name, ":") {
+		return fmt.Errorf("expected a non-empty name without colons")
+	}
+	return nil
+}
+
+func (keys *TenantKeys) key(id string) ([]byte, error) {
+	encoded, ok := keys.Keys[id]
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != encryptionKeySize {
+		return nil, fmt.Errorf("expected a key of %d bytes, got %d bytes", encryptionKeySize, len(key))
+	}
+	return key, nil
+}
+
+/*
+Save the keyset to its file, replacing it atomically. The file is only readable by its owner.
+*/
+func (keyset *Keyset) Save(path string) error {
+	keyset.mutex.RLock()
+	data, err := json.MarshalIndent(keyset, "", "  ")
+	keyset.mutex.RUnlock()
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to save keyset: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to save keyset: %v", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to save keyset: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to save keyset: %v", err)
+	}
+	if err := os.Chmod(tmp.Name(), 0o600); err != nil {
+		return fmt.Errorf("failed to save keyset: %v", err)
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+/*
+Add a new random key to the tenant and make it its primary key, creating the tenant if needed. The previous keys of the
+tenant are kept to decrypt its existing values.
+*/
+func (keyset *Keyset) Rotate(tenant string) error {
+	if err := validateKeyName(tenant); err != nil {
+		return fmt.Errorf("invalid tenant %s: %v", tenant, err)
+	}
+	key := make([]byte, encryptionKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return fmt.Errorf("failed to generate key: %v", err)
+	}
+	keyset.mutex.Lock()
+	defer keyset.mutex.Unlock()
+	if keyset.Tenants == nil {
+		keyset.Tenants = make(map[string]*TenantKeys)
+	}
+	keys, ok := keyset.Tenants[tenant]
+	if !ok {
+		keys = &TenantKeys{Keys: make(map[string]string)}
+		keyset.Tenants[tenant] = keys
+	}
+	id := 1
+	for existing := range keys.Keys {
+		if n, err := strconv.Atoi(existing); err == nil && n >= id {
+			id = n + 1
+		}
+	}
+	keys.Primary = strconv.Itoa(id)
+	keys.Keys[keys.Primary] = base64.StdEncoding.EncodeToString(key)
+	return nil
+}
+
+/*
+Delete all the keys of the tenant (crypto-shredding): its encrypted values can't be decrypted anymore, and its new
+values can't be encrypted. The keyset must then be saved, and its previous copies and backups deleted.
+*/
+func (keyset *Keyset) Shred(tenant string) error {
+	keyset.mutex.Lock()
+	defer keyset.mutex.Unlock()
+	if _, ok := keyset.Tenants[tenant]; !ok {
+		return fmt.Errorf("tenant %s: %w", tenant, ErrKeyNotFound)
+	}
+	delete(keyset.Tenants, tenant)
+	return nil
+}
+
+/*
+Encrypt a value for the tenant with envelope encryption: the value is encrypted by a random data key with AES-GCM, and
+the data key is encrypted by the primary key of the tenant. The field is authenticated with the value, so that an
+encrypted value can't be moved to another field.
+*/
+func (keyset *Keyset) Encrypt(tenant, field, value string) (string, error) {
+	keyset.mutex.RLock()
+	keys, ok := keyset.Tenants[tenant]
+	var id string
+	var tenantKey []byte
+	var err error
+	if ok {
+		id = keys.Primary
+		tenantKey, err = keys.key(id)
+	}
+	keyset.mutex.RUnlock()
+	if !ok {
+		return "", fmt.Errorf("tenant %s: %w", tenant, ErrKeyNotFound)
+	}
+	if err != nil {
+		return "", fmt.Errorf("invalid key %s of tenant %s: %v", id, tenant, err)
+	}
+	dataKey := make([]byte, encryptionKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", fmt.Errorf("failed to generate data key: %v", err)
+	}
+	wrappedKey, err := sealGCM(tenantKey, dataKey, []byte(tenant))
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := sealGCM(dataKey, []byte(value), []byte(normalizeFieldName(field)))
+	if err != nil {
+		return "", err
+	}
+	envelope := append(wrappedKey, ciphertext...)
+	return encryptedPrefix + tenant + ":" + id + ":" + base64.RawURLEncoding.EncodeToString(envelope), nil
+}
+
+/*
+Decrypt a value encrypted by Encrypt for the field. ErrKeyNotFound is returned when the key of its tenant was shredded.
+*/
+func (keyset *Keyset) Decrypt(field, encrypted string) (string, error) {
+	tenant, id, encoded, ok := parseEncrypted(encrypted)
+	if !ok {
+		return "", fmt.Errorf("invalid encrypted value")
+	}
+	envelope, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("invalid encrypted value: %v", err)
+	}
+	keyset.mutex.RLock()
+	keys, ok := keyset.Tenants[tenant]
+	var tenantKey []byte
+	if ok {
+		tenantKey, err = keys.key(id)
+	}
+	keyset.mutex.RUnlock()
+	if !ok {
+		return "", fmt.Errorf("tenant %s: %w", tenant, ErrKeyNotFound)
+	}
+	if err != nil {
+		return "", fmt.Errorf("key %s of tenant %s: %w", id, tenant, err)
+	}
+	wrappedSize := gcmNonceSize + encryptionKeySize + gcmTagSize
+	if len(envelope) < wrappedSize {
+		return "", fmt.Errorf("invalid encrypted value: envelope too short")
+	}
+	dataKey, err := openGCM(tenantKey, envelope[:wrappedSize], []byte(tenant))
+	if err != nil {
+		return "", err
+	}
+	value, err := openGCM(dataKey, envelope[wrappedSize:], []byte(normalizeFieldName(field)))
+	return string(value), err
+}
+
+/*
+Get the tenant and the key id of an encrypted value
+*/
+func parseEncrypted(encrypted string) (tenant, id, envelope string, ok bool) {
+	rest, ok := strings.CutPrefix(encrypted, encryptedPrefix)
+	if !ok {
+		return "", "", "", false
+	}
+	parts := strings.SplitN(rest, ":", 3)
+	if len(parts) != 3 {
+		return "", "", "", false
+	}
+	return parts[0], parts[1], parts[2], true
+}
+
+const (
+	gcmNonceSize = 12
+	gcmTagSize   = 16
+)
+
+/*
+Encrypt with AES-GCM, the random nonce being prepended to the ciphertext
+*/
+func sealGCM(key, plaintext, additionalData []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcmNonceSize, gcmNonceSize+len(plaintext)+gcmTagSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %v", err)
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func openGCM(key, ciphertext, additionalData []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < gcmNonceSize {
+		return nil, fmt.Errorf("invalid encrypted value: ciphertext too short")
+	}
+	plaintext, err := aead.Open(nil, ciphertext[:gcmNonceSize], ciphertext[gcmNonceSize:], additionalData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt value: %v", err)
+	}
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key: %v", err)
+	}
+	return cipher.NewGCM(block)
+}
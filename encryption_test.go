@@ -0,0 +1,217 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestKeyset(t *testing.T, tenants ...string) *Keyset {
+	t.Helper()
+	keyset := &Keyset{}
+	for _, tenant := range tenants {
+		if err := keyset.Rotate(tenant); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return keyset
+}
+
+func TestKeysetDecrypt(t *testing.T) {
+	const email = "jane.doe@example.com"
+	tests := []struct {
+		name string
+		// Change of the keyset after the value is encrypted
+		change  func(keyset *Keyset) error
+		field   string
+		tamper  bool
+		wantErr error
+	}{
+		{name: "same field", field: "email"},
+		{name: "field named as its column", field: "Email"},
+		{name: "other field", field: "subject", wantErr: errDecrypt},
+		{name: "tampered value", field: "email", tamper: true, wantErr: errDecrypt},
+		{name: "after a rotation", change: func(keyset *Keyset) error { return keyset.Rotate("shop") }, field: "email"},
+		{name: "after the shredding of another tenant", change: func(keyset *Keyset) error { return keyset.Shred("blog") }, field: "email"},
+		{name: "after the shredding of the tenant", change: func(keyset *Keyset) error { return keyset.Shred("shop") }, field: "email", wantErr: ErrKeyNotFound},
+		{
+			name: "after a rotation and the shredding of the tenant",
+			change: func(keyset *Keyset) error {
+				if err := keyset.Rotate("shop"); err != nil {
+					return err
+				}
+				return keyset.Shred("shop")
+			},
+			field:   "email",
+			wantErr: ErrKeyNotFound,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			keyset := newTestKeyset(t, "shop", "blog")
+			encrypted, err := keyset.Encrypt("shop", "email", email)
+			if err != nil {
+				t.Fatalf("Encrypt: %v", err)
+			}
+			if !strings.HasPrefix(encrypted, "enc:v1:shop:1:") || strings.Contains(encrypted, email) {
+				t.Fatalf("encrypted value: got %s", encrypted)
+			}
+			if test.change != nil {
+				if err := test.change(keyset); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if test.tamper {
+				// A character within the ciphertext, whose bits are all decoded
+				i := len(encrypted) - 10
+				replacement := "A"
+				if encrypted[i] == 'A' {
+					replacement = "B"
+				}
+				encrypted = encrypted[:i] + replacement + encrypted[i+1:]
+			}
+			decrypted, err := keyset.Decrypt(test.field, encrypted)
+			switch {
+			case test.wantErr == nil && err != nil:
+				t.Errorf("Decrypt: %v", err)
+			case test.wantErr == nil && decrypted != email:
+				t.Errorf("Decrypt: got %q, want %q", decrypted, email)
+			case test.wantErr == ErrKeyNotFound && !errors.Is(err, ErrKeyNotFound):
+				t.Errorf("Decrypt: got %v, want %v", err, ErrKeyNotFound)
+			case test.wantErr == errDecrypt && (err == nil || errors.Is(err, ErrKeyNotFound)):
+				t.Errorf("Decrypt: got %q (%v), want an authentication error", decrypted, err)
+			}
+		})
+	}
+}
+
+// Any decryption error other than a missing key
+var errDecrypt = errors.New("decryption error")
+
+func TestKeysetRotateAndShred(t *testing.T) {
+	keyset := newTestKeyset(t, "shop")
+	if err := keyset.Rotate("shop"); err != nil {
+		t.Fatal(err)
+	}
+	// New values are encrypted with the new primary key
+	encrypted, err := keyset.Encrypt("shop", "email", "jane.doe@example.com")
+	if err != nil || !strings.HasPrefix(encrypted, "enc:v1:shop:2:") {
+		t.Fatalf("Encrypt after a rotation: got %s (%v), want the key 2", encrypted, err)
+	}
+	if err := keyset.Shred("shop"); err != nil {
+		t.Fatalf("Shred: %v", err)
+	}
+	if _, err := keyset.Encrypt("shop", "email", "jane.doe@example.com"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Encrypt after Shred: got %v, want %v", err, ErrKeyNotFound)
+	}
+	if err := keyset.Shred("shop"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Shred of a shredded tenant: got %v, want %v", err, ErrKeyNotFound)
+	}
+	if err := keyset.Rotate("shop:2"); err == nil {
+		t.Error("Rotate of an invalid tenant: no error")
+	}
+}
+
+func TestKeysetSaveAndLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keyset.json")
+	keyset := newTestKeyset(t, "shop", "blog")
+	shop, _ := keyset.Encrypt("shop", "email", "jane.doe@example.com")
+	blog, _ := keyset.Encrypt("blog", "email", "john.doe@example.com")
+	if err := keyset.Shred("shop"); err != nil {
+		t.Fatal(err)
+	}
+	if err := keyset.Save(path); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("keyset file: got %v (%v), want a file only readable by its owner", info.Mode(), err)
+	}
+	loaded, err := LoadKeyset(path)
+	if err != nil {
+		t.Fatalf("LoadKeyset: %v", err)
+	}
+	if _, err := loaded.Decrypt("email", shop); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Decrypt of a shredded tenant: got %v, want %v", err, ErrKeyNotFound)
+	}
+	if value, err := loaded.Decrypt("email", blog); err != nil || value != "john.doe@example.com" {
+		t.Errorf("Decrypt: got %q (%v)", value, err)
+	}
+}
+
+func TestLoadKeysetRejectsInvalidKeysets(t *testing.T) {
+	tests := []struct {
+		name   string
+		keyset string
+	}{
+		{"invalid json", `{"tenants": `},
+		{"missing primary key", `{"tenants": {"shop": {"primary": "2", "keys": {"1": "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="}}}}`},
+		{"short key", `{"tenants": {"shop": {"primary": "1", "keys": {"1": "AAAA"}}}}`},
+		{"invalid tenant", `{"tenants": {"shop:1": {"primary": "1", "keys": {"1": "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="}}}}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "keyset.json")
+			if err := os.WriteFile(path, []byte(test.keyset), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := LoadKeyset(path); err == nil {
+				t.Error("no error")
+			}
+		})
+	}
+}
+
+func TestShreddedTenantIsAcknowledged(t *testing.T) {
+	tests := []struct {
+		name       string
+		quarantine string
+	}{
+		{"without quarantine table", ``},
+		{"quarantined without its payload", `, "quarantine": {"datasetId": "brevo", "tableId": "quarantine", "payload": true}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "keyset.json")
+			keyset := newTestKeyset(t, "shop", "blog")
+			if err := keyset.Shred("blog"); err != nil {
+				t.Fatal(err)
+			}
+			if err := keyset.Save(path); err != nil {
+				t.Fatal(err)
+			}
+			sink := startTestConsumer(t, fmt.Sprintf(`{
+				"encryption": {"keyset": %q},
+				"tables": [
+					{"source": "shop", "datasetId": "brevo", "tableId": "shop_emails", "eventCategory": "transactional-email", "transforms": {"email": {"action": "encrypt"}}},
+					{"source": "blog", "datasetId": "brevo", "tableId": "blog_emails", "eventCategory": "transactional-email", "transforms": {"email": {"action": "encrypt"}}}
+				]%s
+			}`, path, test.quarantine))
+			// A permanent error would fail every redelivery: the message is acknowledged
+			if err := publish(context.Background(), t, "m1", map[string]string{"source": "blog", "category": "transactional-email"}, testTransactionalEmail); err != nil {
+				t.Fatalf("message of a shredded tenant: got %v, want it acknowledged", err)
+			}
+			if rows := sink.Rows("brevo.blog_emails"); len(rows) != 0 {
+				t.Errorf("rows of a shredded tenant: %+v", rows)
+			}
+			if quarantined := sink.Rows("brevo.quarantine"); test.quarantine != "" {
+				if len(quarantined) != 1 {
+					t.Fatalf("quarantine: got %d rows, want 1", len(quarantined))
+				}
+				if record := quarantined[0].Row.(QuarantineRecordBigquery); record.Payload.Valid || !strings.Contains(record.Reason.StringVal, "permanent") {
+					t.Errorf("quarantine: got %+v, want the reason without the payload", record)
+				}
+			}
+			// The other tenants are still encrypted
+			if err := publish(context.Background(), t, "m2", map[string]string{"source": "shop", "category": "transactional-email"}, testTransactionalEmail); err != nil {
+				t.Fatal(err)
+			}
+			if rows := sink.Rows("brevo.shop_emails"); len(rows) != 1 {
+				t.Errorf("rows of the tenant: got %d, want 1", len(rows))
+			}
+		})
+	}
+}
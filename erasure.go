@@ -0,0 +1,313 @@
+package function
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+const (
+	ErasureDeleted = "deleted"
+	ErasureFailed  = "failed"
+	// Rows were deleted, but columns holding the identifier could not be matched: their rows remain
+	ErasurePartial = "partial"
+	ErasureDryRun  = "dry-run"
+	// The rows of the suppression ledger are kept, so that the erased contact stays suppressed
+	ErasureRetained = "retained"
+)
+
+/*
+ErasureConfig holds the table receiving the audit records of the erasures
+*/
+type ErasureConfig struct {
+	AuditTable *Table `json:"auditTable"`
+}
+
+/*
+ErasureRequest is the erasure of all the rows of a contact, by its email or phone number
+*/
+type ErasureRequest struct {
+	Identifier string
+	Requester  string
+	// Count the rows without deleting them
+	DryRun bool
+}
+
+/*
+ErasureReport lists the rows deleted in each table. The identifier is only reported by its hash.
+*/
+type ErasureReport struct {
+	RequestId      string          `json:"requestId"`
+	IdentifierType string          `json:"identifierType"`
+	IdentifierHash string          `json:"identifierHash"`
+	DryRun         bool            `json:"dryRun"`
+	Tables         []ErasureResult `json:"tables"`
+	RequestedAt    time.Time       `json:"requestedAt"`
+	CompletedAt    time.Time       `json:"completedAt"`
+}
+
+type ErasureResult struct {
+	Table   string   `json:"table"`
+	Columns []string `json:"columns"`
+	// Columns holding the identifier that can't be matched, such as masked or encrypted columns
+	Skipped []string `json:"skipped,omitempty"`
+	Rows    int64    `json:"rows"`
+	Status  string   `json:"status"`
+	Error   string   `json:"error,omitempty"`
+}
+
+/*
+ErasureAuditCategory is the internal event category of the erasure audit table
+*/
+const ErasureAuditCategory = "erasure-audit"
+
+/*
+ErasureAuditBigquery is a struct that represents the erasure of the rows of a contact in a table, in the bigquery format.
+*/
+type ErasureAuditBigquery struct {
+	RequestId      bigquery.NullString `json:"request_id"`
+	IdentifierType bigquery.NullString `json:"identifier_type"`
+	IdentifierHash bigquery.NullString `json:"identifier_hash"`
+	Requester      bigquery.NullString `json:"requester"`
+	Table          bigquery.NullString `json:"table"`
+	Columns        []string            `json:"columns"`
+	Skipped        []string            `json:"skipped"`
+	DeletedRows    bigquery.NullInt64  `json:"deleted_rows"`
+	Status         bigquery.NullString `json:"status"`
+	Error          bigquery.NullString `json:"error"`
+	RequestedAt    time.Time           `json:"requested_at"`
+	CompletedAt    time.Time           `json:"completed_at"`
+}
+
+var ErasureAuditBigqueryDescription = map[string]string{
+	"RequestId":      "Id of the erasure request",
+	"IdentifierType": "Type of the identifier of the contact (email or phone)",
+	"IdentifierHash": "SHA-256 hash of the identifier of the contact, lowercased",
+	"Requester":      "Who requested the erasure",
+	"Table":          "Table of the deleted rows",
+	"Columns":        "Columns matched against the identifier",
+	"Skipped":        "Columns holding the identifier that could not be matched",
+	"DeletedRows":    "Number of deleted rows",
+	"Status":         "Status of the erasure in the table (deleted, partial, retained or failed)",
+	"Error":          "Error of the erasure in the table",
+	"RequestedAt":    "Time at which the erasure was requested",
+	"CompletedAt":    "Time at which the erasure of the table completed",
+}
+
+/*
+Erase the rows of a contact in all the managed tables: the columns holding its email or phone number, nested in Content
+or hashed by the field transforms, the vault tables and the payloads of the quarantine table. The suppression ledger and
+its staging table are retained: deleting the bounces, complaints and unsubscriptions of the contact would let it be mailed
+or texted again. The deletes are
+parameterized DML statements, run one table at a time and waited for, and an audit record is written for each table.
+Rows inserted by streaming in the last minutes are in the streaming buffer and can't be deleted yet: the erasure of the
+table fails and must be run again later.
+*/
+func (bqContext *BqContext) Erase(ctx context.Context, request ErasureRequest) (*ErasureReport, error) {
+	identifier := strings.TrimSpace(request.Identifier)
+	if identifier == "" {
+		return nil, fmt.Errorf("missing identifier")
+	}
+	if !request.DryRun && bqContext.Erasure.AuditTable == nil {
+		return nil, fmt.Errorf("no erasure audit table configured")
+	}
+	requestId, err := newRequestId()
+	if err != nil {
+		return nil, err
+	}
+	report := &ErasureReport{
+		RequestId:      requestId,
+		IdentifierType: identifierType(identifier),
+		IdentifierHash: hashIdentifier(identifier),
+		DryRun:         request.DryRun,
+		RequestedAt:    time.Now().UTC(),
+	}
+	// All the statements are built before the first delete, so that an invalid configuration deletes nothing
+	type tableErasure struct {
+		table     Table
+		result    ErasureResult
+		statement string
+		params    []bigquery.QueryParameter
+		retained  bool
+	}
+	var erasures []tableErasure
+	values := identifierValues(identifier)
+	for _, table := range bqContext.ManagedTables() {
+		if bqContext.isSuppressionTable(table) {
+			erasures = append(erasures, tableErasure{table: table, result: ErasureResult{Table: table.Key()}, retained: true})
+			continue
+		}
+		result, statement, params, err := bqContext.erasureStatement(table, report.IdentifierType, values, request.DryRun)
+		if err != nil {
+			return nil, err
+		}
+		if statement != "" || len(result.Skipped) > 0 {
+			erasures = append(erasures, tableErasure{table: table, result: result, statement: statement, params: params})
+		}
+	}
+	for _, erasure := range erasures {
+		table, result := erasure.table, erasure.result
+		err = nil
+		if erasure.statement != "" {
+			result.Rows, err = bqContext.runErasure(ctx, table, erasure.statement, erasure.params, request.DryRun)
+		}
+		switch {
+		case erasure.retained:
+			result.Status = ErasureRetained
+			logger.InfoContext(ctx, "Suppression rows retained", "requestId", requestId, "table", table.Key())
+		case err != nil:
+			result.Status = ErasureFailed
+			result.Error = err.Error()
+			logger.ErrorContext(ctx, "Erasure failed", "requestId", requestId, "table", table.Key(), "error", err)
+		case request.DryRun:
+			result.Status = ErasureDryRun
+		case len(result.Skipped) > 0:
+			// The masked and encrypted columns can't be matched, and the keys are shredded per tenant, not per contact
+			result.Status = ErasurePartial
+			result.Error = fmt.Sprintf("columns %s can't be matched, their rows are not erased", strings.Join(result.Skipped, ", "))
+			logger.WarnContext(ctx, "Rows partially erased", "requestId", requestId, "table", table.Key(), "rows", result.Rows, "skipped", result.Skipped)
+		default:
+			result.Status = ErasureDeleted
+			logger.InfoContext(ctx, "Rows erased", "requestId", requestId, "table", table.Key(), "rows", result.Rows)
+		}
+		if !request.DryRun {
+			if err := bqContext.auditErasure(ctx, report, request, result); err != nil {
+				return report, err
+			}
+		}
+		report.Tables = append(report.Tables, result)
+	}
+	report.CompletedAt = time.Now().UTC()
+	var partial []string
+	for _, result := range report.Tables {
+		if result.Status == ErasureFailed {
+			return report, fmt.Errorf("erasure failed in table %s: %s", result.Table, result.Error)
+		}
+		if result.Status == ErasurePartial {
+			partial = append(partial, result.Table)
+		}
+	}
+	if len(partial) > 0 {
+		return report, fmt.Errorf("erasure partial in tables %s: their masked or encrypted columns can't be matched", strings.Join(partial, ", "))
+	}
+	return report, nil
+}
+
+/*
+Check whether the table is the suppression ledger or its staging table, which the erasures retain
+*/
+func (bqContext *BqContext) isSuppressionTable(table Table) bool {
+	for _, suppression := range []*Table{bqContext.Suppression.Table, bqContext.Suppression.Staging} {
+		if suppression != nil && suppression.Key() == table.Key() {
+			return true
+		}
+	}
+	return false
+}
+
+func newRequestId() (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", fmt.Errorf("failed to generate request id: %v", err)
+	}
+	return hex.EncodeToString(id), nil
+}
+
+/*
+Hash of the identifier written in the audit records, so that an erasure can be found without keeping the identifier
+*/
+func hashIdentifier(identifier string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(identifier))))
+	return hex.EncodeToString(sum[:])
+}
+
+/*
+Build the DELETE statement of the rows of the identifier in the table, or the COUNT statement in dry run. The statement
+is empty when the table has no column holding the identifier.
+*/
+func (bqContext *BqContext) erasureStatement(table Table, kind string, values []string, dryRun bool) (ErasureResult, string, []bigquery.QueryParameter, error) {
+	match, err := bqContext.matchIdentifier(table, kind, values)
+	result := ErasureResult{Table: table.Key(), Columns: match.Columns, Skipped: match.Skipped}
+	if err != nil || match.Condition == "" {
+		return result, "", nil, err
+	}
+	verb := "DELETE FROM"
+	if dryRun {
+		verb = "SELECT COUNT(*) FROM"
+	}
+	statement := fmt.Sprintf("%s %s WHERE %s", verb, bqContext.tableReference(table), match.Condition)
+	return result, statement, match.Params, nil
+}
+
+/*
+Run the statement of the erasure and wait for its completion. The number of deleted rows, or of matching rows in dry
+run, is returned.
+*/
+func (bqContext *BqContext) runErasure(ctx context.Context, table Table, statement string, params []bigquery.QueryParameter, dryRun bool) (int64, error) {
+	client, err := bqContext.GetClient(table)
+	if err != nil {
+		return 0, err
+	}
+	query := client.Query(statement)
+	query.Parameters = params
+	query.Location = table.Location
+	job, err := query.Run(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to run erasure of table %s: %v", table.Key(), err)
+	}
+	status, err := job.Wait(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to wait for erasure of table %s: %v", table.Key(), err)
+	}
+	if err := status.Err(); err != nil {
+		return 0, fmt.Errorf("erasure of table %s failed: %v", table.Key(), err)
+	}
+	if dryRun {
+		it, err := job.Read(ctx)
+		if err != nil {
+			return 0, fmt.Errorf("failed to read count of table %s: %v", table.Key(), err)
+		}
+		var row []bigquery.Value
+		if err := it.Next(&row); err != nil {
+			return 0, fmt.Errorf("failed to read count of table %s: %v", table.Key(), err)
+		}
+		count, _ := row[0].(int64)
+		return count, nil
+	}
+	if statistics, ok := status.Statistics.Details.(*bigquery.QueryStatistics); ok {
+		return statistics.NumDMLAffectedRows, nil
+	}
+	return 0, nil
+}
+
+/*
+Write the audit record of the erasure of a table
+*/
+func (bqContext *BqContext) auditErasure(ctx context.Context, report *ErasureReport, request ErasureRequest, result ErasureResult) error {
+	record := ErasureAuditBigquery{
+		RequestId:      bigquery.NullString{StringVal: report.RequestId, Valid: true},
+		IdentifierType: bigquery.NullString{StringVal: report.IdentifierType, Valid: true},
+		IdentifierHash: bigquery.NullString{StringVal: report.IdentifierHash, Valid: true},
+		Requester:      bigquery.NullString{StringVal: request.Requester, Valid: request.Requester != ""},
+		Table:          bigquery.NullString{StringVal: result.Table, Valid: true},
+		Columns:        result.Columns,
+		Skipped:        result.Skipped,
+		DeletedRows:    bigquery.NullInt64{Int64: result.Rows, Valid: result.Status == ErasureDeleted || result.Status == ErasurePartial},
+		Status:         bigquery.NullString{StringVal: result.Status, Valid: true},
+		Error:          bigquery.NullString{StringVal: result.Error, Valid: result.Error != ""},
+		RequestedAt:    report.RequestedAt,
+		CompletedAt:    time.Now().UTC(),
+	}
+	table := *bqContext.Erasure.AuditTable
+	row := InsertRow{Row: record, InsertId: fmt.Sprintf("%s:%s", report.RequestId, result.Table)}
+	if err := bqContext.Sink.Insert(ctx, table, row); err != nil {
+		return fmt.Errorf("failed to write audit record of erasure %s of table %s: %v", report.RequestId, result.Table, err)
+	}
+	return nil
+}
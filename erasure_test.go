@@ -0,0 +1,66 @@
+package function
+
+import (
+	"context"
+	"testing"
+)
+
+func TestErasureOfMaskedColumnsIsPartial(t *testing.T) {
+	sink := startTestConsumer(t, `{
+		"tables": [{"source": "shop", "datasetId": "brevo", "tableId": "sms", "eventCategory": "transactional-sms", "transforms": {"to": {"action": "mask"}}}],
+		"erasure": {"auditTable": {"datasetId": "brevo", "tableId": "erasures"}}
+	}`)
+	report, err := bqContext.Erase(context.Background(), ErasureRequest{Identifier: "+33612345678", Requester: "dpo@example.com"})
+	if err == nil {
+		t.Fatal("partial erasure: no error")
+	}
+	if report == nil || len(report.Tables) != 1 {
+		t.Fatalf("report: got %+v, want the sms table", report)
+	}
+	result := report.Tables[0]
+	if result.Table != "brevo.sms" || result.Status != ErasurePartial || len(result.Skipped) != 1 || result.Skipped[0] != "To" {
+		t.Errorf("result: got %+v, want partial with the To column skipped", result)
+	}
+	audits := sink.Rows("brevo.erasures")
+	if len(audits) != 1 {
+		t.Fatalf("audit records: got %d, want 1", len(audits))
+	}
+	if audit := audits[0].Row.(ErasureAuditBigquery); audit.Status.StringVal != ErasurePartial {
+		t.Errorf("audit status: got %s, want %s", audit.Status.StringVal, ErasurePartial)
+	}
+}
+
+func TestErasedContactStaysSuppressed(t *testing.T) {
+	sink := startTestConsumer(t, `{
+		"suppression": {
+			"staging": {"datasetId": "brevo", "tableId": "suppression_events"},
+			"table": {"datasetId": "brevo", "tableId": "suppressions"}
+		},
+		"erasure": {"auditTable": {"datasetId": "brevo", "tableId": "erasures"}}
+	}`)
+	for _, dryRun := range []bool{true, false} {
+		// No delete statement is run: the suppression rows of the contact are kept
+		report, err := bqContext.Erase(context.Background(), ErasureRequest{Identifier: "jane.doe@example.com", Requester: "dpo@example.com", DryRun: dryRun})
+		if err != nil {
+			t.Fatalf("Erase: %v", err)
+		}
+		retained := make(map[string]string)
+		for _, result := range report.Tables {
+			retained[result.Table] = result.Status
+		}
+		for _, table := range []string{"brevo.suppression_events", "brevo.suppressions"} {
+			if retained[table] != ErasureRetained {
+				t.Errorf("dry run %v: table %s: got %q, want %s", dryRun, table, retained[table], ErasureRetained)
+			}
+		}
+	}
+	audits := sink.Rows("brevo.erasures")
+	if len(audits) != 2 {
+		t.Fatalf("audit records: got %d, want 2", len(audits))
+	}
+	for _, audit := range audits {
+		if audit := audit.Row.(ErasureAuditBigquery); audit.Status.StringVal != ErasureRetained {
+			t.Errorf("audit status of table %s: got %s, want %s", audit.Table.StringVal, audit.Status.StringVal, ErasureRetained)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/*
+ErrorClass is the class of an error, used to decide whether a message should be retried and to label logs
+*/
+type ErrorClass string
+
+const (
+	ErrorClassCanceled  ErrorClass = "canceled"
+	ErrorClassTimeout   ErrorClass = "timeout"
+	ErrorClassTransient ErrorClass = "transient"
+	ErrorClassUnhealthy ErrorClass = "unhealthy"
+	ErrorClassInvalid   ErrorClass = "invalid"
+	ErrorClassPermanent ErrorClass = "permanent"
+	ErrorClassUnknown   ErrorClass = "unknown"
+)
+
+/*
+Classify an error. Cancellations and timeouts come from the context of the invocation, transient errors are network
+errors and quota, rate limit and server errors of BigQuery, invalid errors are rows rejected by BigQuery, and permanent
+errors are the other client errors of BigQuery and the missing encryption keys of a tenant. The gRPC errors of the
+Storage Write API are classified the same way.
+*/
+func ClassifyError(err error) ErrorClass {
+	var apiErr *googleapi.Error
+	var putErr bigquery.PutMultiError
+	var storageErr StorageRowErrors
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, context.Canceled):
+		return ErrorClassCanceled
+	case errors.Is(err, context.DeadlineExceeded):
+		return ErrorClassTimeout
+	case errors.Is(err, ErrTableUnhealthy):
+		return ErrorClassUnhealthy
+	case errors.Is(err, ErrKeyNotFound):
+		return ErrorClassPermanent
+	case errors.As(err, &putErr):
+		for _, rowErr := range putErr {
+			for _, e := range rowErr.Errors {
+				if bqErr, ok := e.(*bigquery.Error); !ok || !isRowReason(bqErr.Reason) {
+					return ErrorClassTransient
+				}
+			}
+		}
+		return ErrorClassInvalid
+	case errors.As(err, &storageErr):
+		return ErrorClassInvalid
+	case errors.As(err, &apiErr):
+		if apiErr.Code == http.StatusTooManyRequests || apiErr.Code >= http.StatusInternalServerError {
+			return ErrorClassTransient
+		}
+		if apiErr.Code == http.StatusForbidden && isQuotaError(apiErr) {
+			return ErrorClassTransient
+		}
+		return ErrorClassPermanent
+	case errors.As(err, &netErr):
+		return ErrorClassTransient
+	default:
+		return classifyStatus(err)
+	}
+}
+
+/*
+Classify the gRPC status of an error of the Storage Write API
+*/
+func classifyStatus(err error) ErrorClass {
+	grpcStatus, ok := status.FromError(err)
+	if !ok {
+		return ErrorClassUnknown
+	}
+	switch grpcStatus.Code() {
+	case codes.Unavailable, codes.ResourceExhausted, codes.Aborted, codes.Internal:
+		return ErrorClassTransient
+	case codes.InvalidArgument:
+		return ErrorClassInvalid
+	case codes.NotFound, codes.PermissionDenied, codes.Unauthenticated, codes.FailedPrecondition:
+		return ErrorClassPermanent
+	default:
+		return ErrorClassUnknown
+	}
+}
+
+/*
+Check whether BigQuery returned a quota or rate limit error, which it does with a 403 status code
+*/
+func isQuotaError(apiErr *googleapi.Error) bool {
+	for _, item := range apiErr.Errors {
+		if item.Reason == "quotaExceeded" || item.Reason == "rateLimitExceeded" {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Check whether the error may succeed when retried. Unknown errors are considered retryable.
+*/
+func IsRetryable(err error) bool {
+	class := ClassifyError(err)
+	return class != ErrorClassPermanent && class != ErrorClassInvalid
+}
+
+/*
+Row errors reasons caused by the content of the row. "stopped" rows were valid but not inserted because of another row of the same request.
+*/
+func isRowReason(reason string) bool {
+	return reason == "invalid" || reason == "stopped"
+}
+
+/*
+RowError is an error of BigQuery on a field of an inserted row
+*/
+type RowError struct {
+	Field   string `json:"field"`
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+}
+
+/*
+Unpack the errors of the rows rejected by BigQuery, with the names of the offending fields
+*/
+func RowErrors(err error) []RowError {
+	var storageErr StorageRowErrors
+	if errors.As(err, &storageErr) {
+		return storageErr
+	}
+	var putErr bigquery.PutMultiError
+	if !errors.As(err, &putErr) {
+		return nil
+	}
+	var rowErrors []RowError
+	for _, rowErr := range putErr {
+		for _, e := range rowErr.Errors {
+			if bqErr, ok := e.(*bigquery.Error); ok {
+				rowErrors = append(rowErrors, RowError{Field: bqErr.Location, Reason: bqErr.Reason, Message: bqErr.Message})
+			} else {
+				rowErrors = append(rowErrors, RowError{Message: e.Error()})
+			}
+		}
+	}
+	return rowErrors
+}
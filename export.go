@@ -0,0 +1,217 @@
+package function
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	ExportJSON = "json"
+	ExportCSV  = "csv"
+)
+
+/*
+Columns of the time of the rows, in order of preference, with the SQL expression converting them to a timestamp
+*/
+var eventTimeColumns = []struct {
+	name       string
+	expression string
+}{
+	{"EventTime", "`EventTime`"},
+	{"TSEvent", "TIMESTAMP_SECONDS(`TSEvent`)"},
+	{"TSEpoch", "TIMESTAMP_MILLIS(`TSEpoch`)"},
+	{"QuarantinedAt", "`QuarantinedAt`"},
+	{"TransformedAt", "`TransformedAt`"},
+	{"Minute", "`Minute`"},
+	{"UpdatedAt", "`UpdatedAt`"},
+	{rowMetadataColumn, "COALESCE(`" + rowMetadataColumn + "`.`PublishTime`, `" + rowMetadataColumn + "`.`InsertedAt`)"},
+}
+
+// Event time of the tables without time column
+const noEventTime = "CAST(NULL AS TIMESTAMP)"
+
+/*
+SubjectExport is the timeline of the rows of a contact in all the tables, for a subject access request
+*/
+type SubjectExport struct {
+	IdentifierType string          `json:"identifierType"`
+	ExportedAt     time.Time       `json:"exportedAt"`
+	Tables         []ExportedTable `json:"tables"`
+	Timeline       []TimelineEntry `json:"timeline"`
+}
+
+/*
+ExportedTable lists the columns of a table matched against the identifier, and the number of rows found
+*/
+type ExportedTable struct {
+	Table   string   `json:"table"`
+	Columns []string `json:"columns"`
+	Skipped []string `json:"skipped,omitempty"`
+	Rows    int      `json:"rows"`
+}
+
+/*
+TimelineEntry is a row of the contact, with its source and table. The time is null when the row has no time column.
+*/
+type TimelineEntry struct {
+	Time     *time.Time      `json:"time"`
+	Source   string          `json:"source"`
+	Table    string          `json:"table"`
+	Category string          `json:"category"`
+	Row      json.RawMessage `json:"row"`
+}
+
+/*
+Export the rows of a contact, by its email or phone number, in all the managed tables, matched like the erasures. The
+rows are merged in a timeline sorted by their event time. The columns hashed by the field transforms are matched with
+the hash of the identifier, and the rows are exported as they are stored.
+*/
+func (bqContext *BqContext) Export(ctx context.Context, identifier string) (*SubjectExport, error) {
+	identifier = strings.TrimSpace(identifier)
+	if identifier == "" {
+		return nil, fmt.Errorf("missing identifier")
+	}
+	export := &SubjectExport{IdentifierType: identifierType(identifier), ExportedAt: time.Now().UTC()}
+	values := identifierValues(identifier)
+	for _, table := range bqContext.ManagedTables() {
+		match, err := bqContext.matchIdentifier(table, export.IdentifierType, values)
+		if err != nil {
+			return nil, err
+		}
+		if match.Condition == "" {
+			continue
+		}
+		entries, err := bqContext.exportTable(ctx, table, match)
+		if err != nil {
+			return nil, err
+		}
+		export.Tables = append(export.Tables, ExportedTable{Table: table.Key(), Columns: match.Columns, Skipped: match.Skipped, Rows: len(entries)})
+		export.Timeline = append(export.Timeline, entries...)
+	}
+	slices.SortStableFunc(export.Timeline, func(a, b TimelineEntry) int {
+		switch {
+		case a.Time == nil && b.Time == nil:
+			return 0
+		case a.Time == nil:
+			return 1
+		case b.Time == nil:
+			return -1
+		default:
+			return a.Time.Compare(*b.Time)
+		}
+	})
+	logger.InfoContext(ctx, "Subject exported", "identifierType", export.IdentifierType, "tables", len(export.Tables), "rows", len(export.Timeline))
+	return export, nil
+}
+
+/*
+Query the rows of the match in the table, with their event time
+*/
+func (bqContext *BqContext) exportTable(ctx context.Context, table Table, match IdentifierMatch) ([]TimelineEntry, error) {
+	schema, err := table.Schema()
+	if err != nil {
+		return nil, err
+	}
+	client, err := bqContext.GetClient(table)
+	if err != nil {
+		return nil, err
+	}
+	statement := fmt.Sprintf("SELECT %s AS event_time, TO_JSON_STRING(t) AS data FROM %s AS t WHERE %s",
+		eventTimeExpression(schema), bqContext.tableReference(table), match.Condition)
+	query := client.Query(statement)
+	query.Parameters = match.Params
+	query.Location = table.Location
+	it, err := query.Read(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to export table %s: %v", table.Key(), err)
+	}
+	var entries []TimelineEntry
+	for {
+		var values []bigquery.Value
+		err := it.Next(&values)
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read export of table %s: %v", table.Key(), err)
+		}
+		row, _ := values[1].(string)
+		entry := TimelineEntry{Source: table.Source, Table: table.Key(), Category: table.EventCategory, Row: json.RawMessage(row)}
+		if eventTime, ok := values[0].(time.Time); ok {
+			eventTime = eventTime.UTC()
+			entry.Time = &eventTime
+		}
+		// The rows of the projections and of the quarantine table hold their own source and category
+		var fields struct{ Source, Category *string }
+		if err := json.Unmarshal(entry.Row, &fields); err == nil {
+			if fields.Source != nil && *fields.Source != "" {
+				entry.Source = *fields.Source
+			}
+			if fields.Category != nil && *fields.Category != "" {
+				entry.Category = *fields.Category
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+/*
+SQL expression of the event time of the rows of the schema: the first time column found
+*/
+func eventTimeExpression(schema bigquery.Schema) string {
+	var expressions []string
+	for _, column := range eventTimeColumns {
+		if slices.ContainsFunc(schema, func(field *bigquery.FieldSchema) bool { return field.Name == column.name }) {
+			expressions = append(expressions, column.expression)
+		}
+	}
+	switch len(expressions) {
+	case 0:
+		return noEventTime
+	case 1:
+		return expressions[0]
+	default:
+		return "COALESCE(" + strings.Join(expressions, ", ") + ")"
+	}
+}
+
+/*
+Write the export in JSON, with the tables and the timeline
+*/
+func (export *SubjectExport) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(export)
+}
+
+/*
+Write the timeline of the export in CSV, one line per row, the row being JSON encoded
+*/
+func (export *SubjectExport) WriteCSV(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write([]string{"time", "source", "table", "category", "row"}); err != nil {
+		return err
+	}
+	for _, entry := range export.Timeline {
+		eventTime := ""
+		if entry.Time != nil {
+			eventTime = entry.Time.Format(time.RFC3339)
+		}
+		if err := writer.Write([]string{eventTime, entry.Source, entry.Table, entry.Category, string(entry.Row)}); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,79 @@
+package function
+
+import (
+	"context"
+	"sync"
+)
+
+/*
+FakeSink is an in-memory sink with fault injection, to test the consumer and the spooling sink without BigQuery.
+Injected faults are returned first, in order, then the error of the outage if one is set.
+*/
+type FakeSink struct {
+	mu     sync.Mutex
+	rows   map[string][]InsertRow
+	faults []error
+	outage error
+	calls  int
+}
+
+func NewFakeSink() *FakeSink {
+	return &FakeSink{rows: make(map[string][]InsertRow)}
+}
+
+func (sink *FakeSink) Insert(ctx context.Context, table Table, row InsertRow) error {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	sink.calls++
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if len(sink.faults) > 0 {
+		err := sink.faults[0]
+		sink.faults = sink.faults[1:]
+		if err != nil {
+			return err
+		}
+	}
+	if sink.outage != nil {
+		return sink.outage
+	}
+	sink.rows[table.Key()] = append(sink.rows[table.Key()], row)
+	return nil
+}
+
+/*
+Fail the next calls with the errors, in order. A nil error lets the call succeed.
+*/
+func (sink *FakeSink) FailNext(errs ...error) {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	sink.faults = append(sink.faults, errs...)
+}
+
+/*
+Fail all the calls with the error until the outage is ended with a nil error
+*/
+func (sink *FakeSink) SetOutage(err error) {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	sink.outage = err
+}
+
+/*
+Get the rows inserted in the table, in order
+*/
+func (sink *FakeSink) Rows(tableKey string) []InsertRow {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	return append([]InsertRow(nil), sink.rows[tableKey]...)
+}
+
+/*
+Get the number of calls, including the failed ones
+*/
+func (sink *FakeSink) Calls() int {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	return sink.calls
+}
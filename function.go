@@ -2,30 +2,76 @@ package function
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/GoogleCloudPlatform/functions-framework-go/functions"
 	"github.com/cloudevents/sdk-go/v2/event"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var bqContext BqContext
 var logger *slog.Logger
+var deliveries = NewDeliveryTracker(time.Hour)
+var startOnce sync.Once
+var startErr error
+
+// Whether the consumer started, read by the admin endpoint without starting it
+var started atomic.Bool
+
+const provisioningRetryInterval = 10 * time.Second
 
 func init() {
-	logger = slog.New(slog.NewJSONHandler(os.Stdout, nil))
-	gcpProjectID := os.Getenv("GCP_PROJECT_ID")
-	configFilePath := os.Getenv("CONFIG_FILE_PATH")
-	err := bqContext.InitBigqueryClient(gcpProjectID, configFilePath)
-	if err != nil {
-		panic("Error initializing bigquery client: " + err.Error())
-	}
-	err = bqContext.CreateTablesAndUploaders()
-	if err != nil {
-		panic("Error creating tables and uploaders: " + err.Error())
-	}
+	handler := redactingHandler{Handler: slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: logLevel})}
+	logger = slog.New(traceHandler{Handler: handler, projectId: os.Getenv("GCP_PROJECT_ID")})
 	functions.CloudEvent("RunPubSubConsumer", runPubSubConsumer)
+	functions.HTTP("Admin", runAdmin)
+	functions.HTTP("Suppressions", runSuppressions)
+	// A deployed function starts at init to provision the tables during the cold start. Otherwise (worker, commands),
+	// the consumer is started explicitly or on the first invocation.
+	if deployedFunction() {
+		if err := Start(context.Background()); err != nil {
+			panic(err.Error())
+		}
+	}
+}
+
+/*
+Check whether the instance runs a deployed function, whose CPU is only allocated while it handles a request
+*/
+func deployedFunction() bool {
+	return os.Getenv("FUNCTION_TARGET") != ""
+}
+
+/*
+Start initialises the BigQuery client from the configuration and provisions the tables, once per instance.
+Tables that fail to provision are unhealthy: the other tables keep receiving their messages, and the provisioning of the
+unhealthy tables is retried in the background. The logs of the provisioning carry the trace of the context, such as the
+trace of the message of a cold start, whose cancellation doesn't interrupt the provisioning.
+*/
+func Start(ctx context.Context) error {
+	startOnce.Do(func() {
+		gcpProjectID := os.Getenv("GCP_PROJECT_ID")
+		configFilePath := os.Getenv("CONFIG_FILE_PATH")
+		if err := bqContext.InitBigqueryClient(gcpProjectID, configFilePath); err != nil {
+			startErr = fmt.Errorf("error initializing bigquery client: %v", err)
+			return
+		}
+		ctx := context.WithoutCancel(ctx)
+		if err := bqContext.CreateTablesAndUploaders(ctx); err != nil {
+			logger.ErrorContext(ctx, "Error creating tables and uploaders, unhealthy tables will be retried", "error", err)
+		}
+		go bqContext.RetryProvisioning(context.Background(), provisioningRetryInterval)
+		started.Store(true)
+	})
+	return startErr
 }
 
 type MessagePublishedData struct {
@@ -33,52 +79,211 @@ type MessagePublishedData struct {
 }
 
 type PubSubMessage struct {
-	Data       []byte            `json:"data"`
-	Attributes map[string]string `json:"attributes"`
+	Data        []byte            `json:"data"`
+	Attributes  map[string]string `json:"attributes"`
+	MessageId   string            `json:"messageId"`
+	PublishTime time.Time         `json:"publishTime"`
 }
 
 // runPubSubConsumer consumes a CloudEvent message and extracts the Pub/Sub message.
-func runPubSubConsumer(ctx context.Context, e event.Event) error {
+// The message is sent to all its target tables. When some tables fail, an error is returned so that the message is
+// redelivered, and only the failed tables are retried by the same instance.
+// The message is traced from the trace context of its attributes or of the CloudEvent.
+func runPubSubConsumer(ctx context.Context, e event.Event) (err error) {
+	// The trace context is in the message: the spans are started once it is extracted, at the time the event was received
+	received := time.Now()
 	var msg MessagePublishedData
-	var err error
-	var data Event
-	if err = e.DataAs(&msg); err != nil {
-		return fmt.Errorf("event.DataAs: %w", err)
-	}
-	// Extract the category and source from the attributes
-	category, ok := msg.Message.Attributes["category"]
-	if !ok {
-		return fmt.Errorf("category not found in attributes")
-	}
-	source, ok := msg.Message.Attributes["source"]
-	if !ok {
-		return fmt.Errorf("source not found in attributes")
-	}
-	// Get the uploader for the source
-	datasetId, tableId, err := bqContext.GetTargetTable(source)
+	dataErr := e.DataAs(&msg)
+	extracted := time.Now()
+	ctx = extractTraceContext(ctx, e, msg.Message.Attributes)
+	ctx, span := tracer().Start(ctx, "RunPubSubConsumer", trace.WithTimestamp(received), trace.WithSpanKind(trace.SpanKindConsumer), trace.WithAttributes(
+		attribute.String("messaging.system", "gcp_pubsub"),
+		attribute.String("messaging.message.id", msg.Message.MessageId),
+		attribute.String("source", msg.Message.Attributes["source"]),
+		attribute.String("category", msg.Message.Attributes["category"]),
+	))
+	defer func() { endSpan(span, err) }()
+	if err := Start(ctx); err != nil {
+		return err
+	}
+	if !consumers.Enter() {
+		return errWorkerStopping
+	}
+	defer consumers.Leave()
+	_, dataSpan := tracer().Start(ctx, "DataAs", trace.WithTimestamp(received))
+	if dataErr != nil {
+		dataSpan.RecordError(dataErr)
+		dataSpan.SetStatus(codes.Error, dataErr.Error())
+	}
+	dataSpan.End(trace.WithTimestamp(extracted))
+	if dataErr != nil {
+		return fmt.Errorf("event.DataAs: %w", dataErr)
+	}
+	telemetry().Received(ctx, msg.Message.Attributes["source"], msg.Message.Attributes["category"])
+	// Get the target tables of the message from the routing rules
+	_, routeSpan := startSpan(ctx, "Route")
+	routed := &RoutedMessage{Message: msg.Message, ctx: ctx}
+	tables, err := bqContext.Route(routed)
+	endSpan(routeSpan, err)
+	if err != nil {
+		return err
+	}
+	messageId := msg.Message.MessageId
+	// The events are decoded for all the tables, including those already delivered, which the credits and the alerts see too
+	events := decodeEvents(ctx, msg.Message, tables, routed.category)
+	var errs []error
+	for _, table := range tables {
+		if deliveries.Delivered(messageId, table.Key()) {
+			logger.InfoContext(ctx, "Message already delivered to table, skipping", "messageId", messageId, "datasetId", table.DatasetId, "tableId", table.TableId)
+			continue
+		}
+		if err := sendToTable(ctx, msg.Message, table, routed.category, events); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		deliveries.Record(messageId, table.Key())
+	}
+	if len(errs) > 0 {
+		err := errors.Join(errs...)
+		for _, err := range errs {
+			logger.ErrorContext(ctx, "Error sending message", "messageId", messageId, "error", err, "errorClass", ClassifyError(err), "retryable", IsRetryable(err))
+		}
+		return err
+	}
+	deliveries.Forget(messageId)
+	for category, decoded := range events {
+		if decoded.err != nil {
+			continue
+		}
+		bqContext.trackCredits(ctx, category, msg.Message.Attributes["source"], decoded.event)
+		bqContext.evaluateAlerts(ctx, category, msg.Message.Attributes["source"], decoded.event, msg.Message.Data)
+	}
+	return nil
+}
+
+// decodedEvent is the event of a message decoded in a category, or the error of its decoding
+type decodedEvent struct {
+	event Event
+	err   error
+}
+
+// tableCategory gets the category of the message in the table. The category of the table is authoritative: the category
+// attribute is only validated against it, and accepted is false when the table doesn't accept it. Without category
+// attribute, the projections take the category resolved by Route from the tables the message is routed to.
+func tableCategory(msg PubSubMessage, table Table, routedCategory string) (category string, accepted bool, err error) {
+	category, ok := msg.Attributes["category"]
+	if ok {
+		return category, table.Accepts(category), nil
+	}
+	if !bqContext.RouteBySource {
+		return "", false, fmt.Errorf("category not found in attributes")
+	}
+	if table.Projection == "" {
+		return table.EventCategory, true, nil
+	}
+	if !table.Accepts(routedCategory) {
+		return "", false, fmt.Errorf("category not found in attributes, and required by projection %s of table %s", table.Projection, table.Key())
+	}
+	return routedCategory, true, nil
+}
+
+// decodeEvents decodes the Pub/Sub message once in each category of its tables, as several tables can receive the same
+// message
+func decodeEvents(ctx context.Context, msg PubSubMessage, tables []Table, routedCategory string) map[string]decodedEvent {
+	events := make(map[string]decodedEvent)
+	for _, table := range tables {
+		category, accepted, err := tableCategory(msg, table, routedCategory)
+		if err != nil || !accepted {
+			continue
+		}
+		if _, ok := events[category]; ok {
+			continue
+		}
+		start := time.Now()
+		_, decodeSpan := startSpan(ctx, "DecodeEvent", attribute.String("category", category))
+		event, err := DecodeEvent(category, msg.Data)
+		endSpan(decodeSpan, err)
+		telemetry().Decoded(ctx, msg.Attributes["source"], category, table, time.Since(start), err)
+		events[category] = decodedEvent{event: event, err: err}
+	}
+	return events
+}
+
+// sendToTable sends the event of the Pub/Sub message decoded in the category of the table to the table, in the row
+// format of the table.
+func sendToTable(ctx context.Context, msg PubSubMessage, table Table, routedCategory string, events map[string]decodedEvent) error {
+	source := msg.Attributes["source"]
+	category, accepted, err := tableCategory(msg, table, routedCategory)
 	if err != nil {
-		return fmt.Errorf("error getting target table for source: %s", source)
-	}
-	uploader, ok := bqContext.Uploaders[fmt.Sprintf("%s.%s", datasetId, tableId)]
-	if !ok {
-		return fmt.Errorf("uploader not found for source: %s", source)
-	}
-	// Switch on the category, get the corresponding uploader and send the data to the appropriate table
-	switch category {
-	case "transactional-email":
-		data, err = DecodeAndSend[TransactionalEmailEvent](msg.Message.Data, uploader, bqContext.Ctx)
-	case "marketing-email":
-		data, err = DecodeAndSend[MarketingEmailEvent](msg.Message.Data, uploader, bqContext.Ctx)
-	case "marketing-sms":
-		data, err = DecodeAndSend[MarketingSMSEvent](msg.Message.Data, uploader, bqContext.Ctx)
-	case "transactional-sms":
-		data, err = DecodeAndSend[TransactionalSMSEvent](msg.Message.Data, uploader, bqContext.Ctx)
-	default:
-		return fmt.Errorf("invalid category: ##%s##", category)
+		return err
+	}
+	if !accepted {
+		return bqContext.Quarantine(ctx, msg, fmt.Sprintf("category %s is not accepted by table %s for source %s", category, table.Key(), source), nil)
+	}
+	decoded := events[category]
+	if decoded.err != nil {
+		return fmt.Errorf("error decoding %s event for source %s: %w", category, source, decoded.err)
+	}
+	data := decoded.event
+	value := table.Row(category, source, data, msg.Data)
+	if value == nil {
+		// The projection of the table doesn't store this event
+		return nil
+	}
+	ctx, span := startSpan(ctx, "Insert", attribute.String("table", table.Key()), attribute.String("write.mode", table.WriteMode))
+	row := InsertRow{Row: value, InsertId: insertId(msg.MessageId, table)}
+	if table.RowMetadata {
+		row.Metadata = NewRowMetadata(ctx, msg)
+	}
+	start := time.Now()
+	err = bqContext.transformRow(ctx, msg, table, &row)
+	if err == nil {
+		err = bqContext.Sink.Insert(ctx, table, row)
+	}
+	endSpan(span, err)
+	telemetry().Inserted(ctx, msg, category, table, time.Since(start), err)
+	if ClassifyError(err) == ErrorClassUnhealthy && bqContext.UnhealthyPolicy == UnhealthyQuarantine {
+		return bqContext.Quarantine(ctx, msg, fmt.Sprintf("table %s for source %s is unhealthy: %v", table.Key(), source, err), nil)
+	}
+	if rowErrors := RowErrors(err); len(rowErrors) > 0 && ClassifyError(err) == ErrorClassInvalid {
+		// The row will never be accepted: log the offending fields and quarantine the message instead of retrying it
+		fields := make([]string, 0, len(rowErrors))
+		for _, rowError := range rowErrors {
+			fields = append(fields, rowError.Field)
+			logger.ErrorContext(ctx, "Row rejected by Bigquery", "messageId", msg.MessageId, "source", source, "category", category, "table", table.Key(), "field", rowError.Field, "reason", rowError.Reason, "message", currentRedactor().redactText(rowError.Message))
+		}
+		return rejectMessage(ctx, msg, table, fmt.Sprintf("row rejected by table %s on fields %v", table.Key(), fields), err, rowErrors)
+	}
+	if err != nil && !IsRetryable(err) {
+		// A permanent error, such as the missing key of a shredded tenant, would fail every redelivery
+		return rejectMessage(ctx, msg, table, fmt.Sprintf("%s error of table %s for source %s: %v", ClassifyError(err), table.Key(), source, err), err, nil)
 	}
 	if err != nil {
-		return fmt.Errorf("error decoding and sending %s event to table fo source %s: %w", category, source, err)
+		return fmt.Errorf("error sending %s event to table %s for source %s: %w", category, table.Key(), source, err)
+	}
+	if logSuccess() {
+		logger.InfoContext(ctx, "Successfully sent row to Bigquery", "data", data, "source", source, "category", category, "datasetId", table.DatasetId, "tableId", table.TableId)
 	}
-	logger.Info("Successfully sent row to Bigquery", "data", data, "source", source, "category", category, "datasetId", datasetId, "tableId", tableId)
 	return nil
 }
+
+// rejectMessage acknowledges a message that will never be written to the table: it is quarantined, or dropped when no
+// quarantine table is configured. The payload of a tenant without keys is never stored, as its keys were shredded.
+func rejectMessage(ctx context.Context, msg PubSubMessage, table Table, reason string, err error, rowErrors []RowError) error {
+	if bqContext.QuarantineTable == nil {
+		logger.ErrorContext(ctx, "Dropping message rejected by table", "messageId", msg.MessageId, "table", table.Key(), "error", err, "errorClass", ClassifyError(err))
+		return nil
+	}
+	if errors.Is(err, ErrKeyNotFound) {
+		msg.Data = nil
+	}
+	return bqContext.Quarantine(ctx, msg, reason, rowErrors)
+}
+
+// insertId of the row of the message in the table, empty when the message has no id
+func insertId(messageId string, table Table) string {
+	if messageId == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s:%s", messageId, table.Key())
+}
@@ -0,0 +1,128 @@
+package function
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cloudevents/sdk-go/v2/event"
+)
+
+const testTransactionalEmail = `{"event":"delivered","email":"jane@example.com","id":1,"message-id":"<m1@example.com>","ts_event":1760000000,"template_id":12}`
+
+/*
+Start the consumer with the configuration, without BigQuery: the rows are inserted in the returned fake sink
+*/
+func startTestConsumer(t *testing.T, config string) *FakeSink {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	bqContext = BqContext{}
+	if err := bqContext.LoadTablesFromConfig(path); err != nil {
+		t.Fatalf("LoadTablesFromConfig: %v", err)
+	}
+	bqContext.Ctx = context.Background()
+	sink := NewFakeSink()
+	bqContext.Sink = sink
+	if err := bqContext.initConsumer(bqContext.Ctx); err != nil {
+		t.Fatalf("initConsumer: %v", err)
+	}
+	deliveries = NewDeliveryTracker(time.Hour)
+	// The consumer is started by the test: Start must not initialise it again
+	startOnce.Do(func() {})
+	started.Store(true)
+	t.Cleanup(func() {
+		bqContext = BqContext{}
+		started.Store(false)
+	})
+	return sink
+}
+
+/*
+Build the CloudEvent of a Pub/Sub message, as delivered by Eventarc
+*/
+func newPubSubEvent(t *testing.T, messageId string, attributes map[string]string, data string) event.Event {
+	t.Helper()
+	e := event.New()
+	e.SetID(messageId)
+	e.SetType("google.cloud.pubsub.topic.v1.messagePublished")
+	e.SetSource("//pubsub.googleapis.com/projects/test/topics/brevo")
+	message := MessagePublishedData{Message: PubSubMessage{Data: []byte(data), Attributes: attributes, MessageId: messageId, PublishTime: time.Now().Add(-time.Second)}}
+	if err := e.SetData(event.ApplicationJSON, message); err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+/*
+Consume a Pub/Sub message
+*/
+func publish(ctx context.Context, t *testing.T, messageId string, attributes map[string]string, data string) error {
+	t.Helper()
+	return runPubSubConsumer(ctx, newPubSubEvent(t, messageId, attributes, data))
+}
+
+func TestRedeliveryTracksTheCreditsOfDeliveredTables(t *testing.T) {
+	sink := startTestConsumer(t, `{
+		"routing": {"mode": "fan-out"},
+		"tables": [
+			{"source": "shop", "datasetId": "brevo", "tableId": "sms", "eventCategory": "transactional-sms"},
+			{"source": "shop", "datasetId": "brevo", "tableId": "emails", "eventCategory": "transactional-email"}
+		],
+		"quarantine": {"datasetId": "brevo", "tableId": "quarantine"}
+	}`)
+	attributes := map[string]string{"source": "shop", "category": "transactional-sms"}
+	const sms = `{"event":"sent","to":"33612345678","message_id":1,"credits_used":1,"remaining_credit":90,"ts_event":1760000000}`
+	// The SMS table is written, the quarantine of the message for the email table fails
+	sink.FailNext(nil, errUnavailable)
+	if err := publish(context.Background(), t, "m1", attributes, sms); err == nil {
+		t.Fatal("failed quarantine: no error")
+	}
+	if balances := bqContext.credits.Balances(); len(balances) != 0 {
+		t.Errorf("credits tracked before the message is delivered: %+v", balances)
+	}
+	// The redelivery only retries the quarantine, and the credits still see the event
+	if err := publish(context.Background(), t, "m1", attributes, sms); err != nil {
+		t.Fatal(err)
+	}
+	if rows := sink.Rows("brevo.sms"); len(rows) != 1 {
+		t.Errorf("rows of the SMS table: got %d, want 1", len(rows))
+	}
+	if balances := bqContext.credits.Balances(); len(balances) != 1 || balances[0].Remaining != 90 {
+		t.Errorf("balances: got %+v, want 90 remaining", balances)
+	}
+}
+
+func TestQuarantineStoresThePayloadWhenEnabled(t *testing.T) {
+	tests := []struct {
+		name       string
+		quarantine string
+		payload    bool
+	}{
+		{"by default", `{"datasetId": "brevo", "tableId": "quarantine"}`, false},
+		{"enabled", `{"datasetId": "brevo", "tableId": "quarantine", "payload": true}`, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sink := startTestConsumer(t, `{
+				"tables": [{"source": "shop", "datasetId": "brevo", "tableId": "emails", "eventCategory": "transactional-email"}],
+				"quarantine": `+test.quarantine+`
+			}`)
+			// The category of the message is not accepted by its table
+			if err := publish(context.Background(), t, "m1", map[string]string{"source": "shop", "category": "transactional-sms"}, testTransactionalEmail); err != nil {
+				t.Fatal(err)
+			}
+			rows := sink.Rows("brevo.quarantine")
+			if len(rows) != 1 {
+				t.Fatalf("quarantine: got %d rows, want 1", len(rows))
+			}
+			if record := rows[0].Row.(QuarantineRecordBigquery); record.Payload.Valid != test.payload || (test.payload && record.Payload.StringVal != testTransactionalEmail) {
+				t.Errorf("payload: got %+v, want stored %v", record.Payload, test.payload)
+			}
+		})
+	}
+}
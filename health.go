@@ -0,0 +1,148 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	UnhealthyNack       = "nack"
+	UnhealthyQuarantine = "quarantine"
+
+	minProvisioningBackoff = 10 * time.Second
+	maxProvisioningBackoff = 10 * time.Minute
+)
+
+/*
+ErrTableUnhealthy is returned for the tables that failed to provision, until their next provisioning attempt
+*/
+var ErrTableUnhealthy = errors.New("table unhealthy")
+
+/*
+TableHealth is the provisioning state of a table
+*/
+type TableHealth struct {
+	Table       string    `json:"table"`
+	Healthy     bool      `json:"healthy"`
+	LastError   string    `json:"lastError,omitempty"`
+	Failures    int       `json:"failures"`
+	NextAttempt time.Time `json:"nextAttempt,omitzero"`
+	Since       time.Time `json:"since"`
+}
+
+/*
+HealthRegistry tracks the provisioning state of the tables, and the backoff of the provisioning retries of the unhealthy ones
+*/
+type HealthRegistry struct {
+	mu     sync.Mutex
+	tables map[string]*TableHealth
+}
+
+func NewHealthRegistry() *HealthRegistry {
+	return &HealthRegistry{tables: make(map[string]*TableHealth)}
+}
+
+/*
+Check whether provisioning of the table can be attempted, and return the last error if not
+*/
+func (registry *HealthRegistry) CanAttempt(key string) error {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	health, ok := registry.tables[key]
+	if !ok || health.Healthy || !time.Now().Before(health.NextAttempt) {
+		return nil
+	}
+	return fmt.Errorf("%w until %s: %s", ErrTableUnhealthy, health.NextAttempt.Format(time.RFC3339), health.LastError)
+}
+
+/*
+Record a successful provisioning of the table
+*/
+func (registry *HealthRegistry) Succeeded(ctx context.Context, key string) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	health, ok := registry.tables[key]
+	if ok && health.Healthy {
+		return
+	}
+	if ok {
+		logger.InfoContext(ctx, "Table is healthy again", "table", key, "failures", health.Failures, "tableHealth", "healthy")
+	}
+	registry.tables[key] = &TableHealth{Table: key, Healthy: true, Since: time.Now()}
+}
+
+/*
+Record a failed provisioning of the table, and schedule the next attempt with an exponential backoff
+*/
+func (registry *HealthRegistry) Failed(ctx context.Context, key string, err error) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	health, ok := registry.tables[key]
+	if !ok || health.Healthy {
+		health = &TableHealth{Table: key, Since: time.Now()}
+		registry.tables[key] = health
+	}
+	health.Failures++
+	health.LastError = err.Error()
+	backoff := min(minProvisioningBackoff<<min(health.Failures-1, 16), maxProvisioningBackoff)
+	health.NextAttempt = time.Now().Add(backoff)
+	logger.ErrorContext(ctx, "Table is unhealthy", "table", key, "error", err, "failures", health.Failures, "nextAttempt", health.NextAttempt, "tableHealth", "unhealthy")
+}
+
+/*
+Get a snapshot of the state of all the tables, sorted by table
+*/
+func (registry *HealthRegistry) Snapshot() []TableHealth {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	snapshot := make([]TableHealth, 0, len(registry.tables))
+	for _, key := range slices.Sorted(maps.Keys(registry.tables)) {
+		snapshot = append(snapshot, *registry.tables[key])
+	}
+	return snapshot
+}
+
+/*
+Get the tables that are due for a provisioning retry
+*/
+func (registry *HealthRegistry) Due() []string {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	var due []string
+	now := time.Now()
+	for key, health := range registry.tables {
+		if !health.Healthy && !now.Before(health.NextAttempt) {
+			due = append(due, key)
+		}
+	}
+	return due
+}
+
+/*
+Retry the provisioning of the unhealthy tables in the background, until the context is cancelled
+*/
+func (bqContext *BqContext) RetryProvisioning(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, key := range bqContext.Health.Due() {
+			table, err := bqContext.GetManagedTable(key)
+			if err != nil {
+				continue
+			}
+			if _, err := bqContext.GetUploader(ctx, table); err == nil {
+				logger.InfoContext(ctx, "Table provisioned after retry", "table", key)
+			}
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/googleapi"
+)
+
+func TestExpiredTableIsProvisionedAgain(t *testing.T) {
+	startTestConsumer(t, `{"tables": [{"source": "shop", "datasetId": "brevo", "tableId": "emails", "eventCategory": "transactional-email"}]}`)
+	table, err := bqContext.GetTable("brevo.emails")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bqContext.Uploaders[table.Key()] = &bigquery.Uploader{}
+	bqContext.Health.Succeeded(context.Background(), table.Key())
+
+	err = bqContext.tableNotFound(context.Background(), table, &googleapi.Error{Code: http.StatusNotFound, Message: "Not found: Table p:brevo.emails"})
+	// The message is handled by the unhealthy policy, instead of being dropped as a permanent error
+	if !errors.Is(err, ErrTableUnhealthy) || ClassifyError(err) != ErrorClassUnhealthy {
+		t.Errorf("error: got %v (%s), want an unhealthy table", err, ClassifyError(err))
+	}
+	if _, ok := bqContext.Uploaders[table.Key()]; ok {
+		t.Error("uploader of the expired table still cached")
+	}
+	if err := bqContext.Health.CanAttempt(table.Key()); !errors.Is(err, ErrTableUnhealthy) {
+		t.Errorf("health of the expired table: got %v, want unhealthy until its next provisioning attempt", err)
+	}
+	snapshot := bqContext.Health.Snapshot()
+	if len(snapshot) != 1 || snapshot[0].Healthy || snapshot[0].NextAttempt.IsZero() {
+		t.Errorf("health: got %+v, want a provisioning retry scheduled", snapshot)
+	}
+}
@@ -0,0 +1,219 @@
+package function
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+)
+
+const (
+	IdentifierEmail = "email"
+	IdentifierPhone = "phone"
+)
+
+/*
+Columns holding the identifiers of the contacts, by type, matched by their normalized names at any depth of the schemas
+*/
+var identifierColumns = map[string][]string{
+	IdentifierEmail: {"email", "senderemail", "recipient"},
+	IdentifierPhone: {"to", "workphone", "recipient"},
+}
+
+func identifierType(identifier string) string {
+	if strings.Contains(identifier, "@") {
+		return IdentifierEmail
+	}
+	return IdentifierPhone
+}
+
+/*
+The values of the identifier as they can be stored: emails as is and lowercased, phone numbers with and without their
+leading +
+*/
+func identifierValues(identifier string) []string {
+	values := []string{identifier}
+	if identifierType(identifier) == IdentifierEmail {
+		values = append(values, strings.ToLower(identifier))
+	} else if phone, ok := strings.CutPrefix(identifier, "+"); ok {
+		values = append(values, phone)
+	} else {
+		values = append(values, "+"+identifier)
+	}
+	return slices.Compact(values)
+}
+
+/*
+IdentifierMatch is the condition matching the rows of a table holding an identifier, in the columns holding it
+*/
+type IdentifierMatch struct {
+	Columns []string
+	// Columns holding the identifier that can't be matched, such as masked or encrypted columns
+	Skipped   []string
+	Condition string
+	Params    []bigquery.QueryParameter
+}
+
+/*
+Build the condition matching the rows of the identifier in the table: the columns holding it at any depth, hashed with
+the field transforms of the table, the original values of the vault tables and the payloads of the quarantine table.
+The condition is empty when the table has no column holding the identifier.
+*/
+func (bqContext *BqContext) matchIdentifier(table Table, kind string, values []string) (IdentifierMatch, error) {
+	var match IdentifierMatch
+	schema, err := table.Schema()
+	if err != nil {
+		return match, err
+	}
+	var conditions []string
+	switch table.EventCategory {
+	case VaultCategory:
+		match.Columns = []string{"Original"}
+		conditions = append(conditions, "`Original` IN UNNEST(@values)")
+	case QuarantineCategory:
+		match.Columns = []string{"Payload"}
+		conditions = append(conditions, "EXISTS(SELECT 1 FROM UNNEST(@values) AS value WHERE STRPOS(`Payload`, value) > 0)")
+	default:
+		for _, column := range identifierFields(schema, identifierColumns[kind], nil) {
+			path := column.path()
+			columnValues := values
+			if transform, ok := table.transform(path); ok {
+				switch transform.Action {
+				case TransformKeep:
+				case TransformDrop:
+					continue
+				case TransformHash, TransformHMAC:
+					if columnValues, err = bqContext.transformedValues(table, path, values); err != nil {
+						return match, err
+					}
+				default:
+					match.Skipped = append(match.Skipped, path)
+					continue
+				}
+			}
+			param := fmt.Sprintf("values%d", len(match.Params))
+			match.Params = append(match.Params, bigquery.QueryParameter{Name: param, Value: columnValues})
+			match.Columns = append(match.Columns, path)
+			conditions = append(conditions, column.condition("@"+param))
+		}
+		if table.Projection == UnifiedProjection && table.Payload {
+			// The payload holds the identifier in clear, unless it is transformed
+			transform, ok := table.transform("Payload")
+			switch {
+			case !ok || transform.Action == TransformKeep:
+				param := fmt.Sprintf("values%d", len(match.Params))
+				match.Params = append(match.Params, bigquery.QueryParameter{Name: param, Value: values})
+				match.Columns = append(match.Columns, "Payload")
+				conditions = append(conditions, fmt.Sprintf("EXISTS(SELECT 1 FROM UNNEST(@%s) AS value WHERE STRPOS(`Payload`, value) > 0)", param))
+			case transform.Action != TransformDrop:
+				match.Skipped = append(match.Skipped, "Payload")
+			}
+		}
+	}
+	if len(conditions) == 0 {
+		return match, nil
+	}
+	if len(match.Params) == 0 {
+		match.Params = append(match.Params, bigquery.QueryParameter{Name: "values", Value: values})
+	}
+	match.Condition = strings.Join(conditions, " OR ")
+	return match, nil
+}
+
+/*
+Reference of the table in the SQL statements, in the project of the function by default
+*/
+func (bqContext *BqContext) tableReference(table Table) string {
+	projectId := table.ProjectId
+	if projectId == "" {
+		projectId = bqContext.ProjectId
+	}
+	return fmt.Sprintf("`%s.%s.%s`", projectId, table.DatasetId, table.TableId)
+}
+
+/*
+identifierField is a column holding an identifier, with its parent records
+*/
+type identifierField []*bigquery.FieldSchema
+
+func identifierFields(schema bigquery.Schema, names []string, parents identifierField) []identifierField {
+	var fields []identifierField
+	for _, field := range schema {
+		path := append(slices.Clone(parents), field)
+		if field.Type == bigquery.RecordFieldType {
+			fields = append(fields, identifierFields(field.Schema, names, path)...)
+		} else if field.Type == bigquery.StringFieldType && slices.Contains(names, normalizeFieldName(field.Name)) {
+			fields = append(fields, path)
+		}
+	}
+	return fields
+}
+
+func (field identifierField) path() string {
+	names := make([]string, len(field))
+	for i, f := range field {
+		names[i] = f.Name
+	}
+	return strings.Join(names, ".")
+}
+
+/*
+SQL condition matching the column against the values of the parameter, unnesting its repeated parent records
+*/
+func (field identifierField) condition(param string) string {
+	var condition func(prefix string, fields identifierField) string
+	condition = func(prefix string, fields identifierField) string {
+		column := prefix + "`" + fields[0].Name + "`"
+		if len(fields) == 1 {
+			if fields[0].Repeated {
+				return fmt.Sprintf("EXISTS(SELECT 1 FROM UNNEST(%s) AS item WHERE item IN UNNEST(%s))", column, param)
+			}
+			return fmt.Sprintf("%s IN UNNEST(%s)", column, param)
+		}
+		if fields[0].Repeated {
+			alias := fmt.Sprintf("r%d", len(fields))
+			return fmt.Sprintf("EXISTS(SELECT 1 FROM UNNEST(%s) AS %s WHERE %s)", column, alias, condition(alias+".", fields[1:]))
+		}
+		return condition(column+".", fields[1:])
+	}
+	return condition("", field)
+}
+
+/*
+Get the field transform of a column of the table
+*/
+func (table Table) transform(path string) (FieldTransform, bool) {
+	for name, transform := range table.Transforms {
+		if normalizeFieldName(name) == normalizeFieldName(path) {
+			return transform, true
+		}
+	}
+	return FieldTransform{}, false
+}
+
+/*
+The values of the identifier as hashed by the transform of the column
+*/
+func (bqContext *BqContext) transformedValues(table Table, path string, values []string) ([]string, error) {
+	transformer := bqContext.Transformer(table)
+	if transformer == nil {
+		return nil, fmt.Errorf("transforms of table %s not initialised", table.Key())
+	}
+	for _, field := range transformer.fields {
+		if normalizeFieldName(field.name) != normalizeFieldName(path) {
+			continue
+		}
+		var transformed []string
+		var entries []VaultEntry
+		for _, value := range values {
+			hashed, err := field.transformString(value, "", &entries)
+			if err != nil {
+				return nil, err
+			}
+			transformed = append(transformed, hashed)
+		}
+		return slices.Compact(transformed), nil
+	}
+	return nil, fmt.Errorf("transform of field %s of table %s not found", path, table.Key())
+}
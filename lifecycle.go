@@ -0,0 +1,304 @@
+package function
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+const (
+	LifecycleSent         = "sent"
+	LifecycleDelivered    = "delivered"
+	LifecycleOpened       = "opened"
+	LifecycleClicked      = "clicked"
+	LifecycleBounced      = "bounced"
+	LifecycleUnsubscribed = "unsubscribed"
+)
+
+/*
+States of the lifecycle, from the lowest to the highest precedence, with the column of their first time in the state table.
+The current state of a message is the state of highest precedence it reached, whatever the order of its events.
+*/
+var lifecycleStates = []struct {
+	state  string
+	column string
+}{
+	{LifecycleSent, "SentAt"},
+	{LifecycleDelivered, "DeliveredAt"},
+	{LifecycleOpened, "OpenedAt"},
+	{LifecycleClicked, "ClickedAt"},
+	{LifecycleBounced, "BouncedAt"},
+	{LifecycleUnsubscribed, "UnsubscribedAt"},
+}
+
+/*
+State of the event types of Brevo, by normalized event type. Only the hard bounces are bounced messages: the soft bounces
+are transient, and would outrank the later deliveries, opens and clicks of the message. The other events, such as soft
+bounces, blocked sends, spam complaints or deferrals, don't change the state of the message.
+*/
+var lifecycleEventStates = map[string]string{
+	"request":         LifecycleSent,
+	"sent":            LifecycleSent,
+	"accepted":        LifecycleSent,
+	"delivered":       LifecycleDelivered,
+	"opened":          LifecycleOpened,
+	"uniqueopened":    LifecycleOpened,
+	"proxyopen":       LifecycleOpened,
+	"uniqueproxyopen": LifecycleOpened,
+	"click":           LifecycleClicked,
+	"clicked":         LifecycleClicked,
+	"hardbounce":      LifecycleBounced,
+	"invalidemail":    LifecycleBounced,
+	"unsubscribe":     LifecycleUnsubscribed,
+	"unsubscribed":    LifecycleUnsubscribed,
+	"unsubscription":  LifecycleUnsubscribed,
+}
+
+const (
+	LifecycleProjection      = "lifecycle"
+	LifecycleStateCategory   = "lifecycle-state"
+	defaultLifecycleInterval = 5 * time.Minute
+	defaultLifecycleLookback = 10 * time.Minute
+)
+
+/*
+LifecycleConfig holds the staging table receiving the events of the messages, and the state table merged from it. The
+staging rows received since the last merge, minus the lookback, are merged every interval by the worker.
+*/
+type LifecycleConfig struct {
+	Staging  *Table   `json:"staging"`
+	State    *Table   `json:"state"`
+	Interval Duration `json:"interval"`
+	Lookback Duration `json:"lookback"`
+}
+
+/*
+LifecycleEventBigquery is a struct that represents an event of a message in the staging table of the lifecycle, in the
+bigquery format.
+*/
+type LifecycleEventBigquery struct {
+	Category   bigquery.NullString    `json:"category"`
+	MessageId  bigquery.NullString    `json:"message_id"`
+	CampaignId bigquery.NullInt64     `json:"campaign_id"`
+	Recipient  bigquery.NullString    `json:"recipient"`
+	EventType  bigquery.NullString    `json:"event_type"`
+	State      bigquery.NullString    `json:"state"`
+	EventTime  bigquery.NullTimestamp `json:"event_time"`
+	Source     bigquery.NullString    `json:"source"`
+	ReceivedAt time.Time              `json:"received_at"`
+}
+
+var LifecycleEventBigqueryDescription = map[string]string{
+	"Category":   "Event category",
+	"MessageId":  "Id of the message",
+	"CampaignId": "Campaign id of the marketing messages",
+	"Recipient":  "Email address or mobile number of the recipient",
+	"EventType":  "Type of the event",
+	"State":      "State of the lifecycle reached by the event (sent, delivered, opened, clicked, bounced or unsubscribed)",
+	"EventTime":  "Time at which the event occurred",
+	"Source":     "Source attribute of the Pub/Sub message",
+	"ReceivedAt": "Time at which the event was received",
+}
+
+/*
+LifecycleStateBigquery is a struct that represents the current state of a message, with the first time of each state,
+in the bigquery format.
+*/
+type LifecycleStateBigquery struct {
+	Key            bigquery.NullString    `json:"key"`
+	Category       bigquery.NullString    `json:"category"`
+	MessageId      bigquery.NullString    `json:"message_id"`
+	CampaignId     bigquery.NullInt64     `json:"campaign_id"`
+	Recipient      bigquery.NullString    `json:"recipient"`
+	State          bigquery.NullString    `json:"state"`
+	SentAt         bigquery.NullTimestamp `json:"sent_at"`
+	DeliveredAt    bigquery.NullTimestamp `json:"delivered_at"`
+	OpenedAt       bigquery.NullTimestamp `json:"opened_at"`
+	ClickedAt      bigquery.NullTimestamp `json:"clicked_at"`
+	BouncedAt      bigquery.NullTimestamp `json:"bounced_at"`
+	UnsubscribedAt bigquery.NullTimestamp `json:"unsubscribed_at"`
+	UpdatedAt      time.Time              `json:"updated_at"`
+}
+
+var LifecycleStateBigqueryDescription = map[string]string{
+	"Key":            "Key of the message: the message id, or the campaign id and the recipient of the marketing emails",
+	"Category":       "Event category",
+	"MessageId":      "Id of the message",
+	"CampaignId":     "Campaign id of the marketing messages",
+	"Recipient":      "Email address or mobile number of the recipient",
+	"State":          "Current state of the message (sent, delivered, opened, clicked, bounced or unsubscribed)",
+	"SentAt":         "First time the message was sent",
+	"DeliveredAt":    "First time the message was delivered",
+	"OpenedAt":       "First time the message was opened",
+	"ClickedAt":      "First time a link of the message was clicked",
+	"BouncedAt":      "First time the message bounced",
+	"UnsubscribedAt": "First time the recipient unsubscribed from the message",
+	"UpdatedAt":      "Time of the last merge of the message",
+}
+
+func projectLifecycle(category, source string, event Event, payload []byte) any {
+	unified := projectUnified(category, source, event, payload).(UnifiedEventBigquery)
+	row := LifecycleEventBigquery{
+		Category:   unified.Category,
+		MessageId:  unified.MessageId,
+		CampaignId: unified.CampaignId,
+		Recipient:  unified.Recipient,
+		EventType:  unified.EventType,
+		EventTime:  unified.EventTime,
+		Source:     unified.Source,
+		ReceivedAt: time.Now().UTC(),
+	}
+	if state, ok := lifecycleEventStates[normalizeFieldName(unified.EventType.StringVal)]; ok && unified.EventType.Valid {
+		row.State = nullString(state)
+	}
+	// The marketing emails are identified by their campaign and recipient
+	if category == "marketing-email" {
+		row.MessageId = bigquery.NullString{}
+	}
+	return row
+}
+
+/*
+Validate the lifecycle configuration: the staging and the state tables are set together, and the staging rows are
+written as they are received, as the merges select them by the time they were written
+*/
+func (config LifecycleConfig) Validate() error {
+	if (config.Staging == nil) != (config.State == nil) {
+		return fmt.Errorf("lifecycle requires both a staging and a state table")
+	}
+	if config.Staging != nil && config.Staging.WriteMode == WriteModeLoad {
+		return fmt.Errorf("write mode %s of lifecycle staging table %s is not supported", WriteModeLoad, config.Staging.Key())
+	}
+	return nil
+}
+
+/*
+Merge the staging rows written since the last merge into the state table, and return the number of messages merged.
+Each message keeps the first time of each state, so merging the same rows again, or merging the events out of order,
+gives the same state. The rows are selected by the time the sink wrote them, in their _metadata column, so that the rows
+written late, such as the rows replayed from the spool after an outage, are merged whatever their event time. The rows
+written during the lookback before the last merge are merged again, for the rows written while the last merge ran.
+*/
+func (bqContext *BqContext) MergeLifecycle(ctx context.Context) (int64, error) {
+	config := bqContext.Lifecycle
+	if config.State == nil {
+		return 0, fmt.Errorf("no lifecycle state table configured")
+	}
+	lookback := config.Lookback.Duration
+	if lookback <= 0 {
+		lookback = defaultLifecycleLookback
+	}
+	client, err := bqContext.GetClient(*config.State)
+	if err != nil {
+		return 0, err
+	}
+	query := client.Query(lifecycleMergeStatement(bqContext.tableReference(*config.Staging), bqContext.tableReference(*config.State)))
+	query.Parameters = []bigquery.QueryParameter{{Name: "lookback", Value: int64(lookback.Seconds())}}
+	query.Location = config.State.Location
+	job, err := query.Run(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to run merge of lifecycle table %s: %v", config.State.Key(), err)
+	}
+	status, err := job.Wait(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to wait for merge of lifecycle table %s: %v", config.State.Key(), err)
+	}
+	if err := status.Err(); err != nil {
+		return 0, fmt.Errorf("merge of lifecycle table %s failed: %v", config.State.Key(), err)
+	}
+	var merged int64
+	if statistics, ok := status.Statistics.Details.(*bigquery.QueryStatistics); ok {
+		merged = statistics.NumDMLAffectedRows
+	}
+	logger.InfoContext(ctx, "Lifecycle merged", "table", config.State.Key(), "messages", merged)
+	return merged, nil
+}
+
+/*
+MERGE statement of the staging table into the state table. The staging rows are grouped by message, with the first time
+of each state, and the first times of the state table are kept when they are earlier.
+*/
+func lifecycleMergeStatement(staging, state string) string {
+	var firstTimes, mergedTimes, columns []string
+	for _, s := range lifecycleStates {
+		firstTimes = append(firstTimes, fmt.Sprintf("MIN(IF(State = '%s', COALESCE(EventTime, ReceivedAt), NULL)) AS %s", s.state, s.column))
+		mergedTimes = append(mergedTimes, fmt.Sprintf("%s = %s", s.column, earliest("T."+s.column, "S."+s.column)))
+		columns = append(columns, s.column)
+	}
+	insertColumns := append([]string{"Key", "Category", "MessageId", "CampaignId", "Recipient"}, columns...)
+	insertValues := make([]string, len(insertColumns))
+	for i, column := range insertColumns {
+		insertValues[i] = "S." + column
+	}
+	return fmt.Sprintf(`MERGE %s AS T
+USING (
+  SELECT
+    IF(Category = 'marketing-email', CONCAT(Category, ':', CAST(CampaignId AS STRING), ':', Recipient), CONCAT(Category, ':', MessageId)) AS Key,
+    ANY_VALUE(Category) AS Category, ANY_VALUE(MessageId) AS MessageId, ANY_VALUE(CampaignId) AS CampaignId, ANY_VALUE(Recipient) AS Recipient,
+    %s
+  FROM %s
+  WHERE State IS NOT NULL
+    AND COALESCE(_metadata.InsertedAt, ReceivedAt) >= TIMESTAMP_SUB(COALESCE((SELECT MAX(UpdatedAt) FROM %s), TIMESTAMP_SECONDS(0)), INTERVAL @lookback SECOND)
+  GROUP BY Key
+  HAVING Key IS NOT NULL
+) AS S
+ON T.Key = S.Key
+WHEN MATCHED THEN UPDATE SET
+  %s,
+  State = %s,
+  UpdatedAt = CURRENT_TIMESTAMP()
+WHEN NOT MATCHED THEN INSERT (%s, State, UpdatedAt)
+  VALUES (%s, %s, CURRENT_TIMESTAMP())`,
+		state,
+		strings.Join(firstTimes, ",\n    "),
+		staging,
+		state,
+		strings.Join(mergedTimes, ",\n  "),
+		lifecycleStateExpression(func(column string) string { return earliest("T."+column, "S."+column) }),
+		strings.Join(insertColumns, ", "),
+		strings.Join(insertValues, ", "),
+		lifecycleStateExpression(func(column string) string { return "S." + column }),
+	)
+}
+
+/*
+SQL expression of the earliest of two nullable timestamps
+*/
+func earliest(a, b string) string {
+	return fmt.Sprintf("LEAST(COALESCE(%s, %s), COALESCE(%s, %s))", a, b, b, a)
+}
+
+/*
+SQL expression of the current state: the state of highest precedence whose time is set
+*/
+func lifecycleStateExpression(firstTime func(column string) string) string {
+	var cases []string
+	for i := len(lifecycleStates) - 1; i > 0; i-- {
+		cases = append(cases, fmt.Sprintf("WHEN %s IS NOT NULL THEN '%s'", firstTime(lifecycleStates[i].column), lifecycleStates[i].state))
+	}
+	return fmt.Sprintf("CASE %s ELSE '%s' END", strings.Join(cases, " "), lifecycleStates[0].state)
+}
+
+/*
+Merge the lifecycle periodically, until the context is done
+*/
+func (bqContext *BqContext) RunLifecycle(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultLifecycleInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := bqContext.MergeLifecycle(ctx); err != nil {
+			logger.ErrorContext(ctx, "Lifecycle merge failed", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package function
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLifecycleStagingIsMergedByInsertTime(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	config := `{"lifecycle": {"staging": {"datasetId": "brevo", "tableId": "lifecycle_events"}, "state": {"datasetId": "brevo", "tableId": "message_lifecycle"}}}`
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	var context BqContext
+	if err := context.LoadTablesFromConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	// The rows replayed from the spool keep their event and receive times, but get the time of their replay
+	if !context.Lifecycle.Staging.RowMetadata {
+		t.Error("staging table without _metadata column")
+	}
+	statement := lifecycleMergeStatement("`p.brevo.lifecycle_events`", "`p.brevo.message_lifecycle`")
+	if !strings.Contains(statement, "COALESCE(_metadata.InsertedAt, ReceivedAt) >= ") {
+		t.Errorf("merge statement does not select the rows by insert time:\n%s", statement)
+	}
+}
+
+func TestLifecycleStagingRejectsLoadJobs(t *testing.T) {
+	config := LifecycleConfig{
+		Staging: &Table{DatasetId: "brevo", TableId: "lifecycle_events", WriteMode: WriteModeLoad},
+		State:   &Table{DatasetId: "brevo", TableId: "message_lifecycle"},
+	}
+	if err := config.Validate(); err == nil {
+		t.Error("staging table written by load jobs: no error")
+	}
+}
+
+func TestLifecycleStateOfOutOfOrderEvents(t *testing.T) {
+	tests := []struct {
+		name   string
+		events []string
+		want   string
+	}{
+		{"soft bounce before the open", []string{"request", "soft_bounce", "delivered", "opened"}, LifecycleOpened},
+		{"soft bounce received after the open", []string{"opened", "request", "soft_bounce"}, LifecycleOpened},
+		{"blocked after the click", []string{"click", "blocked", "delivered"}, LifecycleClicked},
+		{"soft bounce only", []string{"soft_bounce"}, ""},
+		{"hard bounce after the open", []string{"opened", "hard_bounce"}, LifecycleBounced},
+		{"hard bounce before the open", []string{"hard_bounce", "opened"}, LifecycleBounced},
+		{"unsubscribe before the bounce", []string{"unsubscribed", "hard_bounce"}, LifecycleUnsubscribed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// The current state is the state of highest precedence of the events, as in the merge statement
+			state, precedence := "", -1
+			for _, eventType := range test.events {
+				event, err := DecodeEvent("transactional-email", []byte(`{"event": "`+eventType+`", "message-id": "<m1@example.com>", "ts_event": 1760000000}`))
+				if err != nil {
+					t.Fatal(err)
+				}
+				row := projectLifecycle("transactional-email", "shop", event, nil).(LifecycleEventBigquery)
+				if !row.State.Valid {
+					continue
+				}
+				for i, s := range lifecycleStates {
+					if s.state == row.State.StringVal && i > precedence {
+						state, precedence = s.state, i
+					}
+				}
+			}
+			if state != test.want {
+				t.Errorf("state: got %q, want %q", state, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,611 @@
+package function
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/storage"
+)
+
+const (
+	LoadFormatNDJSON = "ndjson"
+	LoadFormatAvro   = "avro"
+)
+
+const (
+	loadOpenExtension   = ".open"
+	loadNDJSONExtension = ".ndjson"
+	loadAvroExtension   = ".avro"
+	loadStateExtension  = ".json"
+	loadFailedDirectory = "failed"
+)
+
+/*
+TableLoadConfig holds the settings of a table in load mode. A batch is loaded when it is older than interval or larger
+than maxBatchBytes. Without a bucket, the batch file is uploaded with the load job.
+*/
+type TableLoadConfig struct {
+	Format        string   `json:"format"`
+	Bucket        string   `json:"bucket"`
+	Interval      Duration `json:"interval"`
+	MaxBatchBytes int64    `json:"maxBatchBytes"`
+}
+
+/*
+LoadConfig holds the settings of the load sink of the worker: the directory of the batch files, and the number of load
+jobs submitted for a batch before it is moved to the failed directory.
+*/
+type LoadConfig struct {
+	Directory   string `json:"directory"`
+	MaxAttempts int    `json:"maxAttempts"`
+}
+
+/*
+LoadSink buffers the rows of the tables in load mode in local batch files, and loads the batches with load jobs, which are
+free, instead of streaming them. The rows are synced to disk before they are acknowledged, and the pending batches and jobs
+are resumed after a restart. Insert ids are not used: a message redelivered after its row was buffered is loaded twice.
+*/
+type LoadSink struct {
+	config    LoadConfig
+	bqContext *BqContext
+	mu        sync.Mutex
+	batches   map[string]*loadBatch
+	storage   map[clientKey]*storage.Client
+}
+
+/*
+loadBatch is the open batch of a table, receiving its rows
+*/
+type loadBatch struct {
+	id       string
+	file     *os.File
+	size     int64
+	openedAt time.Time
+}
+
+/*
+loadJobState is the state of a sealed batch, persisted next to its file
+*/
+type loadJobState struct {
+	Table         string    `json:"table"`
+	Batch         string    `json:"batch"`
+	Attempt       int       `json:"attempt"`
+	JobId         string    `json:"jobId,omitempty"`
+	Location      string    `json:"location,omitempty"`
+	Uri           string    `json:"uri,omitempty"`
+	NextAttemptAt time.Time `json:"nextAttemptAt"`
+	LastError     string    `json:"lastError,omitempty"`
+}
+
+/*
+LoadSinkStats is the state of the load sink reported by the admin endpoint
+*/
+type LoadSinkStats struct {
+	OpenBatches    int `json:"openBatches"`
+	PendingBatches int `json:"pendingBatches"`
+	FailedBatches  int `json:"failedBatches"`
+}
+
+func OpenLoadSink(config LoadConfig, bqContext *BqContext) (*LoadSink, error) {
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = 5
+	}
+	if err := os.MkdirAll(config.Directory, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create load directory: %v", err)
+	}
+	sink := &LoadSink{config: config, bqContext: bqContext, batches: make(map[string]*loadBatch), storage: make(map[clientKey]*storage.Client)}
+	if err := sink.sealOrphans(); err != nil {
+		return nil, err
+	}
+	return sink, nil
+}
+
+func (sink *LoadSink) Insert(ctx context.Context, table Table, row InsertRow) error {
+	// The table must be provisioned and healthy, as the load jobs do not create it
+	if _, err := sink.bqContext.GetUploader(ctx, table); err != nil {
+		return err
+	}
+	// The rows of a batch are written to Bigquery by its load job: their insert time is the time they are batched
+	row.InsertedAt = time.Now().UTC()
+	raw, err := row.Raw()
+	if err != nil {
+		return err
+	}
+	line, err := json.Marshal(raw)
+	if err != nil {
+		return fmt.Errorf("failed to encode row for the load batch: %v", err)
+	}
+	line = append(line, '\n')
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	batch, ok := sink.batches[table.Key()]
+	if !ok {
+		batch, err = sink.openBatch(table)
+		if err != nil {
+			return err
+		}
+		sink.batches[table.Key()] = batch
+	}
+	if _, err := batch.file.Write(line); err != nil {
+		return fmt.Errorf("failed to write load batch: %v", err)
+	}
+	if err := batch.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync load batch: %v", err)
+	}
+	batch.size += int64(len(line))
+	if maxBytes := table.Load.MaxBatchBytes; maxBytes > 0 && batch.size >= maxBytes {
+		return sink.seal(ctx, table)
+	}
+	return nil
+}
+
+func (sink *LoadSink) tableDirectory(key string) string {
+	return filepath.Join(sink.config.Directory, key)
+}
+
+func (sink *LoadSink) openBatch(table Table) (*loadBatch, error) {
+	directory := sink.tableDirectory(table.Key())
+	if err := os.MkdirAll(directory, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create load directory: %v", err)
+	}
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return nil, err
+	}
+	id := fmt.Sprintf("%d_%s", time.Now().UnixNano(), hex.EncodeToString(suffix))
+	file, err := os.OpenFile(filepath.Join(directory, id+loadOpenExtension), os.O_CREATE|os.O_WRONLY|os.O_APPEND|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create load batch: %v", err)
+	}
+	return &loadBatch{id: id, file: file, openedAt: time.Now()}, nil
+}
+
+/*
+Close the open batch of the table so that it is loaded. The lock must be held.
+*/
+func (sink *LoadSink) seal(ctx context.Context, table Table) error {
+	batch := sink.batches[table.Key()]
+	delete(sink.batches, table.Key())
+	if err := batch.file.Close(); err != nil {
+		return fmt.Errorf("failed to close load batch: %v", err)
+	}
+	return sealBatch(ctx, sink.tableDirectory(table.Key()), table.Key(), batch.id)
+}
+
+func sealBatch(ctx context.Context, directory, key, id string) error {
+	state := loadJobState{Table: key, Batch: id}
+	if err := saveLoadState(filepath.Join(directory, id+loadStateExtension), state); err != nil {
+		return err
+	}
+	if err := os.Rename(filepath.Join(directory, id+loadOpenExtension), filepath.Join(directory, id+loadNDJSONExtension)); err != nil {
+		return fmt.Errorf("failed to seal load batch: %v", err)
+	}
+	logger.InfoContext(ctx, "Load batch sealed", "table", key, "batch", id)
+	return nil
+}
+
+/*
+Seal the batches left open by a previous run, dropping a row truncated by a crash
+*/
+func (sink *LoadSink) sealOrphans() error {
+	tables, err := os.ReadDir(sink.config.Directory)
+	if err != nil {
+		return fmt.Errorf("failed to list load directory: %v", err)
+	}
+	for _, table := range tables {
+		if !table.IsDir() {
+			continue
+		}
+		directory := sink.tableDirectory(table.Name())
+		files, err := os.ReadDir(directory)
+		if err != nil {
+			return fmt.Errorf("failed to list load directory: %v", err)
+		}
+		for _, file := range files {
+			id, ok := strings.CutSuffix(file.Name(), loadOpenExtension)
+			if !ok {
+				continue
+			}
+			path := filepath.Join(directory, file.Name())
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return fmt.Errorf("failed to read load batch: %v", err)
+			}
+			complete := bytes.LastIndexByte(data, '\n') + 1
+			if complete == 0 {
+				if err := os.Remove(path); err != nil {
+					return fmt.Errorf("failed to remove empty load batch: %v", err)
+				}
+				continue
+			}
+			if complete < len(data) {
+				logger.Error("Dropping truncated row of load batch", "table", table.Name(), "batch", id, "bytes", len(data)-complete)
+				if err := os.Truncate(path, int64(complete)); err != nil {
+					return fmt.Errorf("failed to truncate load batch: %v", err)
+				}
+			}
+			if err := sealBatch(context.Background(), directory, table.Name(), id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+/*
+Seal the batches older than the interval of their table and load the sealed batches, until the context is cancelled
+*/
+func (sink *LoadSink) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		sink.sealDue()
+		states, err := sink.pending()
+		if err != nil {
+			logger.Error("Error listing load batches", "error", err)
+			continue
+		}
+		for _, state := range states {
+			if ctx.Err() != nil {
+				return
+			}
+			if err := sink.process(ctx, state); err != nil {
+				logger.Error("Error loading batch", "table", state.Table, "batch", state.Batch, "error", err)
+			}
+		}
+	}
+}
+
+func (sink *LoadSink) sealDue() {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	for key, batch := range sink.batches {
+		table, err := sink.bqContext.GetManagedTable(key)
+		if err != nil {
+			continue
+		}
+		interval := table.Load.Interval.Duration
+		if interval <= 0 {
+			interval = 5 * time.Minute
+		}
+		if time.Since(batch.openedAt) < interval {
+			continue
+		}
+		if err := sink.seal(context.Background(), table); err != nil {
+			logger.Error("Error sealing load batch", "table", key, "batch", batch.id, "error", err)
+		}
+	}
+}
+
+/*
+List the states of the sealed batches, oldest first
+*/
+func (sink *LoadSink) pending() ([]loadJobState, error) {
+	var states []loadJobState
+	tables, err := os.ReadDir(sink.config.Directory)
+	if err != nil {
+		return nil, err
+	}
+	for _, table := range tables {
+		if !table.IsDir() {
+			continue
+		}
+		paths, err := filepath.Glob(filepath.Join(sink.tableDirectory(table.Name()), "*"+loadStateExtension))
+		if err != nil {
+			return nil, err
+		}
+		slices.Sort(paths)
+		for _, path := range paths {
+			state, err := readLoadState(path)
+			if err != nil {
+				return nil, err
+			}
+			states = append(states, state)
+		}
+	}
+	return states, nil
+}
+
+/*
+Advance the load of a sealed batch: submit its job when it is due, or check the status of its job. A failed job is
+re-submitted with a new job id after a backoff.
+*/
+func (sink *LoadSink) process(ctx context.Context, state loadJobState) error {
+	table, err := sink.bqContext.GetManagedTable(state.Table)
+	if err != nil {
+		return fmt.Errorf("table of the batch is no longer configured: %v", err)
+	}
+	client, err := sink.bqContext.GetClient(table)
+	if err != nil {
+		return err
+	}
+	if state.JobId == "" {
+		if time.Now().Before(state.NextAttemptAt) {
+			return nil
+		}
+		return sink.submit(ctx, client, table, state)
+	}
+	job, err := client.JobFromIDLocation(ctx, state.JobId, state.Location)
+	if isNotFound(err) {
+		return sink.failed(table, state, err)
+	}
+	if err != nil {
+		return err
+	}
+	status, err := job.Status(ctx)
+	if err != nil {
+		return err
+	}
+	if !status.Done() {
+		return nil
+	}
+	if err := status.Err(); err != nil {
+		return sink.failed(table, state, err)
+	}
+	loaded := int64(0)
+	if stats, ok := status.Statistics.Details.(*bigquery.LoadStatistics); ok {
+		loaded = stats.OutputRows
+	}
+	logger.Info("Load batch loaded", "table", state.Table, "batch", state.Batch, "jobId", state.JobId, "rows", loaded)
+	return sink.remove(ctx, table, state)
+}
+
+func (sink *LoadSink) submit(ctx context.Context, client *bigquery.Client, table Table, state loadJobState) error {
+	source, closeSource, err := sink.source(ctx, table, &state)
+	if err != nil {
+		return sink.failed(table, state, err)
+	}
+	defer closeSource()
+	loader := client.Dataset(table.DatasetId).Table(table.TableId).LoaderFrom(source)
+	loader.JobID = loadJobId(state)
+	loader.Location = table.Location
+	loader.CreateDisposition = bigquery.CreateNever
+	loader.WriteDisposition = bigquery.WriteAppend
+	loader.UseAvroLogicalTypes = table.Load.Format == LoadFormatAvro
+	job, err := loader.Run(ctx)
+	switch {
+	case isAlreadyExists(err):
+		// The job was submitted before a crash or a timeout: track it
+		state.JobId = loader.JobID
+		state.Location = table.Location
+	case err != nil:
+		if ctx.Err() != nil {
+			return err
+		}
+		return sink.failed(table, state, err)
+	default:
+		state.JobId = job.ID()
+		state.Location = job.Location()
+	}
+	logger.Info("Load job submitted", "table", state.Table, "batch", state.Batch, "jobId", state.JobId, "attempt", state.Attempt)
+	return sink.saveState(state)
+}
+
+/*
+Deterministic id of the load job of an attempt, so that a job submitted before a crash is not submitted twice
+*/
+func loadJobId(state loadJobState) string {
+	table := strings.NewReplacer(".", "_", "-", "_", ":", "_").Replace(state.Table)
+	return fmt.Sprintf("brevo_load_%s_%s_%d", table, state.Batch, state.Attempt)
+}
+
+/*
+Get the source of the load job of the batch: its file, converted to Avro if configured, uploaded to the bucket of the
+table or sent with the job
+*/
+func (sink *LoadSink) source(ctx context.Context, table Table, state *loadJobState) (bigquery.LoadSource, func(), error) {
+	path := sink.batchPath(*state, loadNDJSONExtension)
+	format := bigquery.JSON
+	if table.Load.Format == LoadFormatAvro {
+		avroPath := sink.batchPath(*state, loadAvroExtension)
+		if _, err := os.Stat(avroPath); err != nil {
+			if err := convertBatchToAvro(table, path, avroPath); err != nil {
+				return nil, nil, err
+			}
+		}
+		path = avroPath
+		format = bigquery.Avro
+	}
+	if table.Load.Bucket != "" {
+		uri, err := sink.upload(ctx, table, path)
+		if err != nil {
+			return nil, nil, err
+		}
+		state.Uri = uri
+		reference := bigquery.NewGCSReference(uri)
+		reference.SourceFormat = format
+		return reference, func() {}, nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open load batch: %v", err)
+	}
+	source := bigquery.NewReaderSource(file)
+	source.SourceFormat = format
+	return source, func() { file.Close() }, nil
+}
+
+/*
+Upload the batch file to the bucket of the table, under the key of the table
+*/
+func (sink *LoadSink) upload(ctx context.Context, table Table, path string) (string, error) {
+	bucket, prefix, _ := strings.Cut(strings.TrimPrefix(table.Load.Bucket, "gs://"), "/")
+	name := strings.TrimSuffix(prefix, "/")
+	if name != "" {
+		name += "/"
+	}
+	name += table.Key() + "/" + filepath.Base(path)
+	client, err := sink.storageClient(table)
+	if err != nil {
+		return "", err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open load batch: %v", err)
+	}
+	defer file.Close()
+	writer := client.Bucket(bucket).Object(name).NewWriter(ctx)
+	if _, err := io.Copy(writer, file); err != nil {
+		writer.Close()
+		return "", fmt.Errorf("failed to upload load batch: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		return "", fmt.Errorf("failed to upload load batch: %v", err)
+	}
+	return fmt.Sprintf("gs://%s/%s", bucket, name), nil
+}
+
+/*
+Get the storage client of the table, authenticated as its service account
+*/
+func (sink *LoadSink) storageClient(table Table) (*storage.Client, error) {
+	key := sink.bqContext.clientKey(table)
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if client, ok := sink.storage[key]; ok {
+		return client, nil
+	}
+	opts, err := sink.bqContext.clientOptions(key, storage.ScopeReadWrite)
+	if err != nil {
+		return nil, err
+	}
+	client, err := storage.NewClient(sink.bqContext.Ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create storage client: %v", err)
+	}
+	sink.storage[key] = client
+	return client, nil
+}
+
+/*
+Record the failure of an attempt: the batch is re-submitted after a backoff, or moved to the failed directory after the
+last attempt
+*/
+func (sink *LoadSink) failed(table Table, state loadJobState, cause error) error {
+	state.Attempt++
+	state.JobId = ""
+	state.Location = ""
+	state.LastError = cause.Error()
+	if state.Attempt >= sink.config.MaxAttempts {
+		logger.Error("Load batch failed, moving it to the failed directory", "table", state.Table, "batch", state.Batch, "attempts", state.Attempt, "error", cause)
+		return sink.moveToFailed(state)
+	}
+	backoff := min(time.Minute<<(state.Attempt-1), 30*time.Minute)
+	state.NextAttemptAt = time.Now().Add(backoff).UTC()
+	logger.Warn("Load job failed, re-submitting the batch", "table", state.Table, "batch", state.Batch, "attempt", state.Attempt, "retryIn", backoff.String(), "error", cause)
+	return sink.saveState(state)
+}
+
+func (sink *LoadSink) moveToFailed(state loadJobState) error {
+	directory := filepath.Join(sink.tableDirectory(state.Table), loadFailedDirectory)
+	if err := os.MkdirAll(directory, 0o700); err != nil {
+		return fmt.Errorf("failed to create failed load directory: %v", err)
+	}
+	if err := saveLoadState(filepath.Join(directory, state.Batch+loadStateExtension), state); err != nil {
+		return err
+	}
+	for _, extension := range []string{loadNDJSONExtension, loadAvroExtension} {
+		err := os.Rename(sink.batchPath(state, extension), filepath.Join(directory, state.Batch+extension))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to move load batch: %v", err)
+		}
+	}
+	return os.Remove(sink.batchPath(state, loadStateExtension))
+}
+
+/*
+Remove the files of a loaded batch, and its object in the bucket
+*/
+func (sink *LoadSink) remove(ctx context.Context, table Table, state loadJobState) error {
+	if state.Uri != "" {
+		if client, err := sink.storageClient(table); err == nil {
+			bucket, name, _ := strings.Cut(strings.TrimPrefix(state.Uri, "gs://"), "/")
+			if err := client.Bucket(bucket).Object(name).Delete(ctx); err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+				logger.Warn("Error deleting loaded batch from the bucket", "uri", state.Uri, "error", err)
+			}
+		}
+	}
+	for _, extension := range []string{loadNDJSONExtension, loadAvroExtension} {
+		if err := os.Remove(sink.batchPath(state, extension)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove load batch: %v", err)
+		}
+	}
+	return os.Remove(sink.batchPath(state, loadStateExtension))
+}
+
+func (sink *LoadSink) batchPath(state loadJobState, extension string) string {
+	return filepath.Join(sink.tableDirectory(state.Table), state.Batch+extension)
+}
+
+func (sink *LoadSink) saveState(state loadJobState) error {
+	return saveLoadState(sink.batchPath(state, loadStateExtension), state)
+}
+
+func saveLoadState(path string, state loadJobState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("failed to write load state: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to write load state: %v", err)
+	}
+	return nil
+}
+
+func readLoadState(path string) (loadJobState, error) {
+	var state loadJobState
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return state, fmt.Errorf("failed to read load state: %v", err)
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, fmt.Errorf("failed to read load state: %v", err)
+	}
+	return state, nil
+}
+
+func (sink *LoadSink) Stats() LoadSinkStats {
+	sink.mu.Lock()
+	stats := LoadSinkStats{OpenBatches: len(sink.batches)}
+	sink.mu.Unlock()
+	pending, _ := filepath.Glob(filepath.Join(sink.config.Directory, "*", "*"+loadStateExtension))
+	failed, _ := filepath.Glob(filepath.Join(sink.config.Directory, "*", loadFailedDirectory, "*"+loadStateExtension))
+	stats.PendingBatches = len(pending)
+	stats.FailedBatches = len(failed)
+	return stats
+}
+
+/*
+Close the open batches. They are sealed and loaded at the next start.
+*/
+func (sink *LoadSink) Close() error {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	var errs []error
+	for _, batch := range sink.batches {
+		errs = append(errs, batch.file.Close())
+	}
+	return errors.Join(errs...)
+}
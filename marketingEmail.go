@@ -8,7 +8,7 @@ Documentation: https://developers.brevo.com/docs/marketing-webhooks#marketing-em
 */
 type MarketingEmailEvent struct {
 	Event        *string                  `json:"event"`
-	Email        *string                  `json:"email"`
+	Email        *string                  `json:"email" pii:"hash"`
 	Id           *int64                   `json:"id"`
 	DateSent     *string                  `json:"date_sent"`
 	DateEvent    *string                  `json:"date_event"`
@@ -29,9 +29,9 @@ type MarketingEmailEvent struct {
 }
 
 type MarketingEmailContent struct {
-	Name      *string `json:"name"`
-	LastName  *string `json:"last_name"`
-	WorkPhone *string `json:"work_phone"`
+	Name      *string `json:"name" pii:"omit"`
+	LastName  *string `json:"last_name" pii:"omit"`
+	WorkPhone *string `json:"work_phone" pii:"hash"`
 }
 
 /*
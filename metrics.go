@@ -0,0 +1,303 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	otelprometheus "go.opentelemetry.io/otel/exporters/prometheus"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+)
+
+const (
+	MetricsExporterOTLP       = "otlp"
+	MetricsExporterPrometheus = "prometheus"
+)
+
+const instrumentationName = "upd.com/brevo-pubsub-consumer"
+
+// Buckets of the latency histograms, in seconds
+var latencyBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+/*
+MetricsConfig holds the settings of the metrics exporter of the worker. The OTLP exporter is also configured by the
+standard OTEL_EXPORTER_OTLP_* environment variables.
+*/
+type MetricsConfig struct {
+	Exporter string   `json:"exporter"`
+	Endpoint string   `json:"endpoint"`
+	Insecure bool     `json:"insecure"`
+	Interval Duration `json:"interval"`
+	Address  string   `json:"address"`
+}
+
+/*
+Metrics holds the OpenTelemetry instruments of the consumer
+*/
+type Metrics struct {
+	received       metric.Int64Counter
+	decoded        metric.Int64Counter
+	inserted       metric.Int64Counter
+	failed         metric.Int64Counter
+	quarantined    metric.Int64Counter
+	decodeDuration metric.Float64Histogram
+	insertDuration metric.Float64Histogram
+	lag            metric.Float64Histogram
+	creditsUsed    metric.Float64Counter
+}
+
+// The instruments of the consumer, swapped by SetMeterProvider while messages are being recorded
+var currentMetrics atomic.Pointer[Metrics]
+
+/*
+Get the instruments of the consumer, created from the global meter provider until SetMeterProvider is called
+*/
+func telemetry() *Metrics {
+	if metrics := currentMetrics.Load(); metrics != nil {
+		return metrics
+	}
+	currentMetrics.CompareAndSwap(nil, mustNewMetrics(otel.GetMeterProvider()))
+	return currentMetrics.Load()
+}
+
+/*
+SetMeterProvider records the metrics of the consumer with the provider, such as a provider with an in-memory reader in tests
+*/
+func SetMeterProvider(provider metric.MeterProvider) error {
+	metrics, err := NewMetrics(provider)
+	if err != nil {
+		return err
+	}
+	currentMetrics.Store(metrics)
+	return nil
+}
+
+func mustNewMetrics(provider metric.MeterProvider) *Metrics {
+	metrics, err := NewMetrics(provider)
+	if err != nil {
+		panic(err.Error())
+	}
+	return metrics
+}
+
+/*
+Create the instruments of the consumer, and the gauges of the state of the tables, the breaker, the spool, the load batches
+and the SMS credits
+*/
+func NewMetrics(provider metric.MeterProvider) (*Metrics, error) {
+	meter := provider.Meter(instrumentationName)
+	metrics := &Metrics{}
+	var err error
+	var errs []error
+	metrics.received, err = meter.Int64Counter("brevo.messages.received", metric.WithDescription("Messages received, by source and category"), metric.WithUnit("{message}"))
+	errs = append(errs, err)
+	metrics.decoded, err = meter.Int64Counter("brevo.messages.decoded", metric.WithDescription("Events decoded, by source and category"), metric.WithUnit("{message}"))
+	errs = append(errs, err)
+	metrics.inserted, err = meter.Int64Counter("brevo.rows.inserted", metric.WithDescription("Rows inserted, by source, category and table"), metric.WithUnit("{row}"))
+	errs = append(errs, err)
+	metrics.failed, err = meter.Int64Counter("brevo.rows.failed", metric.WithDescription("Rows that failed to be decoded or inserted, by source, category, table and error class"), metric.WithUnit("{row}"))
+	errs = append(errs, err)
+	metrics.quarantined, err = meter.Int64Counter("brevo.messages.quarantined", metric.WithDescription("Messages stored in the quarantine table, by source and category"), metric.WithUnit("{message}"))
+	errs = append(errs, err)
+	metrics.decodeDuration, err = meter.Float64Histogram("brevo.decode.duration", metric.WithDescription("Duration of the decoding of the events"), metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(latencyBuckets...))
+	errs = append(errs, err)
+	metrics.insertDuration, err = meter.Float64Histogram("brevo.insert.duration", metric.WithDescription("Duration of the inserts of the rows, retries included"), metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(latencyBuckets...))
+	errs = append(errs, err)
+	metrics.lag, err = meter.Float64Histogram("brevo.publish.lag", metric.WithDescription("Time from the publication of the message in Pub/Sub to the insert of its row"), metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300, 900, 3600))
+	errs = append(errs, err)
+	metrics.creditsUsed, err = meter.Float64Counter("brevo.sms.credits.used", metric.WithDescription("SMS credits used, by source and category"), metric.WithUnit("{credit}"))
+	errs = append(errs, err)
+	errs = append(errs, registerStateGauges(meter))
+	if err := errors.Join(errs...); err != nil {
+		return nil, fmt.Errorf("failed to create metrics: %v", err)
+	}
+	return metrics, nil
+}
+
+func registerStateGauges(meter metric.Meter) error {
+	tableHealthy, err := meter.Int64ObservableGauge("brevo.table.healthy", metric.WithDescription("1 when the table is provisioned, 0 when it is unhealthy"))
+	if err != nil {
+		return err
+	}
+	breakerState, err := meter.Int64ObservableGauge("brevo.breaker.state", metric.WithDescription("1 for the current state of the circuit breaker of the worker"))
+	if err != nil {
+		return err
+	}
+	spoolEntries, err := meter.Int64ObservableGauge("brevo.spool.entries", metric.WithDescription("Rows waiting in the spool"), metric.WithUnit("{row}"))
+	if err != nil {
+		return err
+	}
+	spoolBytes, err := meter.Int64ObservableGauge("brevo.spool.size", metric.WithDescription("Size of the spool"), metric.WithUnit("By"))
+	if err != nil {
+		return err
+	}
+	loadBatches, err := meter.Int64ObservableGauge("brevo.load.batches", metric.WithDescription("Load batches, by status"), metric.WithUnit("{batch}"))
+	if err != nil {
+		return err
+	}
+	creditsRemaining, err := meter.Float64ObservableGauge("brevo.sms.credits.remaining", metric.WithDescription("Latest SMS credit balance, by source"), metric.WithUnit("{credit}"))
+	if err != nil {
+		return err
+	}
+	creditsRate, err := meter.Float64ObservableGauge("brevo.sms.credits.rate", metric.WithDescription("SMS credits used per hour, by source"), metric.WithUnit("{credit}/h"))
+	if err != nil {
+		return err
+	}
+	_, err = meter.RegisterCallback(func(ctx context.Context, observer metric.Observer) error {
+		if bqContext.Health != nil {
+			for _, table := range bqContext.Health.Snapshot() {
+				healthy := int64(0)
+				if table.Healthy {
+					healthy = 1
+				}
+				observer.ObserveInt64(tableHealthy, healthy, metric.WithAttributes(attribute.String("table", table.Table)))
+			}
+		}
+		if sink := spoolingSink.Load(); sink != nil {
+			stats := sink.Stats()
+			for _, state := range []string{BreakerClosed, BreakerHalfOpen, BreakerOpen} {
+				value := int64(0)
+				if state == stats.Breaker {
+					value = 1
+				}
+				observer.ObserveInt64(breakerState, value, metric.WithAttributes(attribute.String("state", state)))
+			}
+			observer.ObserveInt64(spoolEntries, stats.Entries)
+			observer.ObserveInt64(spoolBytes, stats.Bytes)
+		}
+		if sink := loadSink.Load(); sink != nil {
+			stats := sink.Stats()
+			observer.ObserveInt64(loadBatches, int64(stats.OpenBatches), metric.WithAttributes(attribute.String("status", "open")))
+			observer.ObserveInt64(loadBatches, int64(stats.PendingBatches), metric.WithAttributes(attribute.String("status", "pending")))
+			observer.ObserveInt64(loadBatches, int64(stats.FailedBatches), metric.WithAttributes(attribute.String("status", "failed")))
+		}
+		if bqContext.credits != nil {
+			for _, balance := range bqContext.credits.Balances() {
+				attributes := metric.WithAttributes(attribute.String("source", balance.Source))
+				observer.ObserveFloat64(creditsRemaining, balance.Remaining, attributes)
+				observer.ObserveFloat64(creditsRate, balance.Rate, attributes)
+			}
+		}
+		return nil
+	}, tableHealthy, breakerState, spoolEntries, spoolBytes, loadBatches, creditsRemaining, creditsRate)
+	return err
+}
+
+func (metrics *Metrics) Received(ctx context.Context, source, category string) {
+	metrics.received.Add(ctx, 1, metric.WithAttributes(attribute.String("source", source), attribute.String("category", category)))
+}
+
+/*
+Record the decoding of an event, and its failure
+*/
+func (metrics *Metrics) Decoded(ctx context.Context, source, category string, table Table, duration time.Duration, err error) {
+	attributes := metric.WithAttributes(attribute.String("source", source), attribute.String("category", category))
+	metrics.decodeDuration.Record(ctx, duration.Seconds(), attributes)
+	if err != nil {
+		metrics.Failed(ctx, source, category, table, err)
+		return
+	}
+	metrics.decoded.Add(ctx, 1, attributes)
+}
+
+/*
+Record the insert of a row, and the lag since the publication of its message when it succeeded
+*/
+func (metrics *Metrics) Inserted(ctx context.Context, msg PubSubMessage, category string, table Table, duration time.Duration, err error) {
+	source := msg.Attributes["source"]
+	attributes := metric.WithAttributes(attribute.String("source", source), attribute.String("category", category), attribute.String("table", table.Key()))
+	if err != nil {
+		metrics.insertDuration.Record(ctx, duration.Seconds(), metric.WithAttributes(attribute.String("table", table.Key()), attribute.String("error.class", string(ClassifyError(err)))))
+		metrics.Failed(ctx, source, category, table, err)
+		return
+	}
+	metrics.insertDuration.Record(ctx, duration.Seconds(), metric.WithAttributes(attribute.String("table", table.Key())))
+	metrics.inserted.Add(ctx, 1, attributes)
+	if !msg.PublishTime.IsZero() {
+		metrics.lag.Record(ctx, time.Since(msg.PublishTime).Seconds(), attributes)
+	}
+}
+
+func (metrics *Metrics) Failed(ctx context.Context, source, category string, table Table, err error) {
+	metrics.failed.Add(ctx, 1, metric.WithAttributes(attribute.String("source", source), attribute.String("category", category),
+		attribute.String("table", table.Key()), attribute.String("error.class", string(ClassifyError(err)))))
+}
+
+func (metrics *Metrics) CreditsUsed(ctx context.Context, source, category string, credits float64) {
+	metrics.creditsUsed.Add(ctx, credits, metric.WithAttributes(attribute.String("source", source), attribute.String("category", category)))
+}
+
+func (metrics *Metrics) Quarantined(ctx context.Context, source, category string) {
+	metrics.quarantined.Add(ctx, 1, metric.WithAttributes(attribute.String("source", source), attribute.String("category", category)))
+}
+
+/*
+Start the metrics exporter of the worker: an OTLP exporter pushing the metrics periodically, or a Prometheus endpoint
+scraped at /metrics. The returned function flushes and stops the exporter.
+*/
+func StartMetricsExporter(ctx context.Context, config MetricsConfig) (func(context.Context) error, error) {
+	var provider *sdkmetric.MeterProvider
+	var server *http.Server
+	switch config.Exporter {
+	case "":
+		return func(context.Context) error { return nil }, nil
+	case MetricsExporterOTLP:
+		var opts []otlpmetricgrpc.Option
+		if config.Endpoint != "" {
+			opts = append(opts, otlpmetricgrpc.WithEndpoint(config.Endpoint))
+		}
+		if config.Insecure {
+			opts = append(opts, otlpmetricgrpc.WithInsecure())
+		}
+		exporter, err := otlpmetricgrpc.New(ctx, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create otlp metrics exporter: %v", err)
+		}
+		interval := config.Interval.Duration
+		if interval <= 0 {
+			interval = time.Minute
+		}
+		provider = sdkmetric.NewMeterProvider(sdkmetric.WithReader(sdkmetric.NewPeriodicReader(exporter, sdkmetric.WithInterval(interval))))
+	case MetricsExporterPrometheus:
+		registry := prometheus.NewRegistry()
+		exporter, err := otelprometheus.New(otelprometheus.WithRegisterer(registry))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create prometheus metrics exporter: %v", err)
+		}
+		provider = sdkmetric.NewMeterProvider(sdkmetric.WithReader(exporter))
+		address := config.Address
+		if address == "" {
+			address = ":9464"
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+		server = &http.Server{Addr: address, Handler: mux}
+		go func() {
+			if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.Error("Prometheus metrics endpoint failed", "address", address, "error", err)
+			}
+		}()
+		logger.Info("Prometheus metrics endpoint listening", "address", address)
+	default:
+		return nil, fmt.Errorf("invalid metrics exporter: %s", config.Exporter)
+	}
+	shutdown := func(ctx context.Context) error {
+		if server != nil {
+			return errors.Join(server.Shutdown(ctx), provider.Shutdown(ctx))
+		}
+		return provider.Shutdown(ctx)
+	}
+	return shutdown, SetMeterProvider(provider)
+}
@@ -0,0 +1,167 @@
+package function
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+const metricsTestConfig = `{"tables": [{"source": "shop", "datasetId": "brevo", "tableId": "emails", "eventCategory": "transactional-email"}]}`
+
+/*
+Record the metrics with an in-memory reader for the duration of the test
+*/
+func useTestMeterProvider(t *testing.T) *sdkmetric.ManualReader {
+	t.Helper()
+	reader := sdkmetric.NewManualReader()
+	provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	if err := SetMeterProvider(provider); err != nil {
+		t.Fatalf("SetMeterProvider: %v", err)
+	}
+	t.Cleanup(func() { _ = provider.Shutdown(context.Background()) })
+	return reader
+}
+
+/*
+Collect the data points of a metric, by their attributes encoded as "name=value,..." sorted by name
+*/
+func collectMetric(t *testing.T, reader *sdkmetric.ManualReader, name string) map[string]float64 {
+	t.Helper()
+	var resourceMetrics metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &resourceMetrics); err != nil {
+		t.Fatalf("Collect: %v", err)
+	}
+	points := make(map[string]float64)
+	for _, scope := range resourceMetrics.ScopeMetrics {
+		for _, m := range scope.Metrics {
+			if m.Name != name {
+				continue
+			}
+			switch data := m.Data.(type) {
+			case metricdata.Sum[int64]:
+				for _, point := range data.DataPoints {
+					points[point.Attributes.Encoded(attribute.DefaultEncoder())] = float64(point.Value)
+				}
+			case metricdata.Sum[float64]:
+				for _, point := range data.DataPoints {
+					points[point.Attributes.Encoded(attribute.DefaultEncoder())] = point.Value
+				}
+			case metricdata.Gauge[int64]:
+				for _, point := range data.DataPoints {
+					points[point.Attributes.Encoded(attribute.DefaultEncoder())] = float64(point.Value)
+				}
+			case metricdata.Histogram[float64]:
+				for _, point := range data.DataPoints {
+					points[point.Attributes.Encoded(attribute.DefaultEncoder())] = float64(point.Count)
+				}
+			default:
+				t.Fatalf("unexpected data of metric %s: %T", name, m.Data)
+			}
+		}
+	}
+	return points
+}
+
+func TestMetricsOfTheConsumer(t *testing.T) {
+	reader := useTestMeterProvider(t)
+	sink := startTestConsumer(t, metricsTestConfig)
+	ctx := context.Background()
+	attributes := map[string]string{"source": "shop", "category": "transactional-email"}
+
+	if err := publish(ctx, t, "m1", attributes, testTransactionalEmail); err != nil {
+		t.Fatalf("valid message: %v", err)
+	}
+	if err := publish(ctx, t, "m2", attributes, `{"event": 1}`); err == nil {
+		t.Fatal("invalid message: no error")
+	}
+	sink.FailNext(errUnavailable)
+	if err := publish(ctx, t, "m3", attributes, testTransactionalEmail); err == nil {
+		t.Fatal("failed insert: no error")
+	}
+
+	tests := []struct {
+		metric string
+		want   map[string]float64
+	}{
+		{"brevo.messages.received", map[string]float64{
+			"category=transactional-email,source=shop": 3,
+		}},
+		{"brevo.messages.decoded", map[string]float64{
+			"category=transactional-email,source=shop": 2,
+		}},
+		{"brevo.rows.inserted", map[string]float64{
+			"category=transactional-email,source=shop,table=brevo.emails": 1,
+		}},
+		{"brevo.rows.failed", map[string]float64{
+			"category=transactional-email,error.class=unknown,source=shop,table=brevo.emails":   1,
+			"category=transactional-email,error.class=transient,source=shop,table=brevo.emails": 1,
+		}},
+		{"brevo.decode.duration", map[string]float64{
+			"category=transactional-email,source=shop": 3,
+		}},
+		{"brevo.insert.duration", map[string]float64{
+			"table=brevo.emails":                       1,
+			"error.class=transient,table=brevo.emails": 1,
+		}},
+		{"brevo.publish.lag", map[string]float64{
+			"category=transactional-email,source=shop,table=brevo.emails": 1,
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.metric, func(t *testing.T) {
+			got := collectMetric(t, reader, test.metric)
+			if len(got) != len(test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+			for attributes, value := range test.want {
+				if got[attributes] != value {
+					t.Errorf("%s: got %v, want %v", attributes, got[attributes], value)
+				}
+			}
+		})
+	}
+}
+
+func TestMetricsOfTheSpool(t *testing.T) {
+	reader := useTestMeterProvider(t)
+	sink, fake, _ := newSpoolingTestSink(t, SpoolConfig{})
+	spoolingSink.Store(sink)
+	t.Cleanup(func() { spoolingSink.Store(nil) })
+	fake.SetOutage(errUnavailable)
+	for i := 1; i <= 3; i++ {
+		_ = sink.Insert(context.Background(), spoolTestTable, spoolTestRow(i))
+	}
+	if got := collectMetric(t, reader, "brevo.spool.entries"); got[""] != 2 {
+		t.Errorf("spool entries: got %v, want 2", got)
+	}
+	if got := collectMetric(t, reader, "brevo.breaker.state"); got["state=open"] != 1 || got["state=closed"] != 0 {
+		t.Errorf("breaker state: got %v, want open", got)
+	}
+}
+
+func TestSetMeterProviderWhileRecording(t *testing.T) {
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				telemetry().Received(ctx, "shop", "transactional-email")
+			}
+		}()
+	}
+	var reader *sdkmetric.ManualReader
+	for range 5 {
+		reader = useTestMeterProvider(t)
+	}
+	wg.Wait()
+	telemetry().Received(ctx, "shop", "transactional-email")
+	if got := collectMetric(t, reader, "brevo.messages.received"); got["category=transactional-email,source=shop"] < 1 {
+		t.Errorf("messages received by the last provider: got %v", got)
+	}
+}
@@ -0,0 +1,231 @@
+package function
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	NotifierWebhook = "webhook"
+	NotifierSlack   = "slack"
+)
+
+const defaultNotifierTimeout = 5 * time.Second
+
+/*
+NotifierConfig holds the endpoint receiving the alerts: a webhook receiving them in JSON, or a Slack-compatible incoming
+webhook receiving their message. The URL and the headers can be read from an environment variable (env:NAME) or from
+Secret Manager (secret:projects/.../versions/...).
+*/
+type NotifierConfig struct {
+	Type    string            `json:"type"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+	Timeout Duration          `json:"timeout"`
+}
+
+/*
+Alert is a notification of a condition of the consumer, such as a low SMS credit balance
+*/
+type Alert struct {
+	Name    string             `json:"name"`
+	Source  string             `json:"source,omitempty"`
+	Message string             `json:"message"`
+	Values  map[string]float64 `json:"values,omitempty"`
+	Time    time.Time          `json:"time"`
+}
+
+/*
+Notifier sends the alerts to their recipients
+*/
+type Notifier interface {
+	Notify(ctx context.Context, alert Alert) error
+}
+
+/*
+Create the notifier of the configuration, resolving its URL and headers. The notifier is nil when no type is configured.
+*/
+func (bqContext *BqContext) NewNotifier(ctx context.Context, config NotifierConfig) (Notifier, error) {
+	if config.Type == "" {
+		return nil, nil
+	}
+	if config.URL == "" {
+		return nil, fmt.Errorf("missing url of the %s notifier", config.Type)
+	}
+	url, err := bqContext.resolveSecret(ctx, config.URL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve the url of the %s notifier: %v", config.Type, err)
+	}
+	headers := make(map[string]string, len(config.Headers))
+	for name, value := range config.Headers {
+		resolved, err := bqContext.resolveSecret(ctx, value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve header %s of the %s notifier: %v", name, config.Type, err)
+		}
+		headers[name] = string(resolved)
+	}
+	timeout := config.Timeout.Duration
+	if timeout <= 0 {
+		timeout = defaultNotifierTimeout
+	}
+	client := &http.Client{Timeout: timeout}
+	switch config.Type {
+	case NotifierWebhook:
+		return &WebhookNotifier{url: string(url), headers: headers, client: client}, nil
+	case NotifierSlack:
+		return &SlackNotifier{WebhookNotifier{url: string(url), headers: headers, client: client}}, nil
+	default:
+		return nil, fmt.Errorf("invalid notifier type: %s", config.Type)
+	}
+}
+
+/*
+WebhookNotifier posts the alerts in JSON to a URL
+*/
+type WebhookNotifier struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+func (notifier *WebhookNotifier) Notify(ctx context.Context, alert Alert) error {
+	return notifier.post(ctx, alert)
+}
+
+func (notifier *WebhookNotifier) post(ctx context.Context, payload any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, notifier.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create notification: %v", err)
+	}
+	request.Header.Set("Content-Type", "application/json")
+	for name, value := range notifier.headers {
+		request.Header.Set(name, value)
+	}
+	response, err := notifier.client.Do(request)
+	if err != nil {
+		// The error holds the URL, which can be a secret
+		return fmt.Errorf("failed to send notification to %s", request.URL.Host)
+	}
+	defer response.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(response.Body, 1<<16))
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("notification rejected by %s with status %d", request.URL.Host, response.StatusCode)
+	}
+	return nil
+}
+
+/*
+SlackNotifier posts the alerts to a Slack-compatible incoming webhook, as a text message
+*/
+type SlackNotifier struct {
+	WebhookNotifier
+}
+
+func (notifier *SlackNotifier) Notify(ctx context.Context, alert Alert) error {
+	return notifier.post(ctx, map[string]string{"text": alert.Text()})
+}
+
+/*
+Text of the alert: its name, source and message, and its values sorted by name
+*/
+func (alert Alert) Text() string {
+	var text strings.Builder
+	fmt.Fprintf(&text, "*%s*", alert.Name)
+	if alert.Source != "" {
+		fmt.Fprintf(&text, " (%s)", alert.Source)
+	}
+	fmt.Fprintf(&text, ": %s", alert.Message)
+	for _, name := range slices.Sorted(maps.Keys(alert.Values)) {
+		fmt.Fprintf(&text, "\n%s: %g", name, alert.Values[name])
+	}
+	return text.String()
+}
+
+/*
+Check whether an alert must be sent: its condition is met, and it was not sent during the cooldown. The alert is reset
+when its condition is no longer met, so that it is sent as soon as it is met again.
+*/
+func alertDue(alerted map[string]time.Time, name string, condition bool, now time.Time, cooldown time.Duration) bool {
+	if !condition {
+		delete(alerted, name)
+		return false
+	}
+	if last, ok := alerted[name]; ok && now.Sub(last) < cooldown {
+		return false
+	}
+	alerted[name] = now
+	return true
+}
+
+// Alerts waiting to be sent by the notifier, beyond which the alerts are only logged
+const notificationQueueSize = 100
+
+/*
+notification is an alert waiting to be sent, with the context of the message or of the check that raised it
+*/
+type notification struct {
+	ctx   context.Context
+	alert Alert
+}
+
+/*
+Log the alert, and send it with the notifier of the consumer. In the worker, the alert is queued, so that a slow endpoint
+doesn't delay the acknowledgement of the messages, and dropped when the queue is full. Otherwise, the CPU of a function
+is throttled once it answers: the alert is sent before the message is acknowledged, within the timeout of the notifier.
+*/
+func (bqContext *BqContext) notify(ctx context.Context, alert Alert) {
+	logger.WarnContext(ctx, "Alert", "alert", alert.Name, "source", alert.Source, "message", alert.Message, "values", alert.Values)
+	if bqContext.notifier == nil {
+		return
+	}
+	if bqContext.notifications == nil {
+		sendNotification(bqContext.notifier, notification{ctx: context.WithoutCancel(ctx), alert: alert})
+		return
+	}
+	select {
+	case bqContext.notifications <- notification{ctx: context.WithoutCancel(ctx), alert: alert}:
+	default:
+		logger.ErrorContext(ctx, "Alert notification dropped, too many alerts waiting", "alert", alert.Name, "source", alert.Source)
+	}
+}
+
+/*
+Queue the alerts of the consumer, and send them in the background. Only the worker keeps its CPU between the messages.
+*/
+func (bqContext *BqContext) startNotifications() {
+	if bqContext.notifier == nil {
+		return
+	}
+	bqContext.notifications = make(chan notification, notificationQueueSize)
+	go sendNotifications(bqContext.notifier, bqContext.notifications)
+}
+
+/*
+Send the queued alerts with the notifier, one at a time
+*/
+func sendNotifications(notifier Notifier, notifications <-chan notification) {
+	for queued := range notifications {
+		sendNotification(notifier, queued)
+	}
+}
+
+/*
+Send the alert with the notifier, logging the failure
+*/
+func sendNotification(notifier Notifier, queued notification) {
+	if err := notifier.Notify(queued.ctx, queued.alert); err != nil {
+		logger.ErrorContext(queued.ctx, "Alert notification failed", "alert", queued.alert.Name, "source", queued.alert.Source, "error", err)
+	}
+}
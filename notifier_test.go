@@ -0,0 +1,180 @@
+package function
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testAlert = Alert{
+	Name:    AlertLowBalance,
+	Source:  "shop",
+	Message: "90 SMS credits remaining, below 100",
+	Values:  map[string]float64{"remaining": 90},
+	Time:    time.Date(2025, 10, 9, 12, 0, 0, 0, time.UTC),
+}
+
+type receivedNotification struct {
+	header http.Header
+	body   []byte
+}
+
+/*
+Start an endpoint answering the notifications with the status, and return the notifications it receives
+*/
+func startTestEndpoint(t *testing.T, status int) (*httptest.Server, chan receivedNotification) {
+	t.Helper()
+	received := make(chan receivedNotification, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- receivedNotification{header: r.Header, body: body}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server, received
+}
+
+func TestNotifierPayloads(t *testing.T) {
+	t.Setenv("NOTIFIER_TOKEN", "s3cret")
+	tests := []struct {
+		name string
+		kind string
+		want string
+	}{
+		{"webhook", NotifierWebhook, `{"name":"sms-credits-low-balance","source":"shop","message":"90 SMS credits remaining, below 100","values":{"remaining":90},"time":"2025-10-09T12:00:00Z"}`},
+		{"slack", NotifierSlack, `{"text":"*sms-credits-low-balance* (shop): 90 SMS credits remaining, below 100\nremaining: 90"}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, received := startTestEndpoint(t, http.StatusOK)
+			var consumer BqContext
+			config := NotifierConfig{Type: test.kind, URL: server.URL, Headers: map[string]string{"Authorization": "env:NOTIFIER_TOKEN"}}
+			notifier, err := consumer.NewNotifier(t.Context(), config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := notifier.Notify(t.Context(), testAlert); err != nil {
+				t.Fatalf("Notify: %v", err)
+			}
+			notification := <-received
+			if got := string(notification.body); got != test.want {
+				t.Errorf("payload:\ngot  %s\nwant %s", got, test.want)
+			}
+			if got := notification.header.Get("Authorization"); got != "s3cret" {
+				t.Errorf("header: got %q, want the resolved secret", got)
+			}
+			if got := notification.header.Get("Content-Type"); got != "application/json" {
+				t.Errorf("content type: got %q", got)
+			}
+		})
+	}
+}
+
+func TestNotifierRejections(t *testing.T) {
+	for _, status := range []int{http.StatusMovedPermanently, http.StatusBadRequest, http.StatusInternalServerError} {
+		t.Run(http.StatusText(status), func(t *testing.T) {
+			server, _ := startTestEndpoint(t, status)
+			var consumer BqContext
+			notifier, err := consumer.NewNotifier(t.Context(), NotifierConfig{Type: NotifierWebhook, URL: server.URL + "/alerts?key=s3cret"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = notifier.Notify(t.Context(), testAlert)
+			if err == nil {
+				t.Fatal("rejected notification: no error")
+			}
+			if !strings.Contains(err.Error(), strconv.Itoa(status)) {
+				t.Errorf("error without the status: %v", err)
+			}
+			// The URL can be a secret: only its host is reported
+			if strings.Contains(err.Error(), "s3cret") {
+				t.Errorf("error leaks the url: %v", err)
+			}
+		})
+	}
+	var consumer BqContext
+	notifier, err := consumer.NewNotifier(t.Context(), NotifierConfig{Type: NotifierWebhook, URL: "http://127.0.0.1:0/alerts?key=s3cret", Timeout: Duration{time.Second}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := notifier.Notify(t.Context(), testAlert); err == nil || strings.Contains(err.Error(), "s3cret") {
+		t.Errorf("unreachable endpoint: got %v, want an error without the url", err)
+	}
+}
+
+func TestAlertsAreSentAsynchronouslyByTheWorker(t *testing.T) {
+	// The endpoint answers once the alert is logged, so that a synchronous notification would block the test
+	release := make(chan struct{})
+	received := make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		<-release
+		received <- body
+	}))
+	t.Cleanup(server.Close)
+	t.Cleanup(func() {
+		select {
+		case <-release:
+		default:
+			close(release)
+		}
+	})
+	var buffer bytes.Buffer
+	previous := logger
+	logger = slog.New(redactingHandler{Handler: slog.NewJSONHandler(&buffer, nil)})
+	t.Cleanup(func() { logger = previous })
+	startTestConsumer(t, `{"notifier": {"type": "webhook", "url": "`+server.URL+`"}}`)
+	bqContext.startNotifications()
+
+	done := make(chan struct{})
+	go func() {
+		bqContext.notify(context.Background(), testAlert)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("notify waits for the endpoint")
+	}
+	close(release)
+	select {
+	case body := <-received:
+		var alert Alert
+		if err := json.Unmarshal(body, &alert); err != nil || alert.Name != testAlert.Name {
+			t.Errorf("notification: got %s (%v)", body, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("alert not sent")
+	}
+	var logged map[string]any
+	if err := json.Unmarshal(bytes.SplitN(buffer.Bytes(), []byte("\n"), 2)[0], &logged); err != nil {
+		t.Fatal(err)
+	}
+	if logged["alert"] != testAlert.Name {
+		t.Errorf("alert log: got %v, want the name of the alert", logged)
+	}
+}
+
+func TestAlertsAreSentBeforeTheFunctionAnswers(t *testing.T) {
+	server, received := startTestEndpoint(t, http.StatusOK)
+	startTestConsumer(t, `{"notifier": {"type": "webhook", "url": "`+server.URL+`"}}`)
+	// The CPU of a function is throttled once it answers: the alert is sent before notify returns
+	bqContext.notify(context.Background(), testAlert)
+	select {
+	case notification := <-received:
+		var alert Alert
+		if err := json.Unmarshal(notification.body, &alert); err != nil || alert.Name != testAlert.Name {
+			t.Errorf("notification: got %s (%v)", notification.body, err)
+		}
+	default:
+		t.Fatal("alert not sent when notify returns")
+	}
+}
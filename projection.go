@@ -0,0 +1,174 @@
+package function
+
+import (
+	"fmt"
+	"slices"
+
+	"cloud.google.com/go/bigquery"
+)
+
+/*
+Projection converts the events of several categories to a common row format, so that a table can receive events of several categories.
+The projections receive the decoded event and the payload of the message, and return nil for the events they don't store.
+*/
+type Projection struct {
+	Categories  []string
+	Model       any
+	Description map[string]string
+	Project     func(category, source string, event Event, payload []byte) any
+}
+
+const UnifiedProjection = "unified"
+
+/*
+Projections available for the tables (projection field of the configuration)
+*/
+var Projections = map[string]Projection{
+	"sms-credits": {
+		Categories:  []string{"marketing-sms", "transactional-sms"},
+		Model:       SMSCreditEventBigquery{},
+		Description: SMSCreditEventBigqueryDescription,
+		Project:     projectSMSCredit,
+	},
+	UnifiedProjection: {
+		Categories:  []string{"transactional-email", "marketing-email", "marketing-sms", "transactional-sms"},
+		Model:       UnifiedEventBigquery{},
+		Description: UnifiedEventBigqueryDescription,
+		Project:     projectUnified,
+	},
+	LifecycleProjection: {
+		Categories:  []string{"transactional-email", "marketing-email", "marketing-sms", "transactional-sms"},
+		Model:       LifecycleEventBigquery{},
+		Description: LifecycleEventBigqueryDescription,
+		Project:     projectLifecycle,
+	},
+	SuppressionProjection: {
+		Categories:  []string{"transactional-email", "marketing-email", "marketing-sms", "transactional-sms"},
+		Model:       SuppressionEventBigquery{},
+		Description: SuppressionEventBigqueryDescription,
+		Project:     projectSuppression,
+	},
+	AggregateProjection: {
+		Categories:  []string{"transactional-email", "marketing-email", "marketing-sms", "transactional-sms"},
+		Model:       AggregateEventBigquery{},
+		Description: AggregateEventBigqueryDescription,
+		Project:     projectAggregate,
+	},
+}
+
+/*
+Check whether the table can receive events of the category, either natively or through its projection
+*/
+func (table Table) Accepts(category string) bool {
+	if table.Projection != "" {
+		return slices.Contains(Projections[table.Projection].Categories, category)
+	}
+	return table.EventCategory == category
+}
+
+/*
+Convert the event to the row format of the table. The projections only receive the payload when the table stores it.
+*/
+func (table Table) Row(category, source string, event Event, payload []byte) any {
+	if !table.Payload {
+		payload = nil
+	}
+	if table.Projection != "" {
+		return Projections[table.Projection].Project(category, source, event, payload)
+	}
+	return event.ToBigquery()
+}
+
+/*
+Generate the BigQuery schema of the table, from its projection or its event category, with the _metadata column when
+rowMetadata is set
+*/
+func (table Table) Schema() (bigquery.Schema, error) {
+	var schema bigquery.Schema
+	var err error
+	if table.Projection != "" {
+		projection, ok := Projections[table.Projection]
+		if !ok {
+			return nil, fmt.Errorf("projection not found: %s", table.Projection)
+		}
+		schema, err = GenerateTableSchema(projection.Model, projection.Description)
+	} else {
+		schema, err = GenerateCategorySchema(table.EventCategory)
+	}
+	if err != nil || !table.RowMetadata {
+		return schema, err
+	}
+	return append(schema, rowMetadataField()), nil
+}
+
+/*
+SMSCreditEventBigquery is a struct that represents the credit consumption of a marketing or transactional SMS event in the bigquery format.
+*/
+type SMSCreditEventBigquery struct {
+	Source           bigquery.NullString  `json:"source"`
+	Category         bigquery.NullString  `json:"category"`
+	Id               bigquery.NullInt64   `json:"id"`
+	MessageId        bigquery.NullInt64   `json:"message_id"`
+	CampaignId       bigquery.NullInt64   `json:"campaign_id"`
+	To               bigquery.NullString  `json:"to"`
+	SMSCount         bigquery.NullInt64   `json:"sms_count"`
+	CreditsUsed      bigquery.NullFloat64 `json:"credits_used"`
+	RemainingCredits bigquery.NullFloat64 `json:"remaining_credits"`
+	MsgStatus        bigquery.NullString  `json:"msg_status"`
+	Date             bigquery.NullString  `json:"date"`
+	TSEvent          bigquery.NullInt64   `json:"ts_event"`
+	Tag              []string             `json:"tag"`
+}
+
+var SMSCreditEventBigqueryDescription = map[string]string{
+	"Source":           "Source attribute of the Pub/Sub message",
+	"Category":         "Event category (marketing-sms or transactional-sms)",
+	"Id":               "Webhook id",
+	"MessageId":        "Internal id of message",
+	"CampaignId":       "Campaign id for campaign sms",
+	"To":               "Mobile number of the recipient",
+	"SMSCount":         "Number of SMS sent",
+	"CreditsUsed":      "Credits deducted",
+	"RemainingCredits": "Remaining balance credit",
+	"MsgStatus":        "Status of the message (sent, delivered, soft_bounce, hard_bounce)",
+	"Date":             "Time at which the event is generated",
+	"TSEvent":          "Timestamp in seconds of when event occurred",
+	"Tag":              "SMS tags",
+}
+
+func projectSMSCredit(category, source string, event Event, _ []byte) any {
+	row := SMSCreditEventBigquery{
+		Source:   bigquery.NullString{StringVal: source, Valid: source != ""},
+		Category: bigquery.NullString{StringVal: category, Valid: true},
+	}
+	switch e := event.(type) {
+	case MarketingSMSEvent:
+		row.Id = toNullInt64(e.Id)
+		row.MessageId = toNullInt64(e.MessageId)
+		row.CampaignId = toNullInt64(e.CampaignId)
+		row.To = toNullString(e.To)
+		row.SMSCount = toNullInt64(e.SMSCount)
+		row.CreditsUsed = toNullFloat64(e.CreditsUsed)
+		row.RemainingCredits = toNullFloat64(e.RemainingCredits)
+		row.MsgStatus = toNullString(e.MsgStatus)
+		row.Date = toNullString(e.Date)
+		row.TSEvent = toNullInt64(e.TSEvent)
+		if e.Tag != nil {
+			row.Tag = *e.Tag
+		}
+	case TransactionalSMSEvent:
+		row.Id = toNullInt64(e.Id)
+		row.MessageId = toNullInt64(e.MessageId)
+		row.To = toNullString(e.To)
+		row.SMSCount = toNullInt64(e.SMSCount)
+		row.CreditsUsed = toNullFloat64(e.CreditsUsed)
+		row.RemainingCredits = toNullFloat64(e.RemainingCredit)
+		row.MsgStatus = toNullString(e.MsgStatus)
+		row.Date = toNullString(e.Date)
+		row.TSEvent = toNullInt64(e.TSEvent)
+		if e.Tag != nil {
+			row.Tag = *e.Tag
+		}
+	}
+	return row
+}
@@ -0,0 +1,101 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+/*
+QuarantineCategory is the internal event category of the quarantine table
+*/
+const QuarantineCategory = "quarantine"
+
+/*
+QuarantineRecordBigquery is a struct that represents a message that could not be routed, in the bigquery format.
+*/
+type QuarantineRecordBigquery struct {
+	Reason        bigquery.NullString `json:"reason"`
+	Source        bigquery.NullString `json:"source"`
+	Category      bigquery.NullString `json:"category"`
+	MessageId     bigquery.NullString `json:"message_id"`
+	Attributes    bigquery.NullString `json:"attributes"`
+	Payload       bigquery.NullString `json:"payload"`
+	QuarantinedAt time.Time           `json:"quarantined_at"`
+	Errors        []RowErrorBigquery  `json:"errors"`
+}
+
+type RowErrorBigquery struct {
+	Field   bigquery.NullString `json:"field"`
+	Reason  bigquery.NullString `json:"reason"`
+	Message bigquery.NullString `json:"message"`
+}
+
+var QuarantineRecordBigqueryDescription = map[string]string{
+	"Reason":        "Why the message was quarantined",
+	"Source":        "Source attribute of the Pub/Sub message",
+	"Category":      "Category attribute of the Pub/Sub message",
+	"MessageId":     "Pub/Sub message id",
+	"Attributes":    "All the Pub/Sub message attributes, JSON encoded",
+	"Payload":       "Raw Pub/Sub message data, when the quarantine table stores the payloads",
+	"QuarantinedAt": "Time at which the message was quarantined",
+	"Errors":        "Errors of BigQuery on the fields of the rejected row",
+}
+
+/*
+Quarantine stores a message that can't be processed in the quarantine table, so that it is acknowledged instead of being redelivered.
+If no quarantine table is configured, an error is returned and the message is redelivered. The row errors are those of BigQuery when the row was rejected.
+The payload of the message is only stored when the quarantine table opts in.
+*/
+func (bqContext *BqContext) Quarantine(ctx context.Context, msg PubSubMessage, reason string, rowErrors []RowError) error {
+	if bqContext.QuarantineTable == nil {
+		return fmt.Errorf("message quarantined but no quarantine table configured: %s", reason)
+	}
+	attributes, err := json.Marshal(msg.Attributes)
+	if err != nil {
+		return fmt.Errorf("failed to encode attributes: %v", err)
+	}
+	record := QuarantineRecordBigquery{
+		Reason:        bigquery.NullString{StringVal: reason, Valid: true},
+		Source:        toNullString(attributeOrNil(msg.Attributes, "source")),
+		Category:      toNullString(attributeOrNil(msg.Attributes, "category")),
+		MessageId:     bigquery.NullString{StringVal: msg.MessageId, Valid: msg.MessageId != ""},
+		Attributes:    bigquery.NullString{StringVal: string(attributes), Valid: true},
+		QuarantinedAt: time.Now().UTC(),
+	}
+	if bqContext.QuarantineTable.Payload && len(msg.Data) > 0 {
+		// The payload holds the personal data in clear, whatever the field transforms and the encryption of the tables
+		record.Payload = bigquery.NullString{StringVal: string(msg.Data), Valid: true}
+	}
+	for _, rowError := range rowErrors {
+		record.Errors = append(record.Errors, RowErrorBigquery{
+			Field:   bigquery.NullString{StringVal: rowError.Field, Valid: rowError.Field != ""},
+			Reason:  bigquery.NullString{StringVal: rowError.Reason, Valid: rowError.Reason != ""},
+			Message: bigquery.NullString{StringVal: rowError.Message, Valid: true},
+		})
+	}
+	row := InsertRow{Row: record, InsertId: insertId(msg.MessageId, *bqContext.QuarantineTable)}
+	if bqContext.QuarantineTable.RowMetadata {
+		row.Metadata = NewRowMetadata(ctx, msg)
+	}
+	err = bqContext.Sink.Insert(ctx, *bqContext.QuarantineTable, row)
+	if err != nil {
+		return fmt.Errorf("failed to quarantine message (%s): %v", reason, err)
+	}
+	telemetry().Quarantined(ctx, msg.Attributes["source"], msg.Attributes["category"])
+	logger.WarnContext(ctx, "Message quarantined", "reason", reason, "messageId", msg.MessageId, "attributes", msg.Attributes)
+	return nil
+}
+
+/*
+Return a pointer to the attribute value, or nil if the attribute is missing
+*/
+func attributeOrNil(attributes map[string]string, key string) *string {
+	if value, ok := attributes[key]; ok {
+		return &value
+	}
+	return nil
+}
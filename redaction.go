@@ -0,0 +1,382 @@
+package function
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	mathrand "math/rand/v2"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	RedactKeep = "keep"
+	RedactMask = "mask"
+	RedactHash = "hash"
+	RedactOmit = "omit"
+)
+
+/*
+LoggingConfig holds the settings of the logs: the minimum level, the ratio of the successful rows that are logged, and the
+redaction of the personal data. The redaction of each field defaults to the pii tag of the field in the event structs,
+and can be overridden by its dotted path in the events (content.last_name).
+*/
+type LoggingConfig struct {
+	Level             string            `json:"level"`
+	SuccessSampleRate *float64          `json:"successSampleRate"`
+	Redaction         map[string]string `json:"redaction"`
+	HashSalt          string            `json:"hashSalt"`
+}
+
+// Minimum level of the logs
+var logLevel = new(slog.LevelVar)
+
+// Ratio of the successful rows that are logged
+var successSampleRate atomic.Pointer[float64]
+
+// The event structs whose pii tags define the default redaction of the fields
+var piiModels = []any{TransactionalEmailEvent{}, MarketingEmailEvent{}, MarketingSMSEvent{}, TransactionalSMSEvent{}}
+
+// The redactor of the logs, with the default redaction until the configuration is loaded
+var redactor atomic.Pointer[Redactor]
+var defaultRedactor = NewRedactor(LoggingConfig{})
+
+func currentRedactor() *Redactor {
+	if r := redactor.Load(); r != nil {
+		return r
+	}
+	return defaultRedactor
+}
+
+/*
+Apply the logging configuration
+*/
+func ConfigureLogging(config LoggingConfig) error {
+	if config.Level != "" {
+		if err := logLevel.UnmarshalText([]byte(config.Level)); err != nil {
+			return fmt.Errorf("invalid log level %s: %v", config.Level, err)
+		}
+	}
+	if rate := config.SuccessSampleRate; rate != nil {
+		if *rate < 0 || *rate > 1 {
+			return fmt.Errorf("invalid success sample rate %v: expected a value between 0 and 1", *rate)
+		}
+		successSampleRate.Store(rate)
+	}
+	for field, action := range config.Redaction {
+		switch action {
+		case RedactKeep, RedactMask, RedactHash, RedactOmit:
+		default:
+			return fmt.Errorf("invalid redaction %s of field %s", action, field)
+		}
+	}
+	redactor.Store(NewRedactor(config))
+	return nil
+}
+
+/*
+Check whether a successful row should be logged, according to the sample rate
+*/
+func logSuccess() bool {
+	rate := successSampleRate.Load()
+	return rate == nil || *rate >= 1 || (*rate > 0 && mathrand.Float64() < *rate)
+}
+
+/*
+Redactor masks, hashes or omits the personal data of the values logged, by the paths of their fields in the events, so
+that a field nested in an event (content.name) doesn't redact the other values of the same name
+*/
+type Redactor struct {
+	actions map[string]string
+	salt    []byte
+}
+
+/*
+Create the redactor of the configuration. The hashes are salted with the configured salt, or the LOG_HASH_SALT
+environment variable, or else a random salt: the hashes of a value are then only equal within an instance.
+*/
+func NewRedactor(config LoggingConfig) *Redactor {
+	r := &Redactor{actions: make(map[string]string)}
+	for _, model := range piiModels {
+		collectPiiTags(reflect.TypeOf(model), "", r.actions)
+	}
+	for field, action := range config.Redaction {
+		r.actions[normalizeFieldPath(field)] = action
+	}
+	salt := config.HashSalt
+	if salt == "" {
+		salt = os.Getenv("LOG_HASH_SALT")
+	}
+	if salt != "" {
+		r.salt = []byte(salt)
+	} else {
+		r.salt = make([]byte, 16)
+		_, _ = rand.Read(r.salt)
+	}
+	return r
+}
+
+/*
+Collect the pii tags of the fields of the struct and of its nested structs, by the normalized paths of the fields.
+The elements of slices and maps have the path of their field.
+*/
+func collectPiiTags(t reflect.Type, prefix string, actions map[string]string) {
+	for t.Kind() == reflect.Pointer || t.Kind() == reflect.Slice || t.Kind() == reflect.Array || t.Kind() == reflect.Map {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return
+	}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		names := []string{field.Name}
+		if name, _, _ := strings.Cut(field.Tag.Get("json"), ","); name != "" && name != "-" {
+			names = append(names, name)
+		}
+		for _, name := range names {
+			path := prefix + normalizeFieldName(name)
+			if action, ok := field.Tag.Lookup("pii"); ok {
+				actions[path] = action
+			}
+			collectPiiTags(field.Type, path+".", actions)
+		}
+	}
+}
+
+/*
+Field names are matched regardless of case, underscores and dashes, so that the JSON names of the events (last_name)
+match the columns of the rows (LastName)
+*/
+func normalizeFieldName(name string) string {
+	return strings.ToLower(strings.NewReplacer("_", "", "-", "").Replace(name))
+}
+
+/*
+Normalize each name of a dotted path
+*/
+func normalizeFieldPath(path string) string {
+	names := strings.Split(path, ".")
+	for i, name := range names {
+		names[i] = normalizeFieldName(name)
+	}
+	return strings.Join(names, ".")
+}
+
+/*
+Path of a field of the value at a path, the root of the values being the empty path
+*/
+func fieldPath(parent string, name string) string {
+	if name == "" {
+		return parent
+	}
+	if parent == "" {
+		return normalizeFieldName(name)
+	}
+	return parent + "." + normalizeFieldName(name)
+}
+
+func (r *Redactor) action(path string) string {
+	return r.actions[path]
+}
+
+/*
+Redact a value: structs, maps and slices are converted to their JSON values, and their fields are redacted by their
+path from the root of the value
+*/
+func (r *Redactor) Redact(value any) any {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return value
+	}
+	return r.redactJSON(encoded)
+}
+
+func (r *Redactor) redactJSON(encoded []byte) any {
+	decoder := json.NewDecoder(bytes.NewReader(encoded))
+	decoder.UseNumber()
+	var decoded any
+	if err := decoder.Decode(&decoded); err != nil {
+		return string(encoded)
+	}
+	return r.redactValue(decoded, "")
+}
+
+func (r *Redactor) redactValue(value any, path string) any {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, field := range v {
+			switch action := r.action(fieldPath(path, key)); action {
+			case "", RedactKeep:
+				v[key] = r.redactValue(field, fieldPath(path, key))
+			case RedactOmit:
+				delete(v, key)
+			default:
+				v[key] = r.apply(action, field)
+			}
+		}
+		return v
+	case []any:
+		for i := range v {
+			v[i] = r.redactValue(v[i], path)
+		}
+		return v
+	default:
+		return value
+	}
+}
+
+/*
+Apply a redaction to the value of a field
+*/
+func (r *Redactor) apply(action string, value any) any {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case []any:
+		for i := range v {
+			v[i] = r.apply(action, v[i])
+		}
+		return v
+	}
+	text := fmt.Sprint(value)
+	if s, ok := value.(string); ok {
+		text = s
+	} else if _, ok := value.(map[string]any); ok {
+		encoded, _ := json.Marshal(value)
+		text = string(encoded)
+	}
+	switch action {
+	case RedactHash:
+		sum := sha256.Sum256(append(r.salt, text...))
+		return "sha256:" + hex.EncodeToString(sum[:8])
+	case RedactMask:
+		return mask(text)
+	default:
+		return nil
+	}
+}
+
+/*
+Mask a value, keeping the first character of an email and its domain, or the last two characters of other values
+*/
+func mask(value string) string {
+	if local, domain, ok := strings.Cut(value, "@"); ok && local != "" {
+		return local[:1] + "***@" + domain
+	}
+	if len(value) > 4 {
+		return "***" + value[len(value)-2:]
+	}
+	return "***"
+}
+
+// Emails and phone numbers, international or of 8 to 15 digits, in free text
+var emailPattern = regexp.MustCompile(`[^\s@"'<>(),;:\[\]]+@[A-Za-z0-9-]+(\.[A-Za-z0-9-]+)+`)
+var phonePattern = regexp.MustCompile(`\+\d[\d .-]{6,18}\d|\b\d{8,15}\b`)
+
+/*
+Redact the free text of an error message: the JSON values it embeds are redacted by field path, and the emails and phone
+numbers it quotes are masked
+*/
+func (r *Redactor) redactText(text string) string {
+	if s := strings.TrimSpace(text); strings.HasPrefix(s, "{") || strings.HasPrefix(s, "[") {
+		if redacted, err := json.Marshal(r.redactJSON([]byte(s))); err == nil {
+			return string(redacted)
+		}
+	}
+	text = emailPattern.ReplaceAllStringFunc(text, mask)
+	return phonePattern.ReplaceAllStringFunc(text, mask)
+}
+
+func (r *Redactor) redactRowErrors(rowErrors []RowError) []RowError {
+	redacted := make([]RowError, len(rowErrors))
+	for i, rowError := range rowErrors {
+		redacted[i] = RowError{Field: rowError.Field, Reason: rowError.Reason, Message: r.redactText(rowError.Message)}
+	}
+	return redacted
+}
+
+/*
+redactingHandler redacts the personal data of the attributes of the log records: the attributes named after a top-level
+personal field of the events, the structured values and the JSON strings
+*/
+type redactingHandler struct {
+	slog.Handler
+}
+
+func (h redactingHandler) Handle(ctx context.Context, record slog.Record) error {
+	redacted := slog.NewRecord(record.Time, record.Level, record.Message, record.PC)
+	r := currentRedactor()
+	record.Attrs(func(attr slog.Attr) bool {
+		if attr, ok := r.redactAttr(attr, ""); ok {
+			redacted.AddAttrs(attr)
+		}
+		return true
+	})
+	return h.Handler.Handle(ctx, redacted)
+}
+
+func (h redactingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	r := currentRedactor()
+	redacted := make([]slog.Attr, 0, len(attrs))
+	for _, attr := range attrs {
+		if attr, ok := r.redactAttr(attr, ""); ok {
+			redacted = append(redacted, attr)
+		}
+	}
+	return redactingHandler{Handler: h.Handler.WithAttrs(redacted)}
+}
+
+func (h redactingHandler) WithGroup(name string) slog.Handler {
+	return redactingHandler{Handler: h.Handler.WithGroup(name)}
+}
+
+/*
+Redact an attribute of a group at a path. The attributes are redacted as the fields of an event, and their structured
+values as events. False is returned when the attribute is omitted.
+*/
+func (r *Redactor) redactAttr(attr slog.Attr, group string) (slog.Attr, bool) {
+	value := attr.Value.Resolve()
+	switch action := r.action(fieldPath(group, attr.Key)); action {
+	case "", RedactKeep:
+	case RedactOmit:
+		return attr, false
+	default:
+		return slog.Any(attr.Key, r.apply(action, r.Redact(value.Any()))), true
+	}
+	switch value.Kind() {
+	case slog.KindGroup:
+		var attrs []any
+		for _, groupAttr := range value.Group() {
+			if groupAttr, ok := r.redactAttr(groupAttr, fieldPath(group, attr.Key)); ok {
+				attrs = append(attrs, groupAttr)
+			}
+		}
+		return slog.Group(attr.Key, attrs...), true
+	case slog.KindString:
+		// Raw payloads and rows are logged as JSON strings
+		if s := strings.TrimSpace(value.String()); strings.HasPrefix(s, "{") || strings.HasPrefix(s, "[") {
+			return slog.Any(attr.Key, r.redactJSON([]byte(s))), true
+		}
+	case slog.KindAny:
+		switch v := value.Any().(type) {
+		case error:
+			// The messages of BigQuery and Storage Write errors can echo the values of the rows
+			return slog.String(attr.Key, r.redactText(v.Error())), true
+		case []RowError:
+			return slog.Any(attr.Key, r.Redact(r.redactRowErrors(v))), true
+		}
+		kind := reflect.Indirect(reflect.ValueOf(value.Any())).Kind()
+		if kind == reflect.Struct || kind == reflect.Map || kind == reflect.Slice || kind == reflect.Array {
+			return slog.Any(attr.Key, r.Redact(value.Any())), true
+		}
+	}
+	return attr, true
+}
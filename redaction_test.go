@@ -0,0 +1,136 @@
+package function
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+)
+
+func TestRedactErrors(t *testing.T) {
+	r := NewRedactor(LoggingConfig{})
+	tests := []struct {
+		name   string
+		value  any
+		leaked []string
+		kept   []string
+	}{
+		{
+			name:   "row error echoing an email",
+			value:  errors.New("Invalid value jane.doe@example.com for field email"),
+			leaked: []string{"jane.doe@example.com"},
+			kept:   []string{"j***@example.com", "for field email"},
+		},
+		{
+			name:   "storage write error echoing a phone number",
+			value:  errors.New("cannot convert value '+33 6 12 34 56 78' of field recipient"),
+			leaked: []string{"+33 6 12 34 56 78"},
+			kept:   []string{"of field recipient"},
+		},
+		{
+			name:   "error echoing a row",
+			value:  errors.New(`{"email": "jane.doe@example.com", "event": "delivered"}`),
+			leaked: []string{"jane.doe@example.com"},
+			kept:   []string{"delivered"},
+		},
+		{
+			name: "errors of rows rejected by Bigquery",
+			value: RowErrors(bigquery.PutMultiError{{Errors: []error{
+				&bigquery.Error{Location: "ts_event", Reason: "invalid", Message: "no such field for row of 33612345678"},
+			}}}),
+			leaked: []string{"33612345678"},
+			kept:   []string{"ts_event", "invalid"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			attr, ok := r.redactAttr(slog.Any("error", test.value), "")
+			if !ok {
+				t.Fatal("attribute omitted")
+			}
+			logged := attr.Value.String()
+			for _, leaked := range test.leaked {
+				if strings.Contains(logged, leaked) {
+					t.Errorf("%q leaks %q", logged, leaked)
+				}
+			}
+			for _, kept := range test.kept {
+				if !strings.Contains(logged, kept) {
+					t.Errorf("%q lost %q", logged, kept)
+				}
+			}
+		})
+	}
+}
+
+func TestRedactFieldsByPath(t *testing.T) {
+	email, name, sender := "jane.doe@example.com", "Jane", "news@example.com"
+	tests := []struct {
+		name   string
+		config LoggingConfig
+		attr   slog.Attr
+		leaked []string
+		kept   []string
+	}{
+		{
+			name: "attribute named after a nested field",
+			attr: slog.String("name", "low-balance"),
+			kept: []string{"low-balance"},
+		},
+		{
+			name:   "attribute named after a top-level field",
+			attr:   slog.String("email", email),
+			leaked: []string{email},
+		},
+		{
+			name:   "nested fields of an event",
+			attr:   slog.Any("data", MarketingEmailEvent{Email: &email, CampaignName: &name, Content: &[]MarketingEmailContent{{Name: &name}}}),
+			leaked: []string{email, `"name"`},
+			kept:   []string{`"campaign_name":"Jane"`, "sha256:"},
+		},
+		{
+			name:   "sender of a transactional email",
+			attr:   slog.Any("data", TransactionalEmailEvent{SenderEmail: &sender}),
+			leaked: []string{sender},
+			kept:   []string{"sha256:"},
+		},
+		{
+			name:   "JSON payload",
+			attr:   slog.String("row", `{"email": "jane.doe@example.com", "content": [{"name": "Jane", "last_name": "Doe"}]}`),
+			leaked: []string{email, "Jane", "Doe"},
+		},
+		{
+			name:   "path overridden by the configuration",
+			config: LoggingConfig{Redaction: map[string]string{"content.last_name": RedactKeep}},
+			attr:   slog.String("row", `{"content": [{"name": "Jane", "last_name": "Doe"}]}`),
+			leaked: []string{"Jane"},
+			kept:   []string{"Doe"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			attr, ok := NewRedactor(test.config).redactAttr(test.attr, "")
+			if !ok {
+				t.Fatal("attribute omitted")
+			}
+			encoded, err := json.Marshal(attr.Value.Any())
+			if err != nil {
+				t.Fatal(err)
+			}
+			logged := string(encoded)
+			for _, leaked := range test.leaked {
+				if strings.Contains(logged, leaked) {
+					t.Errorf("%s leaks %s", logged, leaked)
+				}
+			}
+			for _, kept := range test.kept {
+				if !strings.Contains(logged, kept) {
+					t.Errorf("%s lost %s", logged, kept)
+				}
+			}
+		})
+	}
+}
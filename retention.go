@@ -0,0 +1,286 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	RetentionPartitionExpiration = "partition-expiration"
+	RetentionPurge               = "purge"
+)
+
+const (
+	RetentionCompliant = "compliant"
+	RetentionExpired   = "expired"
+	RetentionNoPolicy  = "no-policy"
+	// Rows without time can't be purged
+	RetentionUndated = "undated"
+)
+
+const defaultRetentionInterval = 24 * time.Hour
+
+/*
+RetentionConfig holds the interval of the enforcement of the retention of the tables by the worker
+*/
+type RetentionConfig struct {
+	Interval Duration `json:"interval"`
+}
+
+/*
+RetentionResult is the enforcement of the retention of a table: the partition expiration set on a partitioned table, or
+the rows purged from another table
+*/
+type RetentionResult struct {
+	Table     string    `json:"table"`
+	Retention Duration  `json:"retention"`
+	Action    string    `json:"action"`
+	Cutoff    time.Time `json:"cutoff"`
+	Rows      int64     `json:"rows"`
+	Error     string    `json:"error,omitempty"`
+}
+
+/*
+RetentionStatus is the oldest data of a table against its retention. The undated rows have neither event time nor
+_metadata column: the purge keeps them.
+*/
+type RetentionStatus struct {
+	Table               string     `json:"table"`
+	Retention           Duration   `json:"retention"`
+	Partitioned         bool       `json:"partitioned"`
+	PartitionExpiration Duration   `json:"partitionExpiration"`
+	Oldest              *time.Time `json:"oldest"`
+	Cutoff              *time.Time `json:"cutoff"`
+	Rows                int64      `json:"rows"`
+	ExpiredRows         int64      `json:"expiredRows"`
+	UndatedRows         int64      `json:"undatedRows"`
+	Status              string     `json:"status"`
+	Error               string     `json:"error,omitempty"`
+}
+
+/*
+Time partitioning of a new table with a retention, so that its retention is a partition expiration instead of a purge:
+daily partitions of its first event time column, or of the ingestion time when it has no timestamp column of event time.
+The tables of the aggregates are always partitioned, by the columns their merges select their rows by. Nil when the
+table isn't partitioned.
+*/
+func (table Table) timePartitioning(schema bigquery.Schema) *bigquery.TimePartitioning {
+	partitioning := &bigquery.TimePartitioning{Type: bigquery.DayPartitioningType, Expiration: table.Retention.Duration}
+	switch {
+	case table.Projection == AggregateProjection:
+		partitioning.Field = aggregatesStagingTimeColumn
+		return partitioning
+	case table.EventCategory == AggregateCategory:
+		partitioning.Field = aggregatesTimeColumn
+		return partitioning
+	case table.Retention.Duration <= 0:
+		return nil
+	}
+	for _, column := range eventTimeColumns {
+		if slices.ContainsFunc(schema, func(field *bigquery.FieldSchema) bool {
+			return field.Name == column.name && field.Type == bigquery.TimestampFieldType
+		}) {
+			partitioning.Field = column.name
+			break
+		}
+	}
+	return partitioning
+}
+
+/*
+Clustering of a new table: the staging table of the aggregates is clustered by its partitioning column, so that the
+merges only read the blocks of the rows received since their first minute
+*/
+func (table Table) clustering() *bigquery.Clustering {
+	if table.Projection == AggregateProjection {
+		return &bigquery.Clustering{Fields: []string{aggregatesStagingTimeColumn}}
+	}
+	return nil
+}
+
+/*
+Enforce the retention of the tables: partitioned tables get a partition expiration equal to their retention, and the
+rows of the other tables older than their retention, by event time, are deleted. The tables are enforced one at a time,
+and the errors of a table don't stop the enforcement of the others. The rows without event time are purged by the
+publication time of their message, or by the time they were written, when the table has the _metadata column.
+*/
+func (bqContext *BqContext) ApplyRetention(ctx context.Context) ([]RetentionResult, error) {
+	var results []RetentionResult
+	var errs []error
+	for _, table := range bqContext.ManagedTables() {
+		if table.Retention.Duration <= 0 {
+			continue
+		}
+		result, err := bqContext.applyTableRetention(ctx, table)
+		if err != nil {
+			result.Error = err.Error()
+			errs = append(errs, err)
+			logger.ErrorContext(ctx, "Retention enforcement failed", "table", table.Key(), "error", err)
+		} else {
+			logger.InfoContext(ctx, "Retention enforced", "table", table.Key(), "action", result.Action, "rows", result.Rows)
+		}
+		results = append(results, result)
+	}
+	return results, errors.Join(errs...)
+}
+
+func (bqContext *BqContext) applyTableRetention(ctx context.Context, table Table) (RetentionResult, error) {
+	retention := table.Retention.Duration
+	result := RetentionResult{Table: table.Key(), Retention: table.Retention, Cutoff: time.Now().UTC().Add(-retention)}
+	dataset, err := bqContext.GetDataset(table)
+	if err != nil {
+		return result, err
+	}
+	bqTable := dataset.Table(table.TableId)
+	metadata, err := bqTable.Metadata(ctx)
+	if err != nil {
+		return result, fmt.Errorf("failed to get table %s: %v", table.Key(), err)
+	}
+	if partitioning := metadata.TimePartitioning; partitioning != nil {
+		result.Action = RetentionPartitionExpiration
+		if partitioning.Expiration == retention {
+			return result, nil
+		}
+		updated := *partitioning
+		updated.Expiration = retention
+		if _, err := bqTable.Update(ctx, bigquery.TableMetadataToUpdate{TimePartitioning: &updated}, metadata.ETag); err != nil {
+			return result, fmt.Errorf("failed to set partition expiration of table %s: %v", table.Key(), err)
+		}
+		return result, nil
+	}
+	result.Action = RetentionPurge
+	schema, err := table.Schema()
+	if err != nil {
+		return result, err
+	}
+	expression := eventTimeExpression(schema)
+	if expression == noEventTime {
+		return result, fmt.Errorf("table %s has no time column to purge its rows", table.Key())
+	}
+	client, err := bqContext.GetClient(table)
+	if err != nil {
+		return result, err
+	}
+	query := client.Query(fmt.Sprintf("DELETE FROM %s WHERE %s < @cutoff", bqContext.tableReference(table), expression))
+	query.Parameters = []bigquery.QueryParameter{{Name: "cutoff", Value: result.Cutoff}}
+	query.Location = table.Location
+	job, err := query.Run(ctx)
+	if err != nil {
+		return result, fmt.Errorf("failed to purge table %s: %v", table.Key(), err)
+	}
+	status, err := job.Wait(ctx)
+	if err != nil {
+		return result, fmt.Errorf("failed to wait for purge of table %s: %v", table.Key(), err)
+	}
+	if err := status.Err(); err != nil {
+		return result, fmt.Errorf("purge of table %s failed: %v", table.Key(), err)
+	}
+	if statistics, ok := status.Statistics.Details.(*bigquery.QueryStatistics); ok {
+		result.Rows = statistics.NumDMLAffectedRows
+	}
+	return result, nil
+}
+
+/*
+Report the oldest data of each table against its retention, with the number of rows older than the retention
+*/
+func (bqContext *BqContext) RetentionReport(ctx context.Context) ([]RetentionStatus, error) {
+	var statuses []RetentionStatus
+	for _, table := range bqContext.ManagedTables() {
+		status, err := bqContext.tableRetentionStatus(ctx, table)
+		if err != nil {
+			status.Error = err.Error()
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+func (bqContext *BqContext) tableRetentionStatus(ctx context.Context, table Table) (RetentionStatus, error) {
+	status := RetentionStatus{Table: table.Key(), Retention: table.Retention, Status: RetentionNoPolicy}
+	dataset, err := bqContext.GetDataset(table)
+	if err != nil {
+		return status, err
+	}
+	metadata, err := dataset.Table(table.TableId).Metadata(ctx)
+	if err != nil {
+		return status, fmt.Errorf("failed to get table %s: %v", table.Key(), err)
+	}
+	if metadata.TimePartitioning != nil {
+		status.Partitioned = true
+		status.PartitionExpiration = Duration{metadata.TimePartitioning.Expiration}
+	}
+	schema, err := table.Schema()
+	if err != nil {
+		return status, err
+	}
+	expression := eventTimeExpression(schema)
+	cutoff := time.Now().UTC().Add(-table.Retention.Duration)
+	statement := fmt.Sprintf("SELECT MIN(%s), COUNT(*), COUNTIF(%s < @cutoff), COUNTIF(%s IS NULL) FROM %s", expression, expression, expression, bqContext.tableReference(table))
+	if table.Retention.Duration > 0 {
+		status.Cutoff = &cutoff
+	}
+	client, err := bqContext.GetClient(table)
+	if err != nil {
+		return status, err
+	}
+	query := client.Query(statement)
+	query.Parameters = []bigquery.QueryParameter{{Name: "cutoff", Value: cutoff}}
+	query.Location = table.Location
+	it, err := query.Read(ctx)
+	if err != nil {
+		return status, fmt.Errorf("failed to query table %s: %v", table.Key(), err)
+	}
+	var values []bigquery.Value
+	if err := it.Next(&values); err != nil && !errors.Is(err, iterator.Done) {
+		return status, fmt.Errorf("failed to read table %s: %v", table.Key(), err)
+	}
+	if len(values) == 4 {
+		if oldest, ok := values[0].(time.Time); ok {
+			oldest = oldest.UTC()
+			status.Oldest = &oldest
+		}
+		status.Rows, _ = values[1].(int64)
+		if table.Retention.Duration > 0 {
+			status.ExpiredRows, _ = values[2].(int64)
+		}
+		status.UndatedRows, _ = values[3].(int64)
+	}
+	if table.Retention.Duration > 0 {
+		switch {
+		case status.ExpiredRows > 0:
+			status.Status = RetentionExpired
+		case status.UndatedRows > 0 && !status.Partitioned:
+			status.Status = RetentionUndated
+		default:
+			status.Status = RetentionCompliant
+		}
+	}
+	return status, nil
+}
+
+/*
+Enforce the retention of the tables periodically, until the context is done
+*/
+func (bqContext *BqContext) RunRetention(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultRetentionInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		// Errors are logged by table
+		_, _ = bqContext.ApplyRetention(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
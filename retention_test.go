@@ -0,0 +1,48 @@
+package function
+
+import (
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+func TestTimePartitioningOfNewTables(t *testing.T) {
+	retention := Duration{30 * 24 * time.Hour}
+	tests := []struct {
+		name  string
+		table Table
+		// Partition column, empty for the ingestion time
+		field       string
+		partitioned bool
+	}{
+		{"without retention", Table{EventCategory: "transactional-email"}, "", false},
+		{"integer event time", Table{EventCategory: "transactional-email", Retention: retention}, "", true},
+		{"integer event time with row metadata", Table{EventCategory: "marketing-sms", RowMetadata: true, Retention: retention}, "", true},
+		{"timestamp event time", Table{Projection: UnifiedProjection, Retention: retention}, "EventTime", true},
+		{"quarantine", Table{EventCategory: QuarantineCategory, Retention: retention}, "QuarantinedAt", true},
+		{"vault", Table{EventCategory: VaultCategory, Retention: retention}, "TransformedAt", true},
+		{"aggregates staging without retention", Table{Projection: AggregateProjection, RowMetadata: true}, "ReceivedAt", true},
+		{"aggregates staging", Table{Projection: AggregateProjection, RowMetadata: true, Retention: retention}, "ReceivedAt", true},
+		{"aggregates without retention", Table{EventCategory: AggregateCategory}, "Minute", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			schema, err := test.table.Schema()
+			if err != nil {
+				t.Fatal(err)
+			}
+			partitioning := test.table.timePartitioning(schema)
+			if !test.partitioned {
+				if partitioning != nil {
+					t.Errorf("partitioning: got %+v, want none", partitioning)
+				}
+				return
+			}
+			want := bigquery.TimePartitioning{Type: bigquery.DayPartitioningType, Expiration: test.table.Retention.Duration, Field: test.field}
+			if partitioning == nil || *partitioning != want {
+				t.Errorf("partitioning: got %+v, want %+v", partitioning, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"time"
+)
+
+/*
+RetryPolicy retries the transient errors in the function, with an exponential backoff and full jitter, within a number
+of attempts and a time budget. The errors that are not retried are left to the redelivery of Pub/Sub.
+*/
+type RetryPolicy struct {
+	MaxAttempts    int      `json:"maxAttempts"`
+	InitialBackoff Duration `json:"initialBackoff"`
+	MaxBackoff     Duration `json:"maxBackoff"`
+	Budget         Duration `json:"budget"`
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    4,
+	InitialBackoff: Duration{250 * time.Millisecond},
+	MaxBackoff:     Duration{5 * time.Second},
+	Budget:         Duration{20 * time.Second},
+}
+
+/*
+Fill the unset settings with the default ones
+*/
+func (policy RetryPolicy) WithDefaults() RetryPolicy {
+	if policy.MaxAttempts <= 0 {
+		policy.MaxAttempts = DefaultRetryPolicy.MaxAttempts
+	}
+	if policy.InitialBackoff.Duration <= 0 {
+		policy.InitialBackoff = DefaultRetryPolicy.InitialBackoff
+	}
+	if policy.MaxBackoff.Duration <= 0 {
+		policy.MaxBackoff = DefaultRetryPolicy.MaxBackoff
+	}
+	if policy.Budget.Duration <= 0 {
+		policy.Budget = DefaultRetryPolicy.Budget
+	}
+	return policy
+}
+
+/*
+Call fn until it succeeds, returns an error that is not worth retrying in the function, or the attempts or the budget are exhausted.
+The last error is returned.
+*/
+func (policy RetryPolicy) Do(ctx context.Context, fn func(ctx context.Context) error) error {
+	deadline := time.Now().Add(policy.Budget.Duration)
+	backoff := policy.InitialBackoff.Duration
+	for attempt := 1; ; attempt++ {
+		err := fn(ctx)
+		if err == nil || attempt >= policy.MaxAttempts || !shouldRetryInProcess(ctx, err) {
+			return err
+		}
+		sleep := rand.N(backoff) + time.Millisecond
+		if time.Now().Add(sleep).After(deadline) {
+			return err
+		}
+		logger.WarnContext(ctx, "Retrying after transient error", "attempt", attempt, "backoff", sleep, "error", err, "errorClass", ClassifyError(err))
+		select {
+		case <-ctx.Done():
+			return errors.Join(err, ctx.Err())
+		case <-time.After(sleep):
+		}
+		backoff = min(backoff*2, policy.MaxBackoff.Duration)
+	}
+}
+
+/*
+Transient errors are retried, and so are timeouts of a single attempt, but not the cancellation or the expiration of the invocation
+*/
+func shouldRetryInProcess(ctx context.Context, err error) bool {
+	switch ClassifyError(err) {
+	case ErrorClassTransient:
+		return true
+	case ErrorClassTimeout:
+		return ctx.Err() == nil
+	default:
+		return false
+	}
+}
@@ -0,0 +1,271 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+const (
+	RoutingFirstMatch = "first-match"
+	RoutingFanOut     = "fan-out"
+)
+
+/*
+RoutingConfig holds the routing rules of the messages to the tables.
+In first-match mode, the tables of the first matching rule are used. In fan-out mode, the tables of all the matching rules are used.
+The default tables are used when no rule matches.
+*/
+type RoutingConfig struct {
+	Mode    string        `json:"mode"`
+	Rules   []RoutingRule `json:"rules"`
+	Default []string      `json:"default"`
+}
+
+/*
+RoutingRule matches messages on their source, attributes and payload fields, and points to the tables (datasetId.tableId) they must be sent to.
+All the conditions of a rule must match. A rule without conditions matches every message.
+*/
+type RoutingRule struct {
+	Name       string             `json:"name"`
+	Source     *Pattern           `json:"source"`
+	Attributes map[string]Pattern `json:"attributes"`
+	Fields     map[string]Pattern `json:"fields"`
+	Tables     []string           `json:"tables"`
+}
+
+/*
+Pattern is a glob pattern (*, ?, [...]) or, when prefixed with "re:", a regular expression
+*/
+type Pattern struct {
+	raw    string
+	regexp *regexp.Regexp
+}
+
+func (p *Pattern) UnmarshalJSON(data []byte) error {
+	var raw string
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	compiled, err := NewPattern(raw)
+	if err != nil {
+		return err
+	}
+	*p = compiled
+	return nil
+}
+
+func (p Pattern) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.raw)
+}
+
+/*
+Compile a glob or regular expression pattern
+*/
+func NewPattern(raw string) (Pattern, error) {
+	if expr, ok := strings.CutPrefix(raw, "re:"); ok {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return Pattern{}, fmt.Errorf("invalid regular expression %s: %v", raw, err)
+		}
+		return Pattern{raw: raw, regexp: re}, nil
+	}
+	if _, err := path.Match(raw, ""); err != nil {
+		return Pattern{}, fmt.Errorf("invalid glob pattern %s: %v", raw, err)
+	}
+	return Pattern{raw: raw}, nil
+}
+
+func (p Pattern) Match(value string) bool {
+	if p.regexp != nil {
+		return p.regexp.MatchString(value)
+	}
+	matched, _ := path.Match(p.raw, value)
+	return matched
+}
+
+/*
+RoutedMessage is a Pub/Sub message being routed, with its payload fields decoded on demand
+*/
+type RoutedMessage struct {
+	Message PubSubMessage
+	// Context of the message, for the trace of its logs
+	ctx     context.Context
+	fields  map[string]json.RawMessage
+	decoded bool
+	// Category of the message, resolved by Route
+	category string
+}
+
+/*
+Get the string values of a top level payload field. Numbers are formatted as in the payload, and arrays give one value per element.
+*/
+func (m *RoutedMessage) FieldValues(name string) []string {
+	if !m.decoded {
+		m.decoded = true
+		if err := json.Unmarshal(m.Message.Data, &m.fields); err != nil {
+			logger.WarnContext(m.context(), "Payload is not a JSON object, field conditions won't match", "messageId", m.Message.MessageId, "error", err)
+		}
+	}
+	raw, ok := m.fields[name]
+	if !ok {
+		return nil
+	}
+	var array []json.RawMessage
+	if err := json.Unmarshal(raw, &array); err == nil {
+		var values []string
+		for _, element := range array {
+			values = append(values, rawFieldValue(element)...)
+		}
+		return values
+	}
+	return rawFieldValue(raw)
+}
+
+func (m *RoutedMessage) context() context.Context {
+	if m.ctx == nil {
+		return context.Background()
+	}
+	return m.ctx
+}
+
+func rawFieldValue(raw json.RawMessage) []string {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return []string{s}
+	}
+	if value := strings.TrimSpace(string(raw)); value != "null" {
+		return []string{value}
+	}
+	return nil
+}
+
+/*
+Check whether all the conditions of the rule match the message
+*/
+func (rule RoutingRule) Matches(m *RoutedMessage) bool {
+	if rule.Source != nil {
+		source, ok := m.Message.Attributes["source"]
+		if !ok || !rule.Source.Match(source) {
+			return false
+		}
+	}
+	for name, pattern := range rule.Attributes {
+		value, ok := m.Message.Attributes[name]
+		if !ok || !pattern.Match(value) {
+			return false
+		}
+	}
+	for name, pattern := range rule.Fields {
+		matched := false
+		for _, value := range m.FieldValues(name) {
+			if pattern.Match(value) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+Build the routing rules: the configured rules first, then one exact match rule per table with a source
+*/
+func (bqContext *BqContext) InitRouting() error {
+	switch bqContext.Routing.Mode {
+	case "":
+		bqContext.Routing.Mode = RoutingFirstMatch
+	case RoutingFirstMatch, RoutingFanOut:
+	default:
+		return fmt.Errorf("invalid routing mode: %s", bqContext.Routing.Mode)
+	}
+	for _, table := range bqContext.Tables {
+		if table.Source == "" {
+			continue
+		}
+		source := Pattern{raw: table.Source}
+		if strings.ContainsAny(table.Source, `*?[\`) {
+			source = Pattern{regexp: regexp.MustCompile("^" + regexp.QuoteMeta(table.Source) + "$")}
+		}
+		bqContext.Routing.Rules = append(bqContext.Routing.Rules, RoutingRule{Name: "source:" + table.Source, Source: &source, Tables: []string{table.Key()}})
+	}
+	for _, rule := range bqContext.Routing.Rules {
+		for _, key := range rule.Tables {
+			if _, err := bqContext.GetTable(key); err != nil {
+				return fmt.Errorf("routing rule %s: %v", rule.Name, err)
+			}
+		}
+	}
+	for _, key := range bqContext.Routing.Default {
+		if _, err := bqContext.GetTable(key); err != nil {
+			return fmt.Errorf("default route: %v", err)
+		}
+	}
+	return nil
+}
+
+/*
+Get the target tables of the message, according to the routing rules, and the unified table and the staging tables of the
+lifecycle, of the suppressions and of the aggregates when they accept the category of the message
+*/
+func (bqContext *BqContext) Route(m *RoutedMessage) ([]Table, error) {
+	var keys []string
+	for _, rule := range bqContext.Routing.Rules {
+		if !rule.Matches(m) {
+			continue
+		}
+		for _, key := range rule.Tables {
+			if !slices.Contains(keys, key) {
+				keys = append(keys, key)
+			}
+		}
+		if bqContext.Routing.Mode == RoutingFirstMatch {
+			break
+		}
+	}
+	if len(keys) == 0 {
+		keys = bqContext.Routing.Default
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no route found for message with attributes %v", m.Message.Attributes)
+	}
+	tables := make([]Table, 0, len(keys)+4)
+	for _, key := range keys {
+		table, err := bqContext.GetTable(key)
+		if err != nil {
+			return nil, err
+		}
+		tables = append(tables, table)
+	}
+	m.category = bqContext.routedCategory(m, tables)
+	// The unified and staging tables receive the messages of all the categories, whatever their route
+	for _, table := range []*Table{bqContext.UnifiedTable, bqContext.Lifecycle.Staging, bqContext.Suppression.Staging, bqContext.Worker.Aggregates.Staging} {
+		if table != nil && table.Accepts(m.category) && !slices.Contains(keys, table.Key()) {
+			tables = append(tables, *table)
+		}
+	}
+	return tables, nil
+}
+
+/*
+Category of the message: its category attribute, or with routeBySource the category of the first table it is routed to,
+as the category of a table is authoritative
+*/
+func (bqContext *BqContext) routedCategory(m *RoutedMessage, tables []Table) string {
+	if category, ok := m.Message.Attributes["category"]; ok || !bqContext.RouteBySource {
+		return category
+	}
+	for _, table := range tables {
+		if table.Projection == "" && table.EventCategory != "" {
+			return table.EventCategory
+		}
+	}
+	return ""
+}
@@ -0,0 +1,52 @@
+package function
+
+import (
+	"context"
+	"testing"
+)
+
+const routingTestConfig = `{
+	"routeBySource": true,
+	"tables": [{"source": "shop", "datasetId": "brevo", "tableId": "emails", "eventCategory": "transactional-email"}],
+	"unified": {"datasetId": "brevo", "tableId": "events"}
+}`
+
+func TestRouteBySourceToTheUnifiedTable(t *testing.T) {
+	sink := startTestConsumer(t, routingTestConfig)
+	if err := publish(context.Background(), t, "m1", map[string]string{"source": "shop"}, testTransactionalEmail); err != nil {
+		t.Fatalf("message without category: %v", err)
+	}
+	if rows := sink.Rows("brevo.emails"); len(rows) != 1 {
+		t.Errorf("rows of the category table: got %d, want 1", len(rows))
+	}
+	rows := sink.Rows("brevo.events")
+	if len(rows) != 1 {
+		t.Fatalf("rows of the unified table: got %d, want 1", len(rows))
+	}
+	row := rows[0].Row.(UnifiedEventBigquery)
+	if row.Category.StringVal != "transactional-email" || row.Recipient.StringVal == "" {
+		t.Errorf("unified row: got %+v", row)
+	}
+	// The payload is only stored when the table opts in
+	if row.Payload.Valid {
+		t.Errorf("payload stored by default: %s", row.Payload.StringVal)
+	}
+}
+
+func TestUnifiedTableStoresThePayloadWhenEnabled(t *testing.T) {
+	sink := startTestConsumer(t, `{
+		"tables": [{"source": "shop", "datasetId": "brevo", "tableId": "emails", "eventCategory": "transactional-email"}],
+		"unified": {"datasetId": "brevo", "tableId": "events", "payload": true}
+	}`)
+	attributes := map[string]string{"source": "shop", "category": "transactional-email"}
+	if err := publish(context.Background(), t, "m1", attributes, testTransactionalEmail); err != nil {
+		t.Fatal(err)
+	}
+	rows := sink.Rows("brevo.events")
+	if len(rows) != 1 {
+		t.Fatalf("rows of the unified table: got %d, want 1", len(rows))
+	}
+	if row := rows[0].Row.(UnifiedEventBigquery); row.Payload.StringVal != testTransactionalEmail {
+		t.Errorf("payload: got %q, want the message", row.Payload.StringVal)
+	}
+}
@@ -0,0 +1,75 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+/*
+Sink receives the rows of the tables. The BigQuery sink inserts them with the uploaders of the tables, and the worker
+wraps it to spool the rows on disk while BigQuery is unavailable.
+*/
+type Sink interface {
+	Insert(ctx context.Context, table Table, row InsertRow) error
+}
+
+/*
+BigquerySink inserts the rows with the uploaders of the tables, retrying the transient errors
+*/
+type BigquerySink struct {
+	bqContext *BqContext
+}
+
+func NewBigquerySink(bqContext *BqContext) BigquerySink {
+	return BigquerySink{bqContext: bqContext}
+}
+
+func (sink BigquerySink) Insert(ctx context.Context, table Table, row InsertRow) error {
+	uploader, err := sink.bqContext.GetUploader(ctx, table)
+	if err != nil {
+		return err
+	}
+	err = sink.bqContext.Retry.Do(ctx, func(ctx context.Context) error {
+		row.InsertedAt = time.Now().UTC()
+		return Send(ctx, uploader, row, row.InsertId, sink.bqContext.InsertTimeout.Duration)
+	})
+	if isNotFound(err) {
+		return sink.bqContext.tableNotFound(ctx, table, err)
+	}
+	return err
+}
+
+/*
+RawRow is a row already converted to its JSON values, such as a row read back from the spool
+*/
+type RawRow map[string]json.RawMessage
+
+func (r RawRow) Save() (map[string]bigquery.Value, string, error) {
+	row := make(map[string]bigquery.Value, len(r))
+	for name, value := range r {
+		row[name] = value
+	}
+	return row, "", nil
+}
+
+/*
+Convert the row to its JSON values, as sent to BigQuery
+*/
+func (r InsertRow) Raw() (RawRow, error) {
+	values, _, err := r.Save()
+	if err != nil {
+		return nil, err
+	}
+	raw := make(RawRow, len(values))
+	for name, value := range values {
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		raw[name] = encoded
+	}
+	return raw, nil
+}
@@ -0,0 +1,343 @@
+package function
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ErrSpoolFull is returned when appending an entry would exceed the maximum size of the spool
+*/
+var ErrSpoolFull = errors.New("spool full")
+
+const spoolSegmentExtension = ".wal"
+
+/*
+SpoolConfig holds the settings of the local write-ahead log of the worker
+*/
+type SpoolConfig struct {
+	Directory    string `json:"directory"`
+	MaxBytes     int64  `json:"maxBytes"`
+	SegmentBytes int64  `json:"segmentBytes"`
+	NoSync       bool   `json:"noSync"`
+}
+
+/*
+SpoolEntry is a row waiting in the spool to be inserted in its table
+*/
+type SpoolEntry struct {
+	Table     string    `json:"table"`
+	InsertId  string    `json:"insertId"`
+	MessageId string    `json:"messageId"`
+	Row       RawRow    `json:"row"`
+	SpooledAt time.Time `json:"spooledAt"`
+}
+
+/*
+Spool is an append-only write-ahead log of rows, made of NDJSON segment files read in order.
+The position of the next entry to replay is persisted in a cursor file, and fully replayed segments are deleted.
+A new segment is started at every opening, so that a segment truncated by a crash is never appended to.
+*/
+type Spool struct {
+	mu         sync.Mutex
+	config     SpoolConfig
+	segments   []int64
+	active     *os.File
+	activeSize int64
+	cursor     spoolCursor
+	reader     *bufio.Reader
+	readerFile *os.File
+	entries    int64
+	bytes      int64
+}
+
+type spoolCursor struct {
+	Segment int64 `json:"segment"`
+	Offset  int64 `json:"offset"`
+}
+
+/*
+SpoolStats is the size of the spool
+*/
+type SpoolStats struct {
+	Entries int64 `json:"entries"`
+	Bytes   int64 `json:"bytes"`
+}
+
+/*
+Open the spool in its directory, counting the entries left by a previous run
+*/
+func OpenSpool(config SpoolConfig) (*Spool, error) {
+	if config.MaxBytes <= 0 {
+		config.MaxBytes = 1 << 30
+	}
+	if config.SegmentBytes <= 0 {
+		config.SegmentBytes = 64 << 20
+	}
+	if err := os.MkdirAll(config.Directory, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create spool directory: %v", err)
+	}
+	spool := &Spool{config: config}
+	files, err := os.ReadDir(config.Directory)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list spool directory: %v", err)
+	}
+	for _, file := range files {
+		name, ok := strings.CutSuffix(file.Name(), spoolSegmentExtension)
+		if !ok {
+			continue
+		}
+		id, err := strconv.ParseInt(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		spool.segments = append(spool.segments, id)
+	}
+	slices.Sort(spool.segments)
+	if data, err := os.ReadFile(spool.cursorPath()); err == nil {
+		if err := json.Unmarshal(data, &spool.cursor); err != nil {
+			return nil, fmt.Errorf("failed to read spool cursor: %v", err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read spool cursor: %v", err)
+	}
+	for _, id := range spool.segments {
+		if id < spool.cursor.Segment {
+			continue
+		}
+		offset := int64(0)
+		if id == spool.cursor.Segment {
+			offset = spool.cursor.Offset
+		}
+		entries, size, err := countSegment(spool.segmentPath(id), offset)
+		if err != nil {
+			return nil, err
+		}
+		spool.entries += entries
+		spool.bytes += size
+	}
+	next := int64(1)
+	if len(spool.segments) > 0 {
+		next = spool.segments[len(spool.segments)-1] + 1
+	}
+	if err := spool.startSegment(next); err != nil {
+		return nil, err
+	}
+	if spool.cursor.Segment == 0 || !slices.Contains(spool.segments, spool.cursor.Segment) {
+		spool.cursor = spoolCursor{Segment: spool.segments[0]}
+	}
+	logger.Info("Spool opened", "directory", config.Directory, "entries", spool.entries, "bytes", spool.bytes)
+	return spool, nil
+}
+
+/*
+Count the complete entries of a segment after the offset
+*/
+func countSegment(path string, offset int64) (int64, int64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read spool segment: %v", err)
+	}
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	data = data[offset:]
+	complete := bytes.LastIndexByte(data, '\n') + 1
+	return int64(bytes.Count(data[:complete], []byte{'\n'})), int64(complete), nil
+}
+
+func (spool *Spool) segmentPath(id int64) string {
+	return filepath.Join(spool.config.Directory, fmt.Sprintf("%020d%s", id, spoolSegmentExtension))
+}
+
+func (spool *Spool) cursorPath() string {
+	return filepath.Join(spool.config.Directory, "cursor.json")
+}
+
+func (spool *Spool) startSegment(id int64) error {
+	if spool.active != nil {
+		if err := spool.active.Close(); err != nil {
+			return fmt.Errorf("failed to close spool segment: %v", err)
+		}
+	}
+	file, err := os.OpenFile(spool.segmentPath(id), os.O_CREATE|os.O_WRONLY|os.O_APPEND|os.O_EXCL, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to create spool segment: %v", err)
+	}
+	spool.active = file
+	spool.activeSize = 0
+	spool.segments = append(spool.segments, id)
+	return nil
+}
+
+/*
+Append an entry to the spool, synced to disk unless noSync is set
+*/
+func (spool *Spool) Append(entry SpoolEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode spool entry: %v", err)
+	}
+	line = append(line, '\n')
+	spool.mu.Lock()
+	defer spool.mu.Unlock()
+	if spool.bytes+int64(len(line)) > spool.config.MaxBytes {
+		return fmt.Errorf("%w: %d entries, %d bytes", ErrSpoolFull, spool.entries, spool.bytes)
+	}
+	if spool.activeSize > 0 && spool.activeSize+int64(len(line)) > spool.config.SegmentBytes {
+		if err := spool.startSegment(spool.segments[len(spool.segments)-1] + 1); err != nil {
+			return err
+		}
+	}
+	if _, err := spool.active.Write(line); err != nil {
+		return fmt.Errorf("failed to write spool entry: %v", err)
+	}
+	if !spool.config.NoSync {
+		if err := spool.active.Sync(); err != nil {
+			return fmt.Errorf("failed to sync spool segment: %v", err)
+		}
+	}
+	spool.activeSize += int64(len(line))
+	spool.entries++
+	spool.bytes += int64(len(line))
+	return nil
+}
+
+/*
+Replay the entries of the spool in order, until the spool is empty or fn fails. An entry is removed from the spool once
+fn succeeds, and is replayed again on the next call if fn fails. The number of replayed entries is returned.
+Replay must not be called concurrently.
+*/
+func (spool *Spool) Replay(fn func(SpoolEntry) error) (int, error) {
+	replayed := 0
+	for {
+		line, err := spool.next()
+		if err != nil || line == nil {
+			return replayed, err
+		}
+		var entry SpoolEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			logger.Error("Skipping corrupted spool entry", "error", err, "bytes", len(line))
+		} else if err := fn(entry); err != nil {
+			spool.mu.Lock()
+			spool.closeReader()
+			spool.mu.Unlock()
+			return replayed, err
+		}
+		if err := spool.advance(int64(len(line))); err != nil {
+			return replayed, err
+		}
+		replayed++
+	}
+}
+
+/*
+Read the entry at the cursor, moving to the next segment when the current one is fully replayed. Nil is returned when
+the spool is empty.
+*/
+func (spool *Spool) next() ([]byte, error) {
+	spool.mu.Lock()
+	defer spool.mu.Unlock()
+	for {
+		if spool.reader == nil {
+			file, err := os.Open(spool.segmentPath(spool.cursor.Segment))
+			if err != nil {
+				return nil, fmt.Errorf("failed to open spool segment: %v", err)
+			}
+			if _, err := file.Seek(spool.cursor.Offset, io.SeekStart); err != nil {
+				file.Close()
+				return nil, fmt.Errorf("failed to seek spool segment: %v", err)
+			}
+			spool.readerFile = file
+			spool.reader = bufio.NewReader(file)
+		}
+		line, err := spool.reader.ReadBytes('\n')
+		if err == nil {
+			return line, nil
+		}
+		if !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("failed to read spool segment: %v", err)
+		}
+		if spool.cursor.Segment == spool.segments[len(spool.segments)-1] {
+			// End of the active segment: nothing more to replay for now
+			spool.closeReader()
+			return nil, nil
+		}
+		if len(line) > 0 {
+			logger.Error("Skipping truncated spool entry", "segment", spool.cursor.Segment, "bytes", len(line))
+		}
+		// The segment is fully replayed
+		spool.closeReader()
+		if err := os.Remove(spool.segmentPath(spool.cursor.Segment)); err != nil {
+			return nil, fmt.Errorf("failed to remove spool segment: %v", err)
+		}
+		spool.segments = spool.segments[1:]
+		spool.cursor = spoolCursor{Segment: spool.segments[0]}
+		if err := spool.saveCursor(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (spool *Spool) advance(size int64) error {
+	spool.mu.Lock()
+	defer spool.mu.Unlock()
+	spool.cursor.Offset += size
+	spool.entries--
+	spool.bytes -= size
+	return spool.saveCursor()
+}
+
+func (spool *Spool) closeReader() {
+	if spool.readerFile != nil {
+		spool.readerFile.Close()
+	}
+	spool.reader = nil
+	spool.readerFile = nil
+}
+
+func (spool *Spool) saveCursor() error {
+	data, err := json.Marshal(spool.cursor)
+	if err != nil {
+		return err
+	}
+	tmp := spool.cursorPath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("failed to write spool cursor: %v", err)
+	}
+	if err := os.Rename(tmp, spool.cursorPath()); err != nil {
+		return fmt.Errorf("failed to write spool cursor: %v", err)
+	}
+	return nil
+}
+
+func (spool *Spool) Stats() SpoolStats {
+	spool.mu.Lock()
+	defer spool.mu.Unlock()
+	return SpoolStats{Entries: spool.entries, Bytes: spool.bytes}
+}
+
+func (spool *Spool) Empty() bool {
+	return spool.Stats().Entries == 0
+}
+
+/*
+Close the spool files
+*/
+func (spool *Spool) Close() error {
+	spool.mu.Lock()
+	defer spool.mu.Unlock()
+	spool.closeReader()
+	return spool.active.Close()
+}
@@ -0,0 +1,427 @@
+package function
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+
+	"cloud.google.com/go/bigquery"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	SuppressionHardBounce   = "hard_bounce"
+	SuppressionComplaint    = "complaint"
+	SuppressionUnsubscribed = "unsubscribed"
+	SuppressionStop         = "stop"
+)
+
+/*
+Reason of the suppression of the recipient of the event types of Brevo, by normalized event type. The SMS replies are
+suppressions when they are a stop keyword, whatever their event type.
+*/
+var suppressionEventReasons = map[string]string{
+	"hardbounce":     SuppressionHardBounce,
+	"invalidemail":   SuppressionHardBounce,
+	"spam":           SuppressionComplaint,
+	"complaint":      SuppressionComplaint,
+	"unsubscribe":    SuppressionUnsubscribed,
+	"unsubscribed":   SuppressionUnsubscribed,
+	"unsubscription": SuppressionUnsubscribed,
+}
+
+var defaultStopKeywords = []string{"STOP", "STOPALL", "UNSUBSCRIBE", "CANCEL", "END", "QUIT", "ARRET"}
+
+const (
+	SuppressionProjection      = "suppression"
+	SuppressionCategory        = "suppression"
+	defaultSuppressionInterval = 5 * time.Minute
+	defaultSuppressionLookback = 10 * time.Minute
+)
+
+/*
+SuppressionConfig holds the staging table receiving the suppression events, and the suppression table merged from it.
+The SMS replies whose first word is one of the stop keywords are suppressions. The token of the lookup endpoint is a
+reference like the keys of the field transforms: env:NAME or secret:projects/.../versions/...
+*/
+type SuppressionConfig struct {
+	Staging      *Table   `json:"staging"`
+	Table        *Table   `json:"table"`
+	Interval     Duration `json:"interval"`
+	Lookback     Duration `json:"lookback"`
+	StopKeywords []string `json:"stopKeywords"`
+	Token        string   `json:"token"`
+	token        []byte
+}
+
+// Header of the token of the lookup endpoint, as the Authorization header holds the identity token of the caller
+const suppressionTokenHeader = "X-Suppressions-Token"
+
+/*
+SuppressionEventBigquery is a struct that represents a suppression event in the staging table of the suppressions, in
+the bigquery format.
+*/
+type SuppressionEventBigquery struct {
+	Recipient  bigquery.NullString    `json:"recipient"`
+	Channel    bigquery.NullString    `json:"channel"`
+	Reason     bigquery.NullString    `json:"reason"`
+	Category   bigquery.NullString    `json:"category"`
+	EventType  bigquery.NullString    `json:"event_type"`
+	EventTime  bigquery.NullTimestamp `json:"event_time"`
+	Source     bigquery.NullString    `json:"source"`
+	ReceivedAt time.Time              `json:"received_at"`
+}
+
+var SuppressionEventBigqueryDescription = map[string]string{
+	"Recipient":  "Email address, lowercased, or mobile number of the recipient",
+	"Channel":    "Channel of the message (email or sms)",
+	"Reason":     "Reason of the suppression (hard_bounce, complaint, unsubscribed or stop)",
+	"Category":   "Event category",
+	"EventType":  "Type of the event",
+	"EventTime":  "Time at which the event occurred",
+	"Source":     "Source attribute of the Pub/Sub message",
+	"ReceivedAt": "Time at which the event was received",
+}
+
+/*
+SuppressionBigquery is a struct that represents a suppressed recipient, for a reason, in the bigquery format. Its rows
+are written by the merges of the staging table only, so that its columns are never null.
+*/
+type SuppressionBigquery struct {
+	Recipient string    `json:"recipient"`
+	Channel   string    `json:"channel"`
+	Reason    string    `json:"reason"`
+	Category  string    `json:"category"`
+	Source    string    `json:"source"`
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+var SuppressionBigqueryDescription = map[string]string{
+	"Recipient": "Email address, lowercased, or mobile number of the recipient",
+	"Channel":   "Channel of the message (email or sms)",
+	"Reason":    "Reason of the suppression (hard_bounce, complaint, unsubscribed or stop)",
+	"Category":  "Event category of the last event of the suppression",
+	"Source":    "Source attribute of the last event of the suppression",
+	"FirstSeen": "Time of the first event of the suppression",
+	"LastSeen":  "Time of the last event of the suppression",
+	"UpdatedAt": "Time of the last merge of the suppression",
+}
+
+func projectSuppression(category, source string, event Event, payload []byte) any {
+	unified := projectUnified(category, source, event, payload).(UnifiedEventBigquery)
+	reason, ok := suppressionEventReasons[normalizeFieldName(unified.EventType.StringVal)]
+	if !ok || !unified.EventType.Valid {
+		var reply *string
+		switch e := event.(type) {
+		case MarketingSMSEvent:
+			reply = e.Reply
+		case TransactionalSMSEvent:
+			reply = e.Reply
+		}
+		if reply == nil || !bqContext.Suppression.isStopKeyword(*reply) {
+			return nil
+		}
+		reason = SuppressionStop
+	}
+	if !unified.Recipient.Valid || unified.Recipient.StringVal == "" {
+		return nil
+	}
+	recipient := unified.Recipient
+	if unified.Channel.StringVal == ChannelEmail {
+		recipient.StringVal = strings.ToLower(strings.TrimSpace(recipient.StringVal))
+	}
+	return SuppressionEventBigquery{
+		Recipient:  recipient,
+		Channel:    unified.Channel,
+		Reason:     nullString(reason),
+		Category:   unified.Category,
+		EventType:  unified.EventType,
+		EventTime:  unified.EventTime,
+		Source:     unified.Source,
+		ReceivedAt: time.Now().UTC(),
+	}
+}
+
+/*
+Check whether the first word of an SMS reply is a stop keyword, regardless of case, accents and punctuation: "Arrêt"
+matches ARRET
+*/
+func (config SuppressionConfig) isStopKeyword(reply string) bool {
+	words := strings.FieldsFunc(removeAccents(reply), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	if len(words) == 0 {
+		return false
+	}
+	keywords := config.StopKeywords
+	if len(keywords) == 0 {
+		keywords = defaultStopKeywords
+	}
+	return slices.ContainsFunc(keywords, func(keyword string) bool { return strings.EqualFold(removeAccents(keyword), words[0]) })
+}
+
+/*
+Remove the accents of a text, by decomposing its characters and dropping their combining marks
+*/
+func removeAccents(text string) string {
+	removed, _, err := transform.String(transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC), text)
+	if err != nil {
+		return text
+	}
+	return removed
+}
+
+/*
+Validate the suppression configuration: the staging and the suppression tables are set together, and the staging rows
+are written as they are received, as the merges select them by the time they were written
+*/
+func (config SuppressionConfig) Validate() error {
+	if (config.Staging == nil) != (config.Table == nil) {
+		return fmt.Errorf("suppression requires both a staging and a suppression table")
+	}
+	if config.Staging != nil && config.Staging.WriteMode == WriteModeLoad {
+		return fmt.Errorf("write mode %s of suppression staging table %s is not supported", WriteModeLoad, config.Staging.Key())
+	}
+	return validateTokenRef("suppression", config.Token)
+}
+
+/*
+Merge the staging rows written since the last merge into the suppression table, and return the number of suppressions
+merged. A recipient has one row per reason, with the first and last time of its events, so merging the same rows again,
+or merging the events out of order, gives the same suppressions. Like the lifecycle, the rows are selected by the time
+the sink wrote them, so that a late STOP or unsubscription, such as a row replayed from the spool, is never missed.
+*/
+func (bqContext *BqContext) MergeSuppressions(ctx context.Context) (int64, error) {
+	config := bqContext.Suppression
+	if config.Table == nil {
+		return 0, fmt.Errorf("no suppression table configured")
+	}
+	lookback := config.Lookback.Duration
+	if lookback <= 0 {
+		lookback = defaultSuppressionLookback
+	}
+	client, err := bqContext.GetClient(*config.Table)
+	if err != nil {
+		return 0, err
+	}
+	query := client.Query(suppressionMergeStatement(bqContext.tableReference(*config.Staging), bqContext.tableReference(*config.Table)))
+	query.Parameters = []bigquery.QueryParameter{{Name: "lookback", Value: int64(lookback.Seconds())}}
+	query.Location = config.Table.Location
+	job, err := query.Run(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to run merge of suppression table %s: %v", config.Table.Key(), err)
+	}
+	status, err := job.Wait(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to wait for merge of suppression table %s: %v", config.Table.Key(), err)
+	}
+	if err := status.Err(); err != nil {
+		return 0, fmt.Errorf("merge of suppression table %s failed: %v", config.Table.Key(), err)
+	}
+	var merged int64
+	if statistics, ok := status.Statistics.Details.(*bigquery.QueryStatistics); ok {
+		merged = statistics.NumDMLAffectedRows
+	}
+	logger.InfoContext(ctx, "Suppressions merged", "table", config.Table.Key(), "suppressions", merged)
+	return merged, nil
+}
+
+/*
+MERGE statement of the staging table into the suppression table. The staging rows are grouped by recipient and reason,
+and the category and source of the latest event are kept.
+*/
+func suppressionMergeStatement(staging, suppressions string) string {
+	return fmt.Sprintf(`MERGE %s AS T
+USING (
+  SELECT
+    Recipient, Reason,
+    ANY_VALUE(Channel) AS Channel,
+    MAX_BY(IFNULL(Category, ''), COALESCE(EventTime, ReceivedAt)) AS Category,
+    MAX_BY(IFNULL(Source, ''), COALESCE(EventTime, ReceivedAt)) AS Source,
+    MIN(COALESCE(EventTime, ReceivedAt)) AS FirstSeen,
+    MAX(COALESCE(EventTime, ReceivedAt)) AS LastSeen
+  FROM %s
+  WHERE Recipient IS NOT NULL AND Reason IS NOT NULL
+    AND COALESCE(_metadata.InsertedAt, ReceivedAt) >= TIMESTAMP_SUB(COALESCE((SELECT MAX(UpdatedAt) FROM %s), TIMESTAMP_SECONDS(0)), INTERVAL @lookback SECOND)
+  GROUP BY Recipient, Reason
+) AS S
+ON T.Recipient = S.Recipient AND T.Reason = S.Reason
+WHEN MATCHED THEN UPDATE SET
+  Category = IF(S.LastSeen >= T.LastSeen, S.Category, T.Category),
+  Source = IF(S.LastSeen >= T.LastSeen, S.Source, T.Source),
+  FirstSeen = LEAST(T.FirstSeen, S.FirstSeen),
+  LastSeen = GREATEST(T.LastSeen, S.LastSeen),
+  UpdatedAt = CURRENT_TIMESTAMP()
+WHEN NOT MATCHED THEN INSERT (Recipient, Channel, Reason, Category, Source, FirstSeen, LastSeen, UpdatedAt)
+  VALUES (S.Recipient, S.Channel, S.Reason, S.Category, S.Source, S.FirstSeen, S.LastSeen, CURRENT_TIMESTAMP())`,
+		suppressions, staging, suppressions)
+}
+
+/*
+Look up the suppressions of a recipient, by its email or phone number, matched like the erasures
+*/
+func (bqContext *BqContext) LookupSuppressions(ctx context.Context, identifier string) ([]SuppressionBigquery, error) {
+	identifier = strings.TrimSpace(identifier)
+	if identifier == "" {
+		return nil, fmt.Errorf("missing identifier")
+	}
+	table := bqContext.Suppression.Table
+	if table == nil {
+		return nil, fmt.Errorf("no suppression table configured")
+	}
+	match, err := bqContext.matchIdentifier(*table, identifierType(identifier), identifierValues(identifier))
+	if err != nil {
+		return nil, err
+	}
+	if match.Condition == "" {
+		return nil, fmt.Errorf("recipients of suppression table %s can't be matched", table.Key())
+	}
+	return bqContext.readSuppressions(ctx, "WHERE "+match.Condition, match.Params, nil)
+}
+
+/*
+Write all the suppressions in CSV, ordered by recipient and reason
+*/
+func (bqContext *BqContext) ExportSuppressions(ctx context.Context, w io.Writer) error {
+	if bqContext.Suppression.Table == nil {
+		return fmt.Errorf("no suppression table configured")
+	}
+	writer := csv.NewWriter(w)
+	if err := writer.Write([]string{"recipient", "channel", "reason", "category", "source", "first_seen", "last_seen"}); err != nil {
+		return err
+	}
+	_, err := bqContext.readSuppressions(ctx, "", nil, func(suppression SuppressionBigquery) error {
+		return writer.Write([]string{
+			suppression.Recipient,
+			suppression.Channel,
+			suppression.Reason,
+			suppression.Category,
+			suppression.Source,
+			suppression.FirstSeen.Format(time.RFC3339),
+			suppression.LastSeen.Format(time.RFC3339),
+		})
+	})
+	if err != nil {
+		return err
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+/*
+Read the suppressions matching the condition, ordered by recipient and reason. The suppressions are passed to the
+callback as they are read; they are also returned when the callback is nil.
+*/
+func (bqContext *BqContext) readSuppressions(ctx context.Context, condition string, params []bigquery.QueryParameter, callback func(SuppressionBigquery) error) ([]SuppressionBigquery, error) {
+	table := *bqContext.Suppression.Table
+	client, err := bqContext.GetClient(table)
+	if err != nil {
+		return nil, err
+	}
+	query := client.Query(fmt.Sprintf("SELECT * FROM %s %s ORDER BY Recipient, Reason", bqContext.tableReference(table), condition))
+	query.Parameters = params
+	query.Location = table.Location
+	it, err := query.Read(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query suppression table %s: %v", table.Key(), err)
+	}
+	var suppressions []SuppressionBigquery
+	for {
+		var suppression SuppressionBigquery
+		err := it.Next(&suppression)
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read suppression table %s: %v", table.Key(), err)
+		}
+		if callback == nil {
+			suppressions = append(suppressions, suppression)
+		} else if err := callback(suppression); err != nil {
+			return nil, err
+		}
+	}
+	return suppressions, nil
+}
+
+/*
+Merge the suppressions periodically, until the context is done
+*/
+func (bqContext *BqContext) RunSuppressions(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultSuppressionInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := bqContext.MergeSuppressions(ctx); err != nil {
+			logger.ErrorContext(ctx, "Suppression merge failed", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+/*
+SuppressionLookup is the response of the suppression endpoint to the lookup of a recipient
+*/
+type SuppressionLookup struct {
+	Suppressed   bool                  `json:"suppressed"`
+	Suppressions []SuppressionBigquery `json:"suppressions"`
+}
+
+// runSuppressions looks up the suppressions of the recipient of the recipient parameter. The callers must send the
+// token of the configuration: the endpoint is disabled without it. The export of all the suppressions is only available
+// with brevoctl.
+func runSuppressions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := Start(r.Context()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if bqContext.Suppression.Table == nil {
+		http.Error(w, "suppression endpoint not configured", http.StatusNotFound)
+		return
+	}
+	if !authorizeRequest(w, r, suppressionTokenHeader, bqContext.Suppression.token) {
+		return
+	}
+	recipient := r.URL.Query().Get("recipient")
+	if recipient == "" {
+		http.Error(w, "missing recipient", http.StatusBadRequest)
+		return
+	}
+	suppressions, err := bqContext.LookupSuppressions(r.Context(), recipient)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "Error looking up suppressions", "error", err)
+		http.Error(w, "lookup failed", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	lookup := SuppressionLookup{Suppressed: len(suppressions) > 0, Suppressions: suppressions}
+	if lookup.Suppressions == nil {
+		lookup.Suppressions = []SuppressionBigquery{}
+	}
+	if err := json.NewEncoder(w).Encode(lookup); err != nil {
+		logger.Error("Error encoding suppressions", "error", err)
+	}
+}
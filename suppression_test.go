@@ -0,0 +1,98 @@
+package function
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSuppressionStagingIsMergedByInsertTime(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	config := `{"suppression": {"staging": {"datasetId": "brevo", "tableId": "suppression_events"}, "table": {"datasetId": "brevo", "tableId": "suppressions"}}}`
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	var context BqContext
+	if err := context.LoadTablesFromConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	if !context.Suppression.Staging.RowMetadata {
+		t.Error("staging table without _metadata column")
+	}
+	statement := suppressionMergeStatement("`p.brevo.suppression_events`", "`p.brevo.suppressions`")
+	if !strings.Contains(statement, "COALESCE(_metadata.InsertedAt, ReceivedAt) >= ") {
+		t.Errorf("merge statement does not select the rows by insert time:\n%s", statement)
+	}
+	load := SuppressionConfig{
+		Staging: &Table{DatasetId: "brevo", TableId: "suppression_events", WriteMode: WriteModeLoad},
+		Table:   &Table{DatasetId: "brevo", TableId: "suppressions"},
+	}
+	if err := load.Validate(); err == nil {
+		t.Error("staging table written by load jobs: no error")
+	}
+}
+
+func TestSuppressionEndpointRequiresTheToken(t *testing.T) {
+	const suppressionTablesConfig = `"staging": {"datasetId": "brevo", "tableId": "suppression_events"}, "table": {"datasetId": "brevo", "tableId": "suppressions"}`
+	t.Setenv("SUPPRESSIONS_TOKEN", "s3cret")
+	tests := []struct {
+		name   string
+		config string
+		token  string
+		query  string
+		status int
+	}{
+		{"no token configured", `{"suppression": {` + suppressionTablesConfig + `}}`, "s3cret", "recipient=john@example.com", http.StatusNotFound},
+		{"missing token", `{"suppression": {` + suppressionTablesConfig + `, "token": "env:SUPPRESSIONS_TOKEN"}}`, "", "recipient=john@example.com", http.StatusUnauthorized},
+		{"invalid token", `{"suppression": {` + suppressionTablesConfig + `, "token": "env:SUPPRESSIONS_TOKEN"}}`, "s3cre", "recipient=john@example.com", http.StatusUnauthorized},
+		// The export of all the suppressions is only available with brevoctl
+		{"export", `{"suppression": {` + suppressionTablesConfig + `, "token": "env:SUPPRESSIONS_TOKEN"}}`, "s3cret", "format=csv", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			startTestConsumer(t, test.config)
+			request := httptest.NewRequest(http.MethodGet, "/Suppressions?"+test.query, nil)
+			if test.token != "" {
+				request.Header.Set(suppressionTokenHeader, test.token)
+			}
+			response := httptest.NewRecorder()
+			runSuppressions(response, request)
+			if response.Code != test.status {
+				t.Errorf("status: got %d, want %d: %s", response.Code, test.status, response.Body)
+			}
+		})
+	}
+}
+
+func TestStopKeywords(t *testing.T) {
+	tests := []struct {
+		reply    string
+		keywords []string
+		want     bool
+	}{
+		{"STOP", nil, true},
+		{"stop please", nil, true},
+		{"  Stop!", nil, true},
+		{"ARRET", nil, true},
+		{"ARRÊT", nil, true},
+		{"Arrêt svp", nil, true},
+		// Decomposed accent: E followed by a combining circumflex
+		{"ARRE\u0302T", nil, true},
+		{"arrêter", nil, false},
+		{"Don't stop", nil, false},
+		{"", nil, false},
+		{"ABMELDEN", []string{"Abmelden"}, true},
+		{"désinscrire", []string{"DESINSCRIRE"}, true},
+		{"DESINSCRIRE", []string{"désinscrire"}, true},
+		{"STOP", []string{"ARRÊT"}, false},
+	}
+	for _, test := range tests {
+		config := SuppressionConfig{StopKeywords: test.keywords}
+		if got := config.isStopKeyword(test.reply); got != test.want {
+			t.Errorf("isStopKeyword(%q) with %v: got %v, want %v", test.reply, test.keywords, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package function
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/cloudevents/sdk-go/v2/event"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+/*
+TracingConfig holds the settings of the trace exporter of the worker. The OTLP exporter is also configured by the
+standard OTEL_EXPORTER_OTLP_* environment variables.
+*/
+type TracingConfig struct {
+	Exporter    string  `json:"exporter"`
+	Endpoint    string  `json:"endpoint"`
+	Insecure    bool    `json:"insecure"`
+	SampleRatio float64 `json:"sampleRatio"`
+}
+
+// The tracer of the consumer, swapped by SetTracerProvider while messages are being traced
+var currentTracer atomic.Pointer[trace.Tracer]
+
+// W3C trace context, as set by the webhook receiver in the attributes of the messages
+var propagator = propagation.TraceContext{}
+
+/*
+SetTracerProvider records the spans of the consumer with the provider, such as a provider with an in-memory exporter in tests
+*/
+func SetTracerProvider(provider trace.TracerProvider) {
+	tracer := provider.Tracer(instrumentationName)
+	currentTracer.Store(&tracer)
+}
+
+/*
+Get the tracer of the consumer, from the global tracer provider until SetTracerProvider is called
+*/
+func tracer() trace.Tracer {
+	if tracer := currentTracer.Load(); tracer != nil {
+		return *tracer
+	}
+	return otel.GetTracerProvider().Tracer(instrumentationName)
+}
+
+/*
+Start the trace exporter of the worker. The returned function flushes and stops the exporter.
+*/
+func StartTraceExporter(ctx context.Context, config TracingConfig) (func(context.Context) error, error) {
+	switch config.Exporter {
+	case "":
+		return func(context.Context) error { return nil }, nil
+	case MetricsExporterOTLP:
+	default:
+		return nil, fmt.Errorf("invalid trace exporter: %s", config.Exporter)
+	}
+	var opts []otlptracegrpc.Option
+	if config.Endpoint != "" {
+		opts = append(opts, otlptracegrpc.WithEndpoint(config.Endpoint))
+	}
+	if config.Insecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	}
+	exporter, err := otlptracegrpc.New(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create otlp trace exporter: %v", err)
+	}
+	ratio := config.SampleRatio
+	if ratio <= 0 {
+		ratio = 1
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))))
+	SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+/*
+attributeCarrier reads the trace context from the attributes of a Pub/Sub message, set either directly (traceparent) or
+by the OpenTelemetry instrumentation of the Pub/Sub client libraries (googclient_traceparent)
+*/
+type attributeCarrier map[string]string
+
+func (c attributeCarrier) Get(key string) string {
+	if value, ok := c[key]; ok {
+		return value
+	}
+	return c["googclient_"+key]
+}
+
+func (c attributeCarrier) Set(key, value string) {
+	c[key] = value
+}
+
+func (c attributeCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+/*
+Extract the trace context of the message from its attributes, or else from the distributed tracing extension of the CloudEvent
+*/
+func extractTraceContext(ctx context.Context, e event.Event, attributes map[string]string) context.Context {
+	if extracted := propagator.Extract(ctx, attributeCarrier(attributes)); trace.SpanContextFromContext(extracted).IsValid() {
+		return extracted
+	}
+	extensions := propagation.MapCarrier{}
+	for name, value := range e.Extensions() {
+		if s, ok := value.(string); ok {
+			extensions[name] = s
+		}
+	}
+	return propagator.Extract(ctx, extensions)
+}
+
+/*
+Start a span of the consumer
+*/
+func startSpan(ctx context.Context, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer().Start(ctx, name, trace.WithAttributes(attributes...))
+}
+
+/*
+End a span, recording the error and its class
+*/
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		span.SetAttributes(attribute.String("error.class", string(ClassifyError(err))))
+	}
+	span.End()
+}
+
+/*
+RowMetadata is written in the _metadata column of the tables with rowMetadata, to find the trace of a row
+*/
+type RowMetadata struct {
+	TraceId     string
+	SpanId      string
+	MessageId   string
+	PublishTime time.Time
+	// Set by the sink when it writes the row, see InsertRow.InsertedAt
+	InsertedAt time.Time
+}
+
+const rowMetadataColumn = "_metadata"
+
+/*
+Get the metadata of the row of the message, from the span of the context
+*/
+func NewRowMetadata(ctx context.Context, msg PubSubMessage) *RowMetadata {
+	spanContext := trace.SpanContextFromContext(ctx)
+	metadata := &RowMetadata{MessageId: msg.MessageId, PublishTime: msg.PublishTime}
+	if spanContext.IsValid() {
+		metadata.TraceId = spanContext.TraceID().String()
+		metadata.SpanId = spanContext.SpanID().String()
+	}
+	return metadata
+}
+
+func (metadata *RowMetadata) value() map[string]bigquery.Value {
+	return map[string]bigquery.Value{
+		"TraceId":     bigquery.NullString{StringVal: metadata.TraceId, Valid: metadata.TraceId != ""},
+		"SpanId":      bigquery.NullString{StringVal: metadata.SpanId, Valid: metadata.SpanId != ""},
+		"MessageId":   bigquery.NullString{StringVal: metadata.MessageId, Valid: metadata.MessageId != ""},
+		"PublishTime": bigquery.NullTimestamp{Timestamp: metadata.PublishTime, Valid: !metadata.PublishTime.IsZero()},
+		"InsertedAt":  bigquery.NullTimestamp{Timestamp: metadata.InsertedAt, Valid: !metadata.InsertedAt.IsZero()},
+	}
+}
+
+func rowMetadataField() *bigquery.FieldSchema {
+	return &bigquery.FieldSchema{
+		Name:        rowMetadataColumn,
+		Type:        bigquery.RecordFieldType,
+		Description: "Trace and Pub/Sub message of the row",
+		Schema: bigquery.Schema{
+			{Name: "TraceId", Type: bigquery.StringFieldType, Description: "Id of the trace of the message"},
+			{Name: "SpanId", Type: bigquery.StringFieldType, Description: "Id of the span of the insert"},
+			{Name: "MessageId", Type: bigquery.StringFieldType, Description: "Id of the Pub/Sub message"},
+			{Name: "PublishTime", Type: bigquery.TimestampFieldType, Description: "Publication time of the Pub/Sub message"},
+			{Name: "InsertedAt", Type: bigquery.TimestampFieldType, Description: "Time at which the row was written to Bigquery"},
+		},
+	}
+}
+
+/*
+traceHandler adds the trace and span of the context to the log records, in the fields recognised by Cloud Logging
+*/
+type traceHandler struct {
+	slog.Handler
+	projectId string
+}
+
+func (h traceHandler) Handle(ctx context.Context, record slog.Record) error {
+	if spanContext := trace.SpanContextFromContext(ctx); spanContext.IsValid() {
+		traceId := spanContext.TraceID().String()
+		if h.projectId != "" {
+			traceId = fmt.Sprintf("projects/%s/traces/%s", h.projectId, traceId)
+		}
+		record.AddAttrs(
+			slog.String("logging.googleapis.com/trace", traceId),
+			slog.String("logging.googleapis.com/spanId", spanContext.SpanID().String()),
+			slog.Bool("logging.googleapis.com/trace_sampled", spanContext.IsSampled()),
+		)
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h traceHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return traceHandler{Handler: h.Handler.WithAttrs(attrs), projectId: h.projectId}
+}
+
+func (h traceHandler) WithGroup(name string) slog.Handler {
+	return traceHandler{Handler: h.Handler.WithGroup(name), projectId: h.projectId}
+}
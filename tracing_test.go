@@ -0,0 +1,201 @@
+package function
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+	"time"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	testTraceId     = "4bf92f3577b34da6a3ce929d0e0e4736"
+	testParentId    = "00f067aa0ba902b7"
+	testTraceparent = "00-" + testTraceId + "-" + testParentId + "-01"
+)
+
+/*
+Record the spans with an in-memory exporter for the duration of the test
+*/
+func useTestTracerProvider(t *testing.T) *tracetest.InMemoryExporter {
+	t.Helper()
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	SetTracerProvider(provider)
+	t.Cleanup(func() {
+		_ = provider.Shutdown(context.Background())
+		currentTracer.Store(nil)
+	})
+	return exporter
+}
+
+/*
+Record the logs in a buffer for the duration of the test, with the trace fields of the consumer
+*/
+func useTestLogger(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buffer bytes.Buffer
+	previous := logger
+	logger = slog.New(traceHandler{Handler: slog.NewJSONHandler(&buffer, &slog.HandlerOptions{Level: slog.LevelDebug})})
+	t.Cleanup(func() { logger = previous })
+	return &buffer
+}
+
+func TestSpansOfAMessage(t *testing.T) {
+	tests := []struct {
+		name       string
+		attributes map[string]string
+		extension  bool
+	}{
+		{"traceparent attribute", map[string]string{"traceparent": testTraceparent}, false},
+		{"Pub/Sub client attribute", map[string]string{"googclient_traceparent": testTraceparent}, false},
+		{"CloudEvent extension", nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			exporter := useTestTracerProvider(t)
+			startTestConsumer(t, metricsTestConfig)
+			attributes := map[string]string{"source": "shop", "category": "transactional-email"}
+			for name, value := range test.attributes {
+				attributes[name] = value
+			}
+			e := newPubSubEvent(t, "m1", attributes, testTransactionalEmail)
+			if test.extension {
+				e.SetExtension("traceparent", testTraceparent)
+			}
+			if err := runPubSubConsumer(context.Background(), e); err != nil {
+				t.Fatalf("runPubSubConsumer: %v", err)
+			}
+
+			spans := make(map[string]tracetest.SpanStub)
+			for _, span := range exporter.GetSpans() {
+				spans[span.Name] = span
+			}
+			root, ok := spans["RunPubSubConsumer"]
+			if !ok {
+				t.Fatalf("no RunPubSubConsumer span in %v", exporter.GetSpans())
+			}
+			if got := root.SpanContext.TraceID().String(); got != testTraceId {
+				t.Errorf("trace id: got %s, want %s", got, testTraceId)
+			}
+			if got := root.Parent.SpanID().String(); got != testParentId || !root.Parent.IsRemote() {
+				t.Errorf("parent of the message span: got %s (remote %t), want the remote %s", got, root.Parent.IsRemote(), testParentId)
+			}
+			if root.SpanKind != trace.SpanKindConsumer {
+				t.Errorf("kind of the message span: got %s, want %s", root.SpanKind, trace.SpanKindConsumer)
+			}
+			for _, name := range []string{"DataAs", "Route", "DecodeEvent", "Insert"} {
+				span, ok := spans[name]
+				if !ok {
+					t.Errorf("no %s span", name)
+					continue
+				}
+				if span.Parent.SpanID() != root.SpanContext.SpanID() {
+					t.Errorf("parent of the %s span: got %s, want the message span %s", name, span.Parent.SpanID(), root.SpanContext.SpanID())
+				}
+				if span.SpanContext.TraceID() != root.SpanContext.TraceID() {
+					t.Errorf("trace of the %s span: got %s, want %s", name, span.SpanContext.TraceID(), root.SpanContext.TraceID())
+				}
+			}
+			var table string
+			for _, attribute := range spans["Insert"].Attributes {
+				if attribute.Key == "table" {
+					table = attribute.Value.AsString()
+				}
+			}
+			if table != "brevo.emails" {
+				t.Errorf("table of the Insert span: got %q, want brevo.emails", table)
+			}
+		})
+	}
+}
+
+func TestTraceInTheLogsOfAMessage(t *testing.T) {
+	useTestTracerProvider(t)
+	startTestConsumer(t, metricsTestConfig)
+	// The failures of the sink open the breaker, whose logs belong to the message that opened it
+	sink, fake, _ := newSpoolingTestSink(t, SpoolConfig{})
+	fake.SetOutage(errUnavailable)
+	bqContext.Sink = sink
+	logs := useTestLogger(t)
+	attributes := map[string]string{"source": "shop", "category": "transactional-email", "traceparent": testTraceparent}
+	ctx := context.Background()
+	_ = publish(ctx, t, "m1", attributes, testTransactionalEmail)
+	_ = publish(ctx, t, "m2", attributes, testTransactionalEmail)
+	_ = publish(ctx, t, "m3", attributes, `{"email": 1}`)
+
+	lines := bytes.Split(bytes.TrimSpace(logs.Bytes()), []byte("\n"))
+	messages := make(map[string]bool)
+	for _, line := range lines {
+		var record map[string]any
+		if err := json.Unmarshal(line, &record); err != nil {
+			t.Fatalf("invalid log line %s: %v", line, err)
+		}
+		message, _ := record["msg"].(string)
+		messages[message] = true
+		trace, _ := record["logging.googleapis.com/trace"].(string)
+		if trace != testTraceId {
+			t.Errorf("log %q: got trace %q, want %s", message, trace, testTraceId)
+		}
+	}
+	for _, message := range []string{"Circuit breaker state changed", "Error sending message"} {
+		if !messages[message] {
+			t.Errorf("no %q log in %v", message, messages)
+		}
+	}
+}
+
+func TestInsertedAtInTheMetadata(t *testing.T) {
+	publishTime := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	insertedAt := publishTime.Add(3 * time.Hour)
+	row := InsertRow{
+		Row:      LifecycleEventBigquery{EventType: nullString("delivered")},
+		InsertId: "m1:brevo.lifecycle_events",
+		Metadata: &RowMetadata{MessageId: "m1", PublishTime: publishTime},
+	}
+	// The row is spooled before its first write, and replayed later
+	spooled, err := row.Raw()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		row  InsertRow
+	}{
+		{"row", row},
+		{"row replayed from the spool", InsertRow{Row: spooled, InsertId: row.InsertId}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.row.InsertedAt = insertedAt
+			raw, err := test.row.Raw()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var metadata struct {
+				MessageId   string
+				PublishTime time.Time
+				InsertedAt  time.Time
+			}
+			if err := json.Unmarshal(raw[rowMetadataColumn], &metadata); err != nil {
+				t.Fatalf("%s: %v", raw[rowMetadataColumn], err)
+			}
+			if metadata.MessageId != "m1" || !metadata.PublishTime.Equal(publishTime) || !metadata.InsertedAt.Equal(insertedAt) {
+				t.Errorf("metadata: got %+v, want inserted at %s", metadata, insertedAt)
+			}
+		})
+	}
+	// The rows without _metadata column are left unchanged
+	raw, err := InsertRow{Row: LifecycleEventBigquery{}, InsertedAt: insertedAt}.Raw()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := raw[rowMetadataColumn]; ok {
+		t.Errorf("_metadata column added: %s", raw[rowMetadataColumn])
+	}
+}
@@ -8,14 +8,14 @@ Documentation: https://developers.brevo.com/docs/transactional-webhooks#transact
 */
 type TransactionalEmailEvent struct {
 	Event         *string   `json:"event"`
-	Email         *string   `json:"email"`
+	Email         *string   `json:"email" pii:"hash"`
 	Id            *int64    `json:"id"`
 	Date          *string   `json:"date"`
 	TS            *int64    `json:"ts"`
 	MessageId     *string   `json:"message-id"`
 	TSEvent       *int64    `json:"ts_event"`
-	Subject       *string   `json:"subject"`
-	XMailinCustom *string   `json:"X-Mailin-custom"`
+	Subject       *string   `json:"subject" pii:"omit"`
+	XMailinCustom *string   `json:"X-Mailin-custom" pii:"mask"`
 	SendingIP     *string   `json:"sending_ip"`
 	TSEpoch       *int64    `json:"ts_epoch"`
 	TemplateId    *int64    `json:"template_id"`
@@ -24,11 +24,11 @@ type TransactionalEmailEvent struct {
 	Reason        *string   `json:"reason"`
 	Tags          *[]string `json:"tags"`
 	Link          *string   `json:"link"`
-	UserAgent     *string   `json:"user_agent"`
+	UserAgent     *string   `json:"user_agent" pii:"omit"`
 	DeviceUsed    *string   `json:"device_used"`
 	MirrorLink    *string   `json:"mirror_link"`
 	ContactId     *int64    `json:"contact_id"`
-	SenderEmail   *string   `json:"sender_email"`
+	SenderEmail   *string   `json:"sender_email" pii:"hash"`
 }
 
 /*
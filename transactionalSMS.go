@@ -8,7 +8,7 @@ Documentation: https://developers.brevo.com/docs/transactional-webhooks#transact
 */
 type TransactionalSMSEvent struct {
 	Id              *int64             `json:"id"`
-	To              *string            `json:"to"`
+	To              *string            `json:"to" pii:"hash"`
 	SMSCount        *int64             `json:"sms_count"`
 	CreditsUsed     *float64           `json:"credits_used"`
 	MessageId       *int64             `json:"message_id"`
@@ -22,7 +22,7 @@ type TransactionalSMSEvent struct {
 	TSEvent         *int64             `json:"ts_event"`
 	Tag             *[]string          `json:"tag"`
 	ErrorCode       *int64             `json:"error_code"`
-	Reply           *string            `json:"reply"`
+	Reply           *string            `json:"reply" pii:"omit"`
 	BounceType      *string            `json:"bounce_type"`
 }
 
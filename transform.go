@@ -0,0 +1,491 @@
+package function
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+
+	"cloud.google.com/go/bigquery"
+	secretmanager "google.golang.org/api/secretmanager/v1"
+)
+
+const (
+	TransformKeep = "keep"
+	TransformDrop = "drop"
+	TransformHash = "hash"
+	TransformHMAC = "hmac"
+	TransformMask = "mask"
+)
+
+// Characters left visible at the end of the values masked by default
+const defaultMaskVisible = 4
+
+/*
+FieldTransform is the transformation of a field of the rows of a table, applied before the insert. The salt of hash and
+the key of hmac are references: env:NAME reads an environment variable, and secret:projects/.../secrets/.../versions/...
+reads a version of a Secret Manager secret. The salt can also be the value itself, but not the key, which would be
+readable in the configuration.
+*/
+type FieldTransform struct {
+	Action string `json:"action"`
+	Salt   string `json:"salt"`
+	Key    string `json:"key"`
+	// Lowercase and trim the values before hashing them, so that the hashes of the same address match
+	Normalize bool `json:"normalize"`
+	// Characters left visible at the end of the masked values
+	Visible *int `json:"visible"`
+	// Tenant of the encrypted values, instead of the tenant attribute of the messages
+	Tenant string `json:"tenant"`
+}
+
+/*
+Transformer applies the field transforms of a table to its rows
+*/
+type Transformer struct {
+	fields []fieldTransformer
+}
+
+type fieldTransformer struct {
+	name      string
+	path      []string
+	transform FieldTransform
+	secret    []byte
+	keyset    *Keyset
+}
+
+/*
+VaultEntry is the original and the transformed value of a field of a row
+*/
+type VaultEntry struct {
+	Field       string
+	Action      string
+	Original    string
+	Transformed string
+}
+
+/*
+VaultCategory is the internal event category of the vault tables
+*/
+const VaultCategory = "vault"
+
+/*
+VaultRecordBigquery is a struct that represents the original and transformed values of a field, in the bigquery format.
+*/
+type VaultRecordBigquery struct {
+	Table         bigquery.NullString `json:"table"`
+	Field         bigquery.NullString `json:"field"`
+	Action        bigquery.NullString `json:"action"`
+	Original      bigquery.NullString `json:"original"`
+	Transformed   bigquery.NullString `json:"transformed"`
+	MessageId     bigquery.NullString `json:"message_id"`
+	TransformedAt time.Time           `json:"transformed_at"`
+}
+
+var VaultRecordBigqueryDescription = map[string]string{
+	"Table":         "Table of the transformed row",
+	"Field":         "Path of the transformed field",
+	"Action":        "Transformation of the field (hash, hmac or mask)",
+	"Original":      "Original value of the field",
+	"Transformed":   "Value of the field in the table",
+	"MessageId":     "Pub/Sub message id",
+	"TransformedAt": "Time at which the row was transformed",
+}
+
+/*
+Take the field transforms of the table the rows of this table are derived from, on the fields of this table, unless this
+table has its own transforms
+*/
+func (table *Table) inheritTransforms(from Table) {
+	if table.Transforms != nil {
+		return
+	}
+	schema, err := table.Schema()
+	if err != nil {
+		return
+	}
+	for path, transform := range from.Transforms {
+		if _, err := schemaField(schema, path); err != nil {
+			continue
+		}
+		if table.Transforms == nil {
+			table.Transforms = make(map[string]FieldTransform)
+		}
+		table.Transforms[path] = transform
+	}
+}
+
+/*
+Validate the field transforms of the table against its schema: the transformed fields must be string fields
+*/
+func (table Table) ValidateTransforms() error {
+	if len(table.Transforms) == 0 {
+		if table.Vault != nil {
+			return fmt.Errorf("vault of table %s without transforms", table.Key())
+		}
+		return nil
+	}
+	schema, err := table.Schema()
+	if err != nil {
+		return err
+	}
+	for name, transform := range table.Transforms {
+		switch transform.Action {
+		case TransformKeep, TransformDrop, TransformMask, TransformEncrypt:
+		case TransformHash:
+			if transform.Salt == "" {
+				return fmt.Errorf("missing salt of the hash of field %s of table %s", name, table.Key())
+			}
+		case TransformHMAC:
+			if !strings.HasPrefix(transform.Key, "env:") && !strings.HasPrefix(transform.Key, "secret:") {
+				return fmt.Errorf("invalid key of the hmac of field %s of table %s: expected env:NAME or secret:projects/.../versions/...", name, table.Key())
+			}
+		default:
+			return fmt.Errorf("invalid transform %s of field %s of table %s", transform.Action, name, table.Key())
+		}
+		if transform.Visible != nil && *transform.Visible < 0 {
+			return fmt.Errorf("invalid visible characters %d of field %s of table %s", *transform.Visible, name, table.Key())
+		}
+		field, err := schemaField(schema, name)
+		if err != nil {
+			return fmt.Errorf("invalid transform of table %s: %v", table.Key(), err)
+		}
+		if field.Type != bigquery.StringFieldType && transform.Action != TransformKeep && transform.Action != TransformDrop {
+			return fmt.Errorf("invalid transform of table %s: field %s is not a string field", table.Key(), name)
+		}
+	}
+	return nil
+}
+
+/*
+Find the field of a dotted path in the schema. The names are matched regardless of case and underscores, so that the
+JSON names of the events (sender_email) match the columns (SenderEmail).
+*/
+func schemaField(schema bigquery.Schema, path string) (*bigquery.FieldSchema, error) {
+	var field *bigquery.FieldSchema
+	for _, name := range strings.Split(path, ".") {
+		field = nil
+		for _, candidate := range schema {
+			if normalizeFieldName(candidate.Name) == normalizeFieldName(name) {
+				field = candidate
+				break
+			}
+		}
+		if field == nil {
+			return nil, fmt.Errorf("field %s not found", path)
+		}
+		schema = field.Schema
+	}
+	return field, nil
+}
+
+/*
+Create the transformers of the tables with field transforms, resolving their salts and keys
+*/
+func (bqContext *BqContext) InitTransformers(ctx context.Context) error {
+	bqContext.transformers = make(map[string]*Transformer)
+	secrets := make(map[string][]byte)
+	for _, table := range bqContext.ManagedTables() {
+		if len(table.Transforms) == 0 {
+			continue
+		}
+		transformer := &Transformer{}
+		for name, transform := range table.Transforms {
+			field := fieldTransformer{name: name, path: strings.Split(name, "."), transform: transform}
+			ref := transform.Salt
+			if transform.Action == TransformHMAC {
+				ref = transform.Key
+			}
+			if transform.Action == TransformHash || transform.Action == TransformHMAC {
+				secret, ok := secrets[ref]
+				if !ok {
+					var err error
+					if secret, err = bqContext.resolveSecret(ctx, ref); err != nil {
+						return fmt.Errorf("failed to resolve the %s secret of field %s of table %s: %v", transform.Action, name, table.Key(), err)
+					}
+					secrets[ref] = secret
+				}
+				field.secret = secret
+			}
+			if transform.Action == TransformEncrypt {
+				if bqContext.keyset == nil {
+					if bqContext.Encryption.Keyset == "" {
+						return fmt.Errorf("field %s of table %s is encrypted but no keyset is configured", name, table.Key())
+					}
+					keyset, err := LoadKeyset(bqContext.Encryption.Keyset)
+					if err != nil {
+						return err
+					}
+					bqContext.keyset = keyset
+				}
+				field.keyset = bqContext.keyset
+			}
+			transformer.fields = append(transformer.fields, field)
+		}
+		bqContext.transformers[table.Key()] = transformer
+		logger.Info("Field transforms enabled", "table", table.Key(), "fields", len(transformer.fields))
+	}
+	return nil
+}
+
+/*
+Resolve a secret reference: env:NAME, secret:projects/.../secrets/.../versions/..., or the value itself
+*/
+func (bqContext *BqContext) resolveSecret(ctx context.Context, ref string) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(ref, "env:"):
+		value := os.Getenv(strings.TrimPrefix(ref, "env:"))
+		if value == "" {
+			return nil, fmt.Errorf("environment variable %s is not set", strings.TrimPrefix(ref, "env:"))
+		}
+		return []byte(value), nil
+	case strings.HasPrefix(ref, "secret:"):
+		service, err := secretmanager.NewService(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create secret manager client: %v", err)
+		}
+		version, err := service.Projects.Secrets.Versions.Access(strings.TrimPrefix(ref, "secret:")).Context(ctx).Do()
+		if err != nil {
+			return nil, fmt.Errorf("failed to access secret %s: %v", strings.TrimPrefix(ref, "secret:"), err)
+		}
+		return base64.StdEncoding.DecodeString(version.Payload.Data)
+	default:
+		return []byte(ref), nil
+	}
+}
+
+/*
+Get the transformer of the table, nil when the table has no field transforms
+*/
+func (bqContext *BqContext) Transformer(table Table) *Transformer {
+	return bqContext.transformers[table.Key()]
+}
+
+/*
+Transform the fields of the row, and return the original and transformed values of the hashed and masked fields. The
+encrypted fields are encrypted with the keys of the tenant.
+*/
+func (transformer *Transformer) Apply(row map[string]bigquery.Value, tenant string) ([]VaultEntry, error) {
+	var entries []VaultEntry
+	for _, field := range transformer.fields {
+		if err := field.apply(row, field.path, tenant, &entries); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+func (field fieldTransformer) apply(row map[string]bigquery.Value, path []string, tenant string, entries *[]VaultEntry) error {
+	for key, value := range row {
+		if normalizeFieldName(key) != normalizeFieldName(path[0]) {
+			continue
+		}
+		if len(path) > 1 {
+			switch v := value.(type) {
+			case map[string]bigquery.Value:
+				return field.apply(v, path[1:], tenant, entries)
+			case []bigquery.Value:
+				for _, item := range v {
+					if nested, ok := item.(map[string]bigquery.Value); ok {
+						if err := field.apply(nested, path[1:], tenant, entries); err != nil {
+							return err
+						}
+					}
+				}
+			}
+			return nil
+		}
+		switch field.transform.Action {
+		case TransformKeep:
+		case TransformDrop:
+			delete(row, key)
+		default:
+			transformed, err := field.transformValue(value, tenant, entries)
+			if err != nil {
+				return err
+			}
+			row[key] = transformed
+		}
+		return nil
+	}
+	return nil
+}
+
+func (field fieldTransformer) transformValue(value bigquery.Value, tenant string, entries *[]VaultEntry) (bigquery.Value, error) {
+	switch v := value.(type) {
+	case string:
+		return field.transformString(v, tenant, entries)
+	case bigquery.NullString:
+		if !v.Valid {
+			return v, nil
+		}
+		transformed, err := field.transformString(v.StringVal, tenant, entries)
+		return bigquery.NullString{StringVal: transformed, Valid: true}, err
+	case []string:
+		transformed := make([]string, len(v))
+		for i, s := range v {
+			var err error
+			if transformed[i], err = field.transformString(s, tenant, entries); err != nil {
+				return nil, err
+			}
+		}
+		return transformed, nil
+	default:
+		return value, nil
+	}
+}
+
+func (field fieldTransformer) transformString(value, tenant string, entries *[]VaultEntry) (string, error) {
+	var transformed string
+	switch field.transform.Action {
+	case TransformHash:
+		sum := sha256.Sum256(append(append([]byte{}, field.secret...), field.normalize(value)...))
+		transformed = hex.EncodeToString(sum[:])
+	case TransformHMAC:
+		mac := hmac.New(sha256.New, field.secret)
+		mac.Write([]byte(field.normalize(value)))
+		transformed = hex.EncodeToString(mac.Sum(nil))
+	case TransformMask:
+		visible := defaultMaskVisible
+		if field.transform.Visible != nil {
+			visible = *field.transform.Visible
+		}
+		transformed = maskPreservingFormat(value, visible)
+	case TransformEncrypt:
+		if field.transform.Tenant != "" {
+			tenant = field.transform.Tenant
+		}
+		// The original of an encrypted value is never written in a vault: it would outlive the key of its tenant
+		encrypted, err := field.keyset.Encrypt(tenant, field.name, value)
+		if err != nil {
+			return "", fmt.Errorf("failed to encrypt field %s: %w", field.name, err)
+		}
+		return encrypted, nil
+	}
+	*entries = append(*entries, VaultEntry{Field: field.name, Action: field.transform.Action, Original: value, Transformed: transformed})
+	return transformed, nil
+}
+
+func (field fieldTransformer) normalize(value string) string {
+	if field.transform.Normalize {
+		return strings.ToLower(strings.TrimSpace(value))
+	}
+	return value
+}
+
+/*
+Mask the letters and digits of a value, keeping its length and its separators. Emails keep the first character of their
+local part and their domain, other values keep their last visible letters and digits.
+*/
+func maskPreservingFormat(value string, visible int) string {
+	if local, domain, ok := strings.Cut(value, "@"); ok && local != "" {
+		runes := []rune(local)
+		return string(runes[:1]) + strings.Repeat("*", len(runes)-1) + "@" + domain
+	}
+	runes := []rune(value)
+	for i := len(runes) - 1; i >= 0; i-- {
+		if !unicode.IsLetter(runes[i]) && !unicode.IsDigit(runes[i]) {
+			continue
+		}
+		if visible > 0 {
+			visible--
+			continue
+		}
+		runes[i] = '*'
+	}
+	return string(runes)
+}
+
+/*
+Transform the fields of the row, which is replaced by its transformed values
+*/
+func (r *InsertRow) Transform(transformer *Transformer, tenant string) ([]VaultEntry, error) {
+	values, err := r.save()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := transformer.Apply(values, tenant)
+	if err != nil {
+		return nil, err
+	}
+	r.Row = savedRow(values)
+	return entries, nil
+}
+
+/*
+savedRow is a row already converted to its BigQuery values
+*/
+type savedRow map[string]bigquery.Value
+
+func (r savedRow) Save() (map[string]bigquery.Value, string, error) {
+	return r, "", nil
+}
+
+/*
+Write the original and transformed values of the fields of the row in the vault table of the table, before the row itself,
+so that every transformed value of a table can be resolved
+*/
+func (bqContext *BqContext) WriteVault(ctx context.Context, msg PubSubMessage, table Table, entries []VaultEntry) error {
+	if table.Vault == nil || len(entries) == 0 {
+		return nil
+	}
+	now := time.Now().UTC()
+	// The values of a repeated field are numbered in the order of the row: the insert id of a value doesn't depend on
+	// the order of the transforms, which differs between instances
+	elements := make(map[string]int)
+	for _, entry := range entries {
+		element := elements[entry.Field]
+		elements[entry.Field]++
+		record := VaultRecordBigquery{
+			Table:         bigquery.NullString{StringVal: table.Key(), Valid: true},
+			Field:         bigquery.NullString{StringVal: entry.Field, Valid: true},
+			Action:        bigquery.NullString{StringVal: entry.Action, Valid: true},
+			Original:      bigquery.NullString{StringVal: entry.Original, Valid: true},
+			Transformed:   bigquery.NullString{StringVal: entry.Transformed, Valid: true},
+			MessageId:     bigquery.NullString{StringVal: msg.MessageId, Valid: msg.MessageId != ""},
+			TransformedAt: now,
+		}
+		row := InsertRow{Row: record}
+		if id := insertId(msg.MessageId, *table.Vault); id != "" {
+			row.InsertId = fmt.Sprintf("%s:%s:%s:%d", id, table.Key(), entry.Field, element)
+		}
+		if table.Vault.RowMetadata {
+			row.Metadata = NewRowMetadata(ctx, msg)
+		}
+		if err := bqContext.Sink.Insert(ctx, *table.Vault, row); err != nil {
+			return fmt.Errorf("failed to write field %s of table %s in vault %s: %w", entry.Field, table.Key(), table.Vault.Key(), err)
+		}
+	}
+	return nil
+}
+
+/*
+Apply the field transforms of the table to the row, writing the original values in the vault of the table first
+*/
+func (bqContext *BqContext) transformRow(ctx context.Context, msg PubSubMessage, table Table, row *InsertRow) error {
+	transformer := bqContext.Transformer(table)
+	if transformer == nil {
+		return nil
+	}
+	entries, err := row.Transform(transformer, msg.Attributes[bqContext.tenantAttribute()])
+	if err != nil {
+		return fmt.Errorf("failed to transform row of table %s: %w", table.Key(), err)
+	}
+	return bqContext.WriteVault(ctx, msg, table, entries)
+}
+
+/*
+Attribute of the messages naming the tenant of their encrypted values, source by default
+*/
+func (bqContext *BqContext) tenantAttribute() string {
+	if bqContext.Encryption.TenantAttribute != "" {
+		return bqContext.Encryption.TenantAttribute
+	}
+	return "source"
+}
@@ -0,0 +1,175 @@
+package function
+
+import (
+	"context"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+)
+
+func TestTransformerApply(t *testing.T) {
+	visible := 2
+	tests := []struct {
+		name      string
+		path      string
+		transform FieldTransform
+		secret    []byte
+		row       map[string]bigquery.Value
+		want      map[string]bigquery.Value
+		vault     []VaultEntry
+	}{
+		{
+			name:      "hash",
+			path:      "email",
+			transform: FieldTransform{Action: TransformHash},
+			secret:    []byte("pepper"),
+			row:       map[string]bigquery.Value{"Email": "jane.doe@example.com", "Event": "delivered"},
+			want:      map[string]bigquery.Value{"Email": "fb30037b6d90f8ea5ceb6a12b0656ecd677316057b83fd0c0290883849c71a03", "Event": "delivered"},
+			vault:     []VaultEntry{{Field: "email", Action: TransformHash, Original: "jane.doe@example.com", Transformed: "fb30037b6d90f8ea5ceb6a12b0656ecd677316057b83fd0c0290883849c71a03"}},
+		},
+		{
+			name:      "hash without normalization",
+			path:      "email",
+			transform: FieldTransform{Action: TransformHash},
+			secret:    []byte("pepper"),
+			row:       map[string]bigquery.Value{"Email": bigquery.NullString{StringVal: "Jane.Doe@Example.com ", Valid: true}},
+			want:      map[string]bigquery.Value{"Email": bigquery.NullString{StringVal: "cbe6ce4a2bee90ac2112fd530765c4455200a70dabaff1bc3a7eb987dd084acb", Valid: true}},
+			vault:     []VaultEntry{{Field: "email", Action: TransformHash, Original: "Jane.Doe@Example.com ", Transformed: "cbe6ce4a2bee90ac2112fd530765c4455200a70dabaff1bc3a7eb987dd084acb"}},
+		},
+		{
+			name:      "hmac of the normalized value",
+			path:      "email",
+			transform: FieldTransform{Action: TransformHMAC, Normalize: true},
+			secret:    []byte("k3y"),
+			row:       map[string]bigquery.Value{"Email": bigquery.NullString{StringVal: " Jane.Doe@Example.com", Valid: true}},
+			want:      map[string]bigquery.Value{"Email": bigquery.NullString{StringVal: "eee0d69b9379c1c46c2f0160a1b66d5e60c8848e35ab66433420320cf10bcbb3", Valid: true}},
+			vault:     []VaultEntry{{Field: "email", Action: TransformHMAC, Original: " Jane.Doe@Example.com", Transformed: "eee0d69b9379c1c46c2f0160a1b66d5e60c8848e35ab66433420320cf10bcbb3"}},
+		},
+		{
+			name:      "null value",
+			path:      "email",
+			transform: FieldTransform{Action: TransformHMAC},
+			secret:    []byte("k3y"),
+			row:       map[string]bigquery.Value{"Email": bigquery.NullString{}},
+			want:      map[string]bigquery.Value{"Email": bigquery.NullString{}},
+		},
+		{
+			name:      "mask of an email",
+			path:      "email",
+			transform: FieldTransform{Action: TransformMask},
+			row:       map[string]bigquery.Value{"Email": "jane.doe@example.com"},
+			want:      map[string]bigquery.Value{"Email": "j*******@example.com"},
+			vault:     []VaultEntry{{Field: "email", Action: TransformMask, Original: "jane.doe@example.com", Transformed: "j*******@example.com"}},
+		},
+		{
+			name:      "mask of the nested fields of repeated records",
+			path:      "Content.WorkPhone",
+			transform: FieldTransform{Action: TransformMask, Visible: &visible},
+			row: map[string]bigquery.Value{"Content": []bigquery.Value{
+				map[string]bigquery.Value{"WorkPhone": "+33 6 12 34 56 78"},
+				map[string]bigquery.Value{"WorkPhone": "0612345679"},
+			}},
+			want: map[string]bigquery.Value{"Content": []bigquery.Value{
+				map[string]bigquery.Value{"WorkPhone": "+** * ** ** ** 78"},
+				map[string]bigquery.Value{"WorkPhone": "********79"},
+			}},
+			vault: []VaultEntry{
+				{Field: "Content.WorkPhone", Action: TransformMask, Original: "+33 6 12 34 56 78", Transformed: "+** * ** ** ** 78"},
+				{Field: "Content.WorkPhone", Action: TransformMask, Original: "0612345679", Transformed: "********79"},
+			},
+		},
+		{
+			name:      "mask of a repeated field",
+			path:      "tags",
+			transform: FieldTransform{Action: TransformMask},
+			row:       map[string]bigquery.Value{"Tags": []string{"vip-2024", "a"}},
+			want:      map[string]bigquery.Value{"Tags": []string{"***-2024", "a"}},
+			vault: []VaultEntry{
+				{Field: "tags", Action: TransformMask, Original: "vip-2024", Transformed: "***-2024"},
+				{Field: "tags", Action: TransformMask, Original: "a", Transformed: "a"},
+			},
+		},
+		{
+			name:      "drop",
+			path:      "Content.LastName",
+			transform: FieldTransform{Action: TransformDrop},
+			row:       map[string]bigquery.Value{"Content": []bigquery.Value{map[string]bigquery.Value{"LastName": "Doe", "Name": "Jane"}}},
+			want:      map[string]bigquery.Value{"Content": []bigquery.Value{map[string]bigquery.Value{"Name": "Jane"}}},
+		},
+		{
+			name:      "keep",
+			path:      "email",
+			transform: FieldTransform{Action: TransformKeep},
+			row:       map[string]bigquery.Value{"Email": "jane.doe@example.com"},
+			want:      map[string]bigquery.Value{"Email": "jane.doe@example.com"},
+		},
+		{
+			name:      "missing field",
+			path:      "Content.WorkPhone",
+			transform: FieldTransform{Action: TransformMask},
+			row:       map[string]bigquery.Value{"Email": "jane.doe@example.com"},
+			want:      map[string]bigquery.Value{"Email": "jane.doe@example.com"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			transformer := &Transformer{fields: []fieldTransformer{{
+				name:      test.path,
+				path:      strings.Split(test.path, "."),
+				transform: test.transform,
+				secret:    test.secret,
+			}}}
+			entries, err := transformer.Apply(test.row, "shop")
+			if err != nil {
+				t.Fatalf("Apply: %v", err)
+			}
+			if !reflect.DeepEqual(test.row, test.want) {
+				t.Errorf("row: got %v, want %v", test.row, test.want)
+			}
+			if !slices.Equal(entries, test.vault) {
+				t.Errorf("vault: got %+v, want %+v", entries, test.vault)
+			}
+		})
+	}
+}
+
+func TestVaultInsertIdsDoNotDependOnTheOrderOfTheTransforms(t *testing.T) {
+	email := VaultEntry{Field: "email", Action: TransformHMAC, Original: "jane.doe@example.com", Transformed: "eee0d69b"}
+	workPhones := []VaultEntry{
+		{Field: "Content.WorkPhone", Action: TransformMask, Original: "0612345678", Transformed: "********78"},
+		{Field: "Content.WorkPhone", Action: TransformMask, Original: "0612345679", Transformed: "********79"},
+	}
+	table := Table{DatasetId: "brevo", TableId: "marketing_email", Vault: &Table{DatasetId: "brevo_restricted", TableId: "vault"}}
+	msg := PubSubMessage{MessageId: "42"}
+	// The transforms are applied in the order of a map, which differs between the instances and the redeliveries
+	orders := [][]VaultEntry{
+		append([]VaultEntry{email}, workPhones...),
+		append(append([]VaultEntry{}, workPhones...), email),
+	}
+	var previous map[string]string
+	for i, entries := range orders {
+		sink := NewFakeSink()
+		consumer := &BqContext{Sink: sink}
+		if err := consumer.WriteVault(context.Background(), msg, table, entries); err != nil {
+			t.Fatalf("WriteVault: %v", err)
+		}
+		originals := make(map[string]string)
+		for _, row := range sink.Rows(table.Vault.Key()) {
+			record := row.Row.(VaultRecordBigquery)
+			if _, ok := originals[row.InsertId]; ok {
+				t.Errorf("order %d: insert id %s of several values", i, row.InsertId)
+			}
+			originals[row.InsertId] = record.Original.StringVal
+		}
+		if len(originals) != 3 {
+			t.Errorf("order %d: got %d vault rows, want 3", i, len(originals))
+		}
+		if previous != nil && !reflect.DeepEqual(originals, previous) {
+			t.Errorf("insert ids of the values: got %v, want %v", originals, previous)
+		}
+		previous = originals
+	}
+}
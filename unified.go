@@ -0,0 +1,143 @@
+package function
+
+import (
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+const (
+	ChannelEmail = "email"
+	ChannelSMS   = "sms"
+)
+
+const (
+	KindTransactional = "transactional"
+	KindMarketing     = "marketing"
+)
+
+/*
+UnifiedEventBigquery is a struct that represents an email or SMS event of any category in a common bigquery format, so
+that all the touches of a contact are in a single table.
+*/
+type UnifiedEventBigquery struct {
+	Channel    bigquery.NullString    `json:"channel"`
+	Kind       bigquery.NullString    `json:"kind"`
+	Category   bigquery.NullString    `json:"category"`
+	EventType  bigquery.NullString    `json:"event_type"`
+	Recipient  bigquery.NullString    `json:"recipient"`
+	MessageId  bigquery.NullString    `json:"message_id"`
+	CampaignId bigquery.NullInt64     `json:"campaign_id"`
+	TemplateId bigquery.NullInt64     `json:"template_id"`
+	Tags       []string               `json:"tags"`
+	EventTime  bigquery.NullTimestamp `json:"event_time"`
+	Source     bigquery.NullString    `json:"source"`
+	Payload    bigquery.NullString    `json:"payload"`
+}
+
+var UnifiedEventBigqueryDescription = map[string]string{
+	"Channel":    "Channel of the message (email or sms)",
+	"Kind":       "Kind of the message (transactional or marketing)",
+	"Category":   "Event category (transactional-email, marketing-email, marketing-sms or transactional-sms)",
+	"EventType":  "Type of the event (delivered, opened, click, hard_bounce...)",
+	"Recipient":  "Email address or mobile number of the recipient",
+	"MessageId":  "Id of the message",
+	"CampaignId": "Campaign id of the marketing messages",
+	"TemplateId": "Template id of the transactional emails",
+	"Tags":       "Tags of the message",
+	"EventTime":  "Time at which the event occurred",
+	"Source":     "Source attribute of the Pub/Sub message",
+	"Payload":    "Event as received from Brevo, JSON encoded",
+}
+
+func projectUnified(category, source string, event Event, payload []byte) any {
+	row := UnifiedEventBigquery{
+		Category: bigquery.NullString{StringVal: category, Valid: true},
+		Source:   bigquery.NullString{StringVal: source, Valid: source != ""},
+		Payload:  bigquery.NullString{StringVal: string(payload), Valid: len(payload) > 0},
+	}
+	switch e := event.(type) {
+	case TransactionalEmailEvent:
+		row.Channel, row.Kind = nullString(ChannelEmail), nullString(KindTransactional)
+		row.EventType = toNullString(e.Event)
+		row.Recipient = toNullString(e.Email)
+		row.MessageId = toNullString(e.MessageId)
+		row.TemplateId = toNullInt64(e.TemplateId)
+		row.Tags = appendTags(row.Tags, e.Tag)
+		if e.Tags != nil {
+			row.Tags = append(row.Tags, *e.Tags...)
+		}
+		row.EventTime = unifiedEventTime(e.TSEvent, e.TSEpoch)
+	case MarketingEmailEvent:
+		row.Channel, row.Kind = nullString(ChannelEmail), nullString(KindMarketing)
+		row.EventType = toNullString(e.Event)
+		row.Recipient = toNullString(e.Email)
+		row.MessageId = toNullStringInt64(e.Id)
+		row.CampaignId = toNullInt64(e.CampId)
+		row.Tags = appendTags(row.Tags, e.Tag)
+		row.EventTime = unifiedEventTime(e.TSEvent, nil)
+	case MarketingSMSEvent:
+		row.Channel, row.Kind = nullString(ChannelSMS), nullString(KindMarketing)
+		row.EventType = smsEventType(e.MsgStatus, e.Status)
+		row.Recipient = toNullString(e.To)
+		row.MessageId = toNullStringInt64(e.MessageId)
+		row.CampaignId = toNullInt64(e.CampaignId)
+		if e.Tag != nil {
+			row.Tags = *e.Tag
+		}
+		row.EventTime = unifiedEventTime(e.TSEvent, nil)
+	case TransactionalSMSEvent:
+		row.Channel, row.Kind = nullString(ChannelSMS), nullString(KindTransactional)
+		row.EventType = smsEventType(e.MsgStatus, e.Status)
+		row.Recipient = toNullString(e.To)
+		row.MessageId = toNullStringInt64(e.MessageId)
+		if e.Tag != nil {
+			row.Tags = *e.Tag
+		}
+		row.EventTime = unifiedEventTime(e.TSEvent, nil)
+	}
+	return row
+}
+
+func nullString(s string) bigquery.NullString {
+	return bigquery.NullString{StringVal: s, Valid: true}
+}
+
+func toNullStringInt64(i *int64) bigquery.NullString {
+	if i == nil {
+		return bigquery.NullString{}
+	}
+	return nullString(strconv.FormatInt(*i, 10))
+}
+
+func appendTags(tags []string, tag *string) []string {
+	if tag != nil && *tag != "" {
+		return append(tags, *tag)
+	}
+	return tags
+}
+
+/*
+The status of the SMS events is msg_status, or status for the older webhooks
+*/
+func smsEventType(msgStatus, status *string) bigquery.NullString {
+	if msgStatus != nil {
+		return toNullString(msgStatus)
+	}
+	return toNullString(status)
+}
+
+/*
+Time of the event, from its timestamp in seconds, or else in milliseconds
+*/
+func unifiedEventTime(seconds, milliseconds *int64) bigquery.NullTimestamp {
+	switch {
+	case seconds != nil:
+		return bigquery.NullTimestamp{Timestamp: time.Unix(*seconds, 0).UTC(), Valid: true}
+	case milliseconds != nil:
+		return bigquery.NullTimestamp{Timestamp: time.UnixMilli(*milliseconds).UTC(), Valid: true}
+	default:
+		return bigquery.NullTimestamp{}
+	}
+}
@@ -1,6 +1,17 @@
 package function
 
-import "cloud.google.com/go/bigquery"
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/googleapi"
+)
 
 /*
 Event is an interface that all event structs must implement.
@@ -39,3 +50,60 @@ func toNullFloat64(f *float64) bigquery.NullFloat64 {
 	}
 	return bigquery.NullFloat64{Float64: *f, Valid: true}
 }
+
+/*
+Check whether the error is a not found error of a Google API
+*/
+func isNotFound(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound
+}
+
+/*
+Check whether the error is an already exists error of a Google API
+*/
+func isAlreadyExists(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusConflict
+}
+
+/*
+Duration is a time.Duration decoded from a JSON string such as "90s", "12h" or "30d" (days)
+*/
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string: %v", err)
+	}
+	parsed, err := ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = parsed
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+/*
+Parse a duration, with the "d" (days) unit in addition to the units of time.ParseDuration
+*/
+func ParseDuration(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %s: %v", s, err)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	if s == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(s)
+}
@@ -0,0 +1,317 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/GoogleCloudPlatform/functions-framework-go/funcframework"
+)
+
+/*
+WorkerConfig holds the settings of the long-running worker. Without a spool directory, the worker inserts the rows
+directly, like the function. Without a load directory, the rows of the tables in load mode are rejected.
+*/
+type WorkerConfig struct {
+	Spool      SpoolConfig      `json:"spool"`
+	Breaker    BreakerConfig    `json:"breaker"`
+	Load       LoadConfig       `json:"load"`
+	Metrics    MetricsConfig    `json:"metrics"`
+	Tracing    TracingConfig    `json:"tracing"`
+	Retention  RetentionConfig  `json:"retention"`
+	Aggregates AggregatesConfig `json:"aggregates"`
+}
+
+const spoolReplayInterval = time.Second
+const loadCheckInterval = 10 * time.Second
+
+// Time given to the messages being consumed, and then to the last merge of the aggregates, when the worker stops
+const workerShutdownTimeout = 10 * time.Second
+
+// The sinks of the worker, reported by the admin endpoint and by the metrics from their own goroutines
+var loadSink atomic.Pointer[LoadSink]
+var spoolingSink atomic.Pointer[SpoolingSink]
+
+// The messages being consumed, drained when the worker stops
+var consumers = &drainGate{}
+
+var errWorkerStopping = errors.New("worker stopping, message not accepted")
+
+/*
+drainGate tracks the messages being consumed. Once it is drained, no new message is accepted, and the messages in flight
+are waited for, so that the sinks are only closed once they are written.
+*/
+type drainGate struct {
+	mutex    sync.RWMutex
+	draining bool
+	inFlight sync.WaitGroup
+}
+
+/*
+Accept a message, unless the gate is drained. An accepted message must be released with Leave.
+*/
+func (gate *drainGate) Enter() bool {
+	gate.mutex.RLock()
+	defer gate.mutex.RUnlock()
+	if gate.draining {
+		return false
+	}
+	gate.inFlight.Add(1)
+	return true
+}
+
+func (gate *drainGate) Leave() {
+	gate.inFlight.Done()
+}
+
+/*
+Stop accepting messages and wait for the messages in flight, until the context is done
+*/
+func (gate *drainGate) Drain(ctx context.Context) error {
+	gate.mutex.Lock()
+	gate.draining = true
+	gate.mutex.Unlock()
+	drained := make(chan struct{})
+	go func() {
+		gate.inFlight.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+/*
+RunWorker starts the consumer and serves all its functions on the port, at /RunPubSubConsumer, /Admin and /Suppressions,
+until the server fails or the context is done. When a spool directory is configured, rows are spooled on disk while BigQuery is unavailable. When a load
+directory is configured, the rows of the tables in load mode are batched on disk and loaded with load jobs. The metrics
+and the traces are exported with the configured exporters, the retention of the tables is enforced periodically, and so
+are the merges of the lifecycle state table, of the suppression table and of the aggregates table, and the checks of
+the alert rules. When the context is done, the worker stops accepting messages, so that Pub/Sub redelivers them, waits for
+the messages being consumed, merges the aggregates once more, and closes its sinks.
+*/
+func RunWorker(ctx context.Context, port string) error {
+	if err := Start(ctx); err != nil {
+		return err
+	}
+	bqContext.startNotifications()
+	if bqContext.Worker.Load.Directory != "" {
+		sink, err := OpenLoadSink(bqContext.Worker.Load, &bqContext)
+		if err != nil {
+			return err
+		}
+		defer sink.Close()
+		loadSink.Store(sink)
+		bqContext.Sink = NewWriteModeSink(&bqContext, sink)
+		go sink.Run(ctx, loadCheckInterval)
+	}
+	if bqContext.Worker.Spool.Directory != "" {
+		spool, err := OpenSpool(bqContext.Worker.Spool)
+		if err != nil {
+			return err
+		}
+		defer spool.Close()
+		sink := NewSpoolingSink(bqContext.Sink, spool, NewCircuitBreaker(bqContext.Worker.Breaker), &bqContext)
+		bqContext.Sink = sink
+		spoolingSink.Store(sink)
+		go sink.Run(ctx, spoolReplayInterval)
+	}
+	shutdownMetrics, err := StartMetricsExporter(ctx, bqContext.Worker.Metrics)
+	if err != nil {
+		return err
+	}
+	defer shutdownMetrics(context.Background())
+	shutdownTracing, err := StartTraceExporter(ctx, bqContext.Worker.Tracing)
+	if err != nil {
+		return err
+	}
+	defer shutdownTracing(context.Background())
+	if slices.ContainsFunc(bqContext.ManagedTables(), func(table Table) bool { return table.Retention.Duration > 0 }) {
+		go bqContext.RunRetention(ctx, bqContext.Worker.Retention.Interval.Duration)
+	}
+	if bqContext.Lifecycle.State != nil {
+		go bqContext.RunLifecycle(ctx, bqContext.Lifecycle.Interval.Duration)
+	}
+	if bqContext.Suppression.Table != nil {
+		go bqContext.RunSuppressions(ctx, bqContext.Suppression.Interval.Duration)
+	}
+	if bqContext.rules != nil {
+		go bqContext.RunAlerts(ctx)
+	}
+	if bqContext.Worker.Aggregates.Table != nil {
+		go bqContext.RunAggregates(ctx, bqContext.Worker.Aggregates.Interval.Duration)
+	}
+	logger.Info("Worker listening", "port", port)
+	served := make(chan error, 1)
+	go func() { served <- funcframework.Start(port) }()
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
+		logger.Info("Worker stopping")
+		stopWorker()
+		return nil
+	}
+}
+
+/*
+Drain the messages being consumed, then merge the aggregates written by them. The rows still spooled are counted by the
+next merge, once they are replayed.
+*/
+func stopWorker() {
+	drainCtx, cancel := context.WithTimeout(context.Background(), workerShutdownTimeout)
+	defer cancel()
+	if err := consumers.Drain(drainCtx); err != nil {
+		logger.Error("Messages still being consumed when the worker stopped", "error", err)
+	}
+	if bqContext.Worker.Aggregates.Table == nil {
+		return
+	}
+	mergeCtx, cancel := context.WithTimeout(context.Background(), workerShutdownTimeout)
+	defer cancel()
+	if _, err := bqContext.MergeAggregates(mergeCtx); err != nil {
+		logger.Error("Last aggregates merge failed", "error", err)
+	}
+}
+
+/*
+SpoolingSink protects a sink with a circuit breaker. While the breaker is open, rows are appended to the spool, and they
+are replayed in order once the sink is available again. While the spool is not empty, new rows are spooled too, so that
+the rows are inserted in the order they were received.
+*/
+type SpoolingSink struct {
+	inner     Sink
+	spool     *Spool
+	breaker   *CircuitBreaker
+	bqContext *BqContext
+	spooled   atomic.Int64
+	replayed  atomic.Int64
+	rejected  atomic.Int64
+}
+
+/*
+SpoolingSinkStats is the state of the spooling sink reported by the admin endpoint
+*/
+type SpoolingSinkStats struct {
+	Breaker  string `json:"breaker"`
+	Entries  int64  `json:"entries"`
+	Bytes    int64  `json:"bytes"`
+	Spooled  int64  `json:"spooled"`
+	Replayed int64  `json:"replayed"`
+	Rejected int64  `json:"rejected"`
+}
+
+func NewSpoolingSink(inner Sink, spool *Spool, breaker *CircuitBreaker, bqContext *BqContext) *SpoolingSink {
+	return &SpoolingSink{inner: inner, spool: spool, breaker: breaker, bqContext: bqContext}
+}
+
+func (sink *SpoolingSink) Insert(ctx context.Context, table Table, row InsertRow) error {
+	if sink.spool.Empty() && sink.breaker.Allow(ctx) {
+		err := sink.inner.Insert(ctx, table, row)
+		if !isSinkFailure(ctx, err) {
+			sink.breaker.Success(ctx)
+			return err
+		}
+		sink.breaker.Failure(ctx)
+		if sink.breaker.State() == BreakerClosed || ctx.Err() != nil {
+			return err
+		}
+	}
+	raw, err := row.Raw()
+	if err != nil {
+		return fmt.Errorf("failed to encode row for the spool: %v", err)
+	}
+	messageId, _, _ := strings.Cut(row.InsertId, ":")
+	err = sink.spool.Append(SpoolEntry{Table: table.Key(), InsertId: row.InsertId, MessageId: messageId, Row: raw, SpooledAt: time.Now().UTC()})
+	if err != nil {
+		sink.rejected.Add(1)
+		return err
+	}
+	sink.spooled.Add(1)
+	return nil
+}
+
+/*
+Replay the spool whenever the breaker lets calls through, until the context is cancelled
+*/
+func (sink *SpoolingSink) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if sink.spool.Empty() || !sink.breaker.Allow(ctx) {
+			continue
+		}
+		replayed, err := sink.spool.Replay(func(entry SpoolEntry) error {
+			return sink.replay(ctx, entry)
+		})
+		sink.replayed.Add(int64(replayed))
+		if replayed > 0 || err != nil {
+			logger.InfoContext(ctx, "Spool replayed", "replayed", replayed, "remaining", sink.spool.Stats().Entries, "error", err)
+		}
+	}
+}
+
+func (sink *SpoolingSink) replay(ctx context.Context, entry SpoolEntry) error {
+	table, err := sink.bqContext.GetManagedTable(entry.Table)
+	if err != nil {
+		logger.ErrorContext(ctx, "Dropping spooled row of a table that is no longer configured", "table", entry.Table, "messageId", entry.MessageId)
+		return nil
+	}
+	err = sink.inner.Insert(ctx, table, InsertRow{Row: entry.Row, InsertId: entry.InsertId})
+	if isSinkFailure(ctx, err) {
+		sink.breaker.Failure(ctx)
+		return err
+	}
+	sink.breaker.Success(ctx)
+	if ClassifyError(err) == ErrorClassInvalid {
+		// The row will never be accepted: quarantine it to replay the rest of the spool
+		payload, _ := json.Marshal(entry.Row)
+		if sink.bqContext.QuarantineTable == nil {
+			logger.ErrorContext(ctx, "Dropping spooled row rejected by Bigquery", "table", entry.Table, "messageId", entry.MessageId, "row", string(payload), "rowErrors", RowErrors(err))
+			return nil
+		}
+		msg := PubSubMessage{MessageId: entry.MessageId, Data: payload, Attributes: map[string]string{"table": entry.Table}}
+		return sink.bqContext.Quarantine(ctx, msg, fmt.Sprintf("spooled row rejected by table %s on fields %v", entry.Table, RowErrors(err)), RowErrors(err))
+	}
+	return err
+}
+
+func (sink *SpoolingSink) Stats() SpoolingSinkStats {
+	spoolStats := sink.spool.Stats()
+	return SpoolingSinkStats{
+		Breaker:  sink.breaker.State(),
+		Entries:  spoolStats.Entries,
+		Bytes:    spoolStats.Bytes,
+		Spooled:  sink.spooled.Load(),
+		Replayed: sink.replayed.Load(),
+		Rejected: sink.rejected.Load(),
+	}
+}
+
+/*
+Check whether the error means the sink is unavailable. Rejected rows and unhealthy tables mean it is available.
+*/
+func isSinkFailure(ctx context.Context, err error) bool {
+	switch ClassifyError(err) {
+	case ErrorClassTransient, ErrorClassUnknown:
+		return true
+	case ErrorClassTimeout:
+		return ctx.Err() == nil
+	default:
+		return false
+	}
+}
@@ -0,0 +1,244 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+var errUnavailable = &googleapi.Error{Code: 503, Message: "backend unavailable"}
+
+var spoolTestTable = Table{DatasetId: "brevo", TableId: "events"}
+
+func spoolTestRow(i int) InsertRow {
+	return InsertRow{Row: RawRow{"value": json.RawMessage(fmt.Sprint(i))}, InsertId: fmt.Sprintf("message-%d:%s", i, spoolTestTable.Key())}
+}
+
+func newSpoolingTestSink(t *testing.T, spoolConfig SpoolConfig) (*SpoolingSink, *FakeSink, *Spool) {
+	t.Helper()
+	if spoolConfig.Directory == "" {
+		spoolConfig.Directory = t.TempDir()
+	}
+	spoolConfig.NoSync = true
+	spool, err := OpenSpool(spoolConfig)
+	if err != nil {
+		t.Fatalf("OpenSpool: %v", err)
+	}
+	t.Cleanup(func() { spool.Close() })
+	fake := NewFakeSink()
+	breaker := NewCircuitBreaker(BreakerConfig{FailureThreshold: 2, OpenTimeout: Duration{10 * time.Millisecond}})
+	sink := NewSpoolingSink(fake, spool, breaker, &BqContext{Tables: []Table{spoolTestTable}})
+	return sink, fake, spool
+}
+
+/*
+Replay the spool with the replay loop of the worker, until it is empty
+*/
+func replaySpool(t *testing.T, sink *SpoolingSink, spool *Spool) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go sink.Run(ctx, time.Millisecond)
+	deadline := time.Now().Add(5 * time.Second)
+	for !spool.Empty() {
+		if time.Now().After(deadline) {
+			t.Fatalf("spool not replayed: %+v", sink.Stats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func insertIds(rows []InsertRow) []string {
+	ids := make([]string, 0, len(rows))
+	for _, row := range rows {
+		ids = append(ids, row.InsertId)
+	}
+	return ids
+}
+
+func TestSpoolingSinkOpensBreakerAndSpools(t *testing.T) {
+	sink, fake, spool := newSpoolingTestSink(t, SpoolConfig{})
+	fake.SetOutage(errUnavailable)
+	ctx := context.Background()
+
+	// The first failure is returned, so that the message is redelivered
+	if err := sink.Insert(ctx, spoolTestTable, spoolTestRow(1)); !errors.Is(err, errUnavailable) {
+		t.Fatalf("first insert: got %v, want the outage error", err)
+	}
+	if state := sink.breaker.State(); state != BreakerClosed {
+		t.Fatalf("breaker after one failure: got %s, want %s", state, BreakerClosed)
+	}
+	// The second failure opens the breaker: the row and the next ones are spooled without calling the sink
+	for i := 2; i <= 5; i++ {
+		if err := sink.Insert(ctx, spoolTestTable, spoolTestRow(i)); err != nil {
+			t.Fatalf("insert %d: %v", i, err)
+		}
+	}
+	if state := sink.breaker.State(); state != BreakerOpen {
+		t.Fatalf("breaker after the outage: got %s, want %s", state, BreakerOpen)
+	}
+	if calls := fake.Calls(); calls != 2 {
+		t.Errorf("calls of the sink: got %d, want 2", calls)
+	}
+	stats := sink.Stats()
+	if stats.Entries != 4 || stats.Spooled != 4 || stats.Rejected != 0 {
+		t.Errorf("stats: got %+v, want 4 entries spooled", stats)
+	}
+	if rows := fake.Rows(spoolTestTable.Key()); len(rows) != 0 {
+		t.Errorf("rows inserted during the outage: %v", insertIds(rows))
+	}
+	if spool.Empty() {
+		t.Error("spool is empty")
+	}
+}
+
+func TestSpoolingSinkReplaysInOrder(t *testing.T) {
+	// Small segments, so that the replay goes through several segments
+	sink, fake, spool := newSpoolingTestSink(t, SpoolConfig{SegmentBytes: 200})
+	fake.SetOutage(errUnavailable)
+	ctx := context.Background()
+	for i := 1; i <= 10; i++ {
+		_ = sink.Insert(ctx, spoolTestTable, spoolTestRow(i))
+	}
+	segments, _ := filepath.Glob(filepath.Join(spool.config.Directory, "*"+spoolSegmentExtension))
+	if len(segments) < 3 {
+		t.Fatalf("segments: got %d, want several", len(segments))
+	}
+
+	// While the sink is unavailable, the probes of the replay fail and the spool is kept
+	time.Sleep(20 * time.Millisecond)
+	if _, err := spool.Replay(func(entry SpoolEntry) error { return sink.replay(ctx, entry) }); !errors.Is(err, errUnavailable) {
+		t.Fatalf("replay during the outage: got %v, want the outage error", err)
+	}
+	if stats := spool.Stats(); stats.Entries != 9 {
+		t.Fatalf("entries after a failed replay: got %d, want 9", stats.Entries)
+	}
+
+	fake.SetOutage(nil)
+	replaySpool(t, sink, spool)
+	var want []string
+	for i := 2; i <= 10; i++ {
+		want = append(want, spoolTestRow(i).InsertId)
+	}
+	if got := insertIds(fake.Rows(spoolTestTable.Key())); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("replayed rows: got %v, want %v", got, want)
+	}
+	if state := sink.breaker.State(); state != BreakerClosed {
+		t.Errorf("breaker after the replay: got %s, want %s", state, BreakerClosed)
+	}
+	if stats := sink.Stats(); stats.Replayed != 9 || stats.Entries != 0 || stats.Bytes != 0 {
+		t.Errorf("stats after the replay: got %+v", stats)
+	}
+	// The replayed segments are removed, only the active one is kept
+	if segments, _ := filepath.Glob(filepath.Join(spool.config.Directory, "*"+spoolSegmentExtension)); len(segments) != 1 {
+		t.Errorf("segments after the replay: got %d, want 1", len(segments))
+	}
+
+	// Once the spool is empty and the breaker closed, the rows are inserted directly
+	if err := sink.Insert(ctx, spoolTestTable, spoolTestRow(11)); err != nil {
+		t.Fatalf("insert after the replay: %v", err)
+	}
+	if rows := fake.Rows(spoolTestTable.Key()); rows[len(rows)-1].InsertId != spoolTestRow(11).InsertId {
+		t.Errorf("last row: got %s, want %s", rows[len(rows)-1].InsertId, spoolTestRow(11).InsertId)
+	}
+}
+
+func TestSpoolingSinkRespectsMaxBytes(t *testing.T) {
+	entry, err := json.Marshal(SpoolEntry{Table: spoolTestTable.Key(), InsertId: spoolTestRow(1).InsertId, MessageId: "message-1", Row: RawRow{"value": json.RawMessage("1")}, SpooledAt: time.Now().UTC()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Room for 3 entries
+	maxBytes := int64(3*(len(entry)+1) + 10)
+	sink, fake, spool := newSpoolingTestSink(t, SpoolConfig{MaxBytes: maxBytes})
+	fake.SetOutage(errUnavailable)
+	ctx := context.Background()
+	_ = sink.Insert(ctx, spoolTestTable, spoolTestRow(1))
+
+	var errs []error
+	for i := 2; i <= 6; i++ {
+		errs = append(errs, sink.Insert(ctx, spoolTestTable, spoolTestRow(i)))
+	}
+	for i, err := range errs {
+		if i < 3 && err != nil {
+			t.Errorf("insert %d: %v", i+2, err)
+		}
+		if i >= 3 && !errors.Is(err, ErrSpoolFull) {
+			t.Errorf("insert %d: got %v, want %v", i+2, err, ErrSpoolFull)
+		}
+	}
+	stats := sink.Stats()
+	if stats.Entries != 3 || stats.Spooled != 3 || stats.Rejected != 2 {
+		t.Errorf("stats: got %+v, want 3 entries spooled and 2 rejected", stats)
+	}
+	if stats.Bytes > maxBytes {
+		t.Errorf("spool bytes: got %d, above the maximum %d", stats.Bytes, maxBytes)
+	}
+
+	// The rejected rows are not replayed: their messages are redelivered instead
+	fake.SetOutage(nil)
+	replaySpool(t, sink, spool)
+	want := []string{spoolTestRow(2).InsertId, spoolTestRow(3).InsertId, spoolTestRow(4).InsertId}
+	if got := insertIds(fake.Rows(spoolTestTable.Key())); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("replayed rows: got %v, want %v", got, want)
+	}
+}
+
+func TestSpoolSurvivesRestart(t *testing.T) {
+	directory := t.TempDir()
+	spool, err := OpenSpool(SpoolConfig{Directory: directory, NoSync: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		if err := spool.Append(SpoolEntry{Table: spoolTestTable.Key(), InsertId: spoolTestRow(i).InsertId}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Replay the first entry only
+	stop := errors.New("stop")
+	replayed := 0
+	_, _ = spool.Replay(func(entry SpoolEntry) error {
+		if replayed == 1 {
+			return stop
+		}
+		replayed++
+		return nil
+	})
+	spool.Close()
+	// A crash in the middle of an append leaves a truncated entry
+	segments, _ := filepath.Glob(filepath.Join(directory, "*"+spoolSegmentExtension))
+	file, err := os.OpenFile(segments[len(segments)-1], os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = file.WriteString(`{"table":"brevo.ev`)
+	file.Close()
+
+	spool, err = OpenSpool(SpoolConfig{Directory: directory, NoSync: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+	if stats := spool.Stats(); stats.Entries != 2 {
+		t.Fatalf("entries after the restart: got %d, want 2", stats.Entries)
+	}
+	var got []string
+	if _, err := spool.Replay(func(entry SpoolEntry) error {
+		got = append(got, entry.InsertId)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{spoolTestRow(2).InsertId, spoolTestRow(3).InsertId}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("replayed entries: got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,319 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/bigquery/storage/managedwriter"
+	"cloud.google.com/go/bigquery/storage/managedwriter/adapt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+const (
+	WriteModeStreaming    = "streaming"
+	WriteModeStorageWrite = "storage-write"
+	WriteModeLoad         = "load"
+)
+
+/*
+WriteModeSink sends the rows of each table to the sink of its write mode: streaming inserts (default), the Storage Write
+API, or batched load jobs. The load sink is only available in the worker.
+*/
+type WriteModeSink struct {
+	Streaming    Sink
+	StorageWrite Sink
+	Load         Sink
+}
+
+/*
+Create the sink of the write modes. Without a load sink, the rows of the tables in load mode are rejected.
+*/
+func NewWriteModeSink(bqContext *BqContext, load *LoadSink) WriteModeSink {
+	sink := WriteModeSink{Streaming: NewBigquerySink(bqContext), StorageWrite: NewStorageWriteSink(bqContext)}
+	if load != nil {
+		sink.Load = load
+	}
+	return sink
+}
+
+/*
+Check the write mode of the table and its load settings
+*/
+func (table Table) ValidateWriteMode() error {
+	switch table.WriteMode {
+	case "", WriteModeStreaming, WriteModeStorageWrite:
+		return nil
+	case WriteModeLoad:
+		switch table.Load.Format {
+		case "", LoadFormatNDJSON, LoadFormatAvro:
+		default:
+			return fmt.Errorf("invalid load format %s of table %s", table.Load.Format, table.Key())
+		}
+		if table.Load.Bucket != "" && !strings.HasPrefix(table.Load.Bucket, "gs://") {
+			return fmt.Errorf("invalid load bucket %s of table %s: expected gs://bucket/prefix", table.Load.Bucket, table.Key())
+		}
+		return nil
+	default:
+		return fmt.Errorf("invalid write mode %s of table %s", table.WriteMode, table.Key())
+	}
+}
+
+func (sink WriteModeSink) Insert(ctx context.Context, table Table, row InsertRow) error {
+	switch table.WriteMode {
+	case WriteModeStorageWrite:
+		return sink.StorageWrite.Insert(ctx, table, row)
+	case WriteModeLoad:
+		if sink.Load == nil {
+			return fmt.Errorf("write mode %s of table %s requires the worker", WriteModeLoad, table.Key())
+		}
+		return sink.Load.Insert(ctx, table, row)
+	default:
+		return sink.Streaming.Insert(ctx, table, row)
+	}
+}
+
+/*
+StorageWriteSink appends the rows to the default stream of the tables with the Storage Write API, which is cheaper than
+streaming inserts. The default stream is at-least-once: the insert ids are not used to deduplicate the rows.
+*/
+type StorageWriteSink struct {
+	bqContext *BqContext
+	mu        sync.Mutex
+	clients   map[clientKey]*managedwriter.Client
+	streams   map[string]*storageStream
+}
+
+type storageStream struct {
+	stream     *managedwriter.ManagedStream
+	descriptor protoreflect.MessageDescriptor
+	schema     bigquery.Schema
+}
+
+func NewStorageWriteSink(bqContext *BqContext) *StorageWriteSink {
+	return &StorageWriteSink{bqContext: bqContext, clients: make(map[clientKey]*managedwriter.Client), streams: make(map[string]*storageStream)}
+}
+
+func (sink *StorageWriteSink) Insert(ctx context.Context, table Table, row InsertRow) error {
+	// The table must be provisioned and healthy, like for streaming inserts
+	if _, err := sink.bqContext.GetUploader(ctx, table); err != nil {
+		return err
+	}
+	stream, err := sink.getStream(ctx, table)
+	if err != nil {
+		return err
+	}
+	row.InsertedAt = time.Now().UTC()
+	data, err := stream.encode(row)
+	if err != nil {
+		// The row does not match the schema of the table
+		return StorageRowErrors{{Reason: "invalid", Message: err.Error()}}
+	}
+	err = sink.bqContext.Retry.Do(ctx, func(ctx context.Context) error {
+		if timeout := sink.bqContext.InsertTimeout.Duration; timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		result, err := stream.stream.AppendRows(ctx, [][]byte{data})
+		if err != nil {
+			return err
+		}
+		response, err := result.FullResponse(ctx)
+		if rowErrors := response.GetRowErrors(); len(rowErrors) > 0 {
+			storageErr := StorageRowErrors{}
+			for _, rowError := range rowErrors {
+				storageErr = append(storageErr, RowError{Field: storageErrorField(rowError.GetMessage()), Reason: rowError.GetCode().String(), Message: rowError.GetMessage()})
+			}
+			return storageErr
+		}
+		if err != nil && ctx.Err() != nil && !errors.Is(err, ctx.Err()) {
+			return fmt.Errorf("%w: %w", ctx.Err(), err)
+		}
+		return err
+	})
+	if status.Code(err) == codes.NotFound {
+		// The stream of the table is opened again once the table is created again
+		sink.closeStream(table)
+		return sink.bqContext.tableNotFound(ctx, table, err)
+	}
+	return err
+}
+
+/*
+Close and forget the managed stream of the table
+*/
+func (sink *StorageWriteSink) closeStream(table Table) {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if stream, ok := sink.streams[table.Key()]; ok {
+		_ = stream.stream.Close()
+		delete(sink.streams, table.Key())
+	}
+}
+
+/*
+Get the managed stream of the table, opening it on the first row
+*/
+func (sink *StorageWriteSink) getStream(ctx context.Context, table Table) (*storageStream, error) {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if stream, ok := sink.streams[table.Key()]; ok {
+		return stream, nil
+	}
+	key := sink.bqContext.clientKey(table)
+	client, ok := sink.clients[key]
+	if !ok {
+		opts, err := sink.bqContext.clientOptions(key)
+		if err != nil {
+			return nil, err
+		}
+		client, err = managedwriter.NewClient(sink.bqContext.Ctx, key.projectId, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create storage write client for project %s: %v", key.projectId, err)
+		}
+		sink.clients[key] = client
+	}
+	schema, err := table.Schema()
+	if err != nil {
+		return nil, err
+	}
+	storageSchema, err := adapt.BQSchemaToStorageTableSchema(schema)
+	if err != nil {
+		return nil, err
+	}
+	descriptor, err := adapt.StorageSchemaToProto2Descriptor(storageSchema, "root")
+	if err != nil {
+		return nil, err
+	}
+	messageDescriptor, ok := descriptor.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("invalid proto descriptor for table %s", table.Key())
+	}
+	normalized, err := adapt.NormalizeDescriptor(messageDescriptor)
+	if err != nil {
+		return nil, err
+	}
+	managedStream, err := client.NewManagedStream(sink.bqContext.Ctx,
+		managedwriter.WithDestinationTable(managedwriter.TableParentFromParts(key.projectId, table.DatasetId, table.TableId)),
+		managedwriter.WithType(managedwriter.DefaultStream),
+		managedwriter.WithSchemaDescriptor(normalized),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open storage write stream of table %s: %v", table.Key(), err)
+	}
+	logger.InfoContext(ctx, "Storage write stream opened", "table", table.Key())
+	stream := &storageStream{stream: managedStream, descriptor: messageDescriptor, schema: schema}
+	sink.streams[table.Key()] = stream
+	return stream, nil
+}
+
+/*
+Encode the row in the protocol buffer format of the stream. Timestamps are converted to microseconds since the epoch.
+*/
+func (stream *storageStream) encode(row InsertRow) ([]byte, error) {
+	raw, err := row.Raw()
+	if err != nil {
+		return nil, err
+	}
+	values, err := decodeRawRow(raw)
+	if err != nil {
+		return nil, err
+	}
+	encoded, err := json.Marshal(storageValues(stream.schema, values))
+	if err != nil {
+		return nil, err
+	}
+	message := dynamicpb.NewMessage(stream.descriptor)
+	if err := (protojson.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(encoded, message); err != nil {
+		return nil, fmt.Errorf("failed to convert row to protocol buffer: %v", err)
+	}
+	return proto.Marshal(message)
+}
+
+func storageValues(schema bigquery.Schema, values map[string]any) map[string]any {
+	for _, field := range schema {
+		value, ok := values[field.Name]
+		if !ok || value == nil {
+			continue
+		}
+		if field.Repeated {
+			if list, ok := value.([]any); ok {
+				for i := range list {
+					list[i] = storageValue(field, list[i])
+				}
+			}
+			continue
+		}
+		values[field.Name] = storageValue(field, value)
+	}
+	return values
+}
+
+func storageValue(field *bigquery.FieldSchema, value any) any {
+	switch field.Type {
+	case bigquery.TimestampFieldType:
+		if s, ok := value.(string); ok {
+			if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+				return t.UnixMicro()
+			}
+		}
+	case bigquery.RecordFieldType:
+		if record, ok := value.(map[string]any); ok {
+			return storageValues(field.Schema, record)
+		}
+	}
+	return value
+}
+
+/*
+Decode the JSON values of a row, keeping the numbers exact
+*/
+func decodeRawRow(raw RawRow) (map[string]any, error) {
+	values := make(map[string]any, len(raw))
+	for name, value := range raw {
+		decoder := json.NewDecoder(strings.NewReader(string(value)))
+		decoder.UseNumber()
+		var decoded any
+		if err := decoder.Decode(&decoded); err != nil {
+			return nil, err
+		}
+		values[name] = decoded
+	}
+	return values, nil
+}
+
+/*
+StorageRowErrors are the errors of the rows rejected by the Storage Write API
+*/
+type StorageRowErrors []RowError
+
+func (e StorageRowErrors) Error() string {
+	messages := make([]string, 0, len(e))
+	for _, rowError := range e {
+		messages = append(messages, rowError.Message)
+	}
+	return "rows rejected by the storage write api: " + strings.Join(messages, "; ")
+}
+
+/*
+The Storage Write API reports the offending field in the message of the row error, such as "Field Email: ..."
+*/
+func storageErrorField(message string) string {
+	if rest, ok := strings.CutPrefix(message, "Field "); ok {
+		if field, _, ok := strings.Cut(rest, ":"); ok {
+			return field
+		}
+	}
+	return ""
+}